@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	// Generated by scripts/gen-v2rayapi.sh from the Xray protos
+	statsService "gcvp/internal/v2rayapi/stats/command"
+)
+
+// trafficAccountant turns V2Ray's cumulative per-user counters into traffic
+// deltas with exactly-once semantics.
+//
+// Counters are read without resetting them. The values whose traffic is
+// already included in TrafficUsedBytes are saved in User.TrafficCounters, in
+// the same write as the traffic itself, keyed by the run ID of the V2Ray
+// process they belong to (a new process starts its counters from zero). So
+// neither a failed save nor a restart of the manager can count traffic twice
+// or drop it: the next cycle simply takes the difference to what was saved.
+//
+// lastSeen keeps the committed values by counter name for the current
+// process too. It is the baseline of users without a saved value, which
+// matters when a deleted user's email tag is given to a new user.
+type trafficAccountant struct {
+	mu         sync.Mutex       // Serializes accounting cycles
+	generation int              // V2Ray generation lastSeen refers to
+	lastSeen   map[string]int64 // Committed value per counter name
+}
+
+var accountant = &trafficAccountant{lastSeen: make(map[string]int64)}
+
+// TrafficCounterState is a pair of V2Ray counter values whose traffic has
+// been added to the user's TrafficUsedBytes.
+type TrafficCounterState struct {
+	Uplink    int64     `json:"uplink"`
+	Downlink  int64     `json:"downlink"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// trafficCounterRuns is how many V2Ray processes a user keeps counter values
+// for. Several instances may run at once; older entries are dropped.
+const trafficCounterRuns = 8
+
+// statsCounterName returns the V2Ray stats counter name for a user tag and
+// direction ("uplink" or "downlink").
+func statsCounterName(userEmailTag, direction string) string {
+	return fmt.Sprintf("user>>>%s>>>traffic>>>%s", userEmailTag, direction)
+}
+
+// parseUserStatName splits a counter name of the form
+// "user>>>{tag}>>>traffic>>>{uplink|downlink}" into tag and direction.
+func parseUserStatName(name string) (userEmailTag, direction string, ok bool) {
+	parts := strings.Split(name, ">>>")
+	if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+		return "", "", false
+	}
+	if parts[3] != "uplink" && parts[3] != "downlink" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// queryV2RayStats fetches every per-user traffic counter with a single
+// QueryStats call and returns them keyed by counter name. Counters are never
+// reset, see trafficAccountant. Users without traffic have no counter yet.
+func queryV2RayStats(client statsService.StatsServiceClient) (map[string]int64, error) {
+	if client == nil {
+		return nil, fmt.Errorf("StatsServiceClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v2rayAPITimeout)
+	defer cancel()
+
+	resp, err := client.QueryStats(ctx, &statsService.QueryStatsRequest{Pattern: "user>>>"})
+	if err != nil {
+		return nil, fmt.Errorf("QueryStats: %v", err)
+	}
+
+	counters := make(map[string]int64, len(resp.GetStat()))
+	for _, stat := range resp.GetStat() {
+		if _, _, ok := parseUserStatName(stat.GetName()); !ok {
+			continue
+		}
+		counters[stat.GetName()] = stat.GetValue()
+	}
+	return counters, nil
+}
+
+// counterDelta returns how much a counter grew since it was last committed.
+// A value below the committed one means the counter was reset, e.g. because
+// the user was re-added, so the whole current value is new traffic.
+func counterDelta(last, value int64) int64 {
+	if value < last {
+		return value
+	}
+	return value - last
+}
+
+// userTraffic returns the traffic the user's counters show beyond what was
+// already saved for run, and the counter values to save once it is counted.
+func (a *trafficAccountant) userTraffic(user User, runID string, counters map[string]int64, now time.Time) (uplinkDelta, downlinkDelta int64, observed TrafficCounterState) {
+	userTag := userStatsTag(user)
+	uplinkName, downlinkName := statsCounterName(userTag, "uplink"), statsCounterName(userTag, "downlink")
+	observed = TrafficCounterState{Uplink: counters[uplinkName], Downlink: counters[downlinkName], UpdatedAt: now}
+
+	saved, ok := user.TrafficCounters[runID]
+	if !ok {
+		saved = TrafficCounterState{Uplink: a.lastSeen[uplinkName], Downlink: a.lastSeen[downlinkName]}
+	}
+	return counterDelta(saved.Uplink, observed.Uplink), counterDelta(saved.Downlink, observed.Downlink), observed
+}
+
+// countersChanged reports whether observed differs from the counter values
+// saved for run (zero if none are).
+func countersChanged(user User, runID string, observed TrafficCounterState) bool {
+	stored := user.TrafficCounters[runID]
+	return stored.Uplink != observed.Uplink || stored.Downlink != observed.Downlink
+}
+
+// saveTrafficCounters records observed as counted for run in a copy of the
+// user's TrafficCounters (the map may be shared with currentUsersConfig),
+// keeping only the trafficCounterRuns most recently updated runs.
+func saveTrafficCounters(user *User, runID string, observed TrafficCounterState) {
+	runs := make(map[string]TrafficCounterState, len(user.TrafficCounters)+1)
+	for id, state := range user.TrafficCounters {
+		runs[id] = state
+	}
+	runs[runID] = observed
+	for len(runs) > trafficCounterRuns {
+		oldest := ""
+		for id, state := range runs {
+			if oldest == "" || state.UpdatedAt.Before(runs[oldest].UpdatedAt) {
+				oldest = id
+			}
+		}
+		delete(runs, oldest)
+	}
+	user.TrafficCounters = runs
+}
+
+// accountTraffic runs one accounting cycle: it reads the counters of all
+// users at once, adds the new traffic of active users to the stored users
+// together with the counter values it came from, and deactivates users over
+// their limits. It returns the users that were deactivated so the caller can remove
+// them from the running inbound, and whether anything had to be saved.
+func accountTraffic(ctx context.Context, store UserStore) (deactivatedUsers []User, saved bool, err error) {
+	accountant.mu.Lock()
+	defer accountant.mu.Unlock()
+
+	generation, runID := v2raySupervisor.Generation(), v2raySupervisor.RunID()
+	if runID == "" {
+		return nil, false, fmt.Errorf("V2Ray is not running")
+	}
+	if generation != accountant.generation {
+		// A new V2Ray process counts from zero.
+		accountant.generation = generation
+		accountant.lastSeen = make(map[string]int64)
+	}
+
+	conn, err := v2rayAPIConnection()
+	if err != nil {
+		return nil, false, err
+	}
+	statsClient := statsService.NewStatsServiceClient(conn)
+
+	// Query outside of configMutex: one RPC for all users, however many there are.
+	counters, err := queryV2RayStats(statsClient)
+	if err != nil {
+		// Nothing was reset, so the traffic is picked up next cycle.
+		return nil, false, err
+	}
+	if v2raySupervisor.RunID() != runID {
+		// The counters may come from the next process; try again next cycle.
+		return nil, false, fmt.Errorf("V2Ray restarted while its stats were queried")
+	}
+
+	configMutex.RLock()
+	activeUsers := make([]User, 0, len(currentUsersConfig))
+	for _, user := range currentUsersConfig {
+		if user.IsActive {
+			activeUsers = append(activeUsers, user)
+		}
+	}
+	configMutex.RUnlock()
+
+	var configChanged bool = false
+	now := time.Now().UTC()
+
+	for _, user := range activeUsers {
+		uplinkDelta, downlinkDelta, observed := accountant.userTraffic(user, runID, counters, now)
+		if uplinkDelta+downlinkDelta > 0 || countersChanged(user, runID, observed) {
+			configChanged = true // New traffic, or counter values not saved yet
+		}
+		if userLimitExceeded(user, now) != "" {
+			configChanged = true
+		}
+	}
+
+	if !configChanged {
+		return nil, false, nil
+	}
+
+	// Apply the deltas to the latest stored users rather than saving our
+	// snapshot: if another instance wrote in the meantime, the store
+	// reloads and this function runs again, taking the deltas against the
+	// counter values saved there, so nothing is counted twice or lost.
+	deactivatedFrom := make(map[string]User) // State before deactivation, for the audit log
+	committed := make(map[string]int64)      // Counter values to remember once persisted
+	err = persistUsers(ctx, store, func(users UsersConfig) error {
+		deactivatedUsers = nil
+		committed = make(map[string]int64)
+		for userID, user := range users {
+			before := user
+			if user.IsActive {
+				uplinkDelta, downlinkDelta, observed := accountant.userTraffic(user, runID, counters, now)
+				if delta := uplinkDelta + downlinkDelta; delta > 0 {
+					log.Printf("Traffic for user %s (tag: %s): Uplink=%d, Downlink=%d, Total Current Period=%d", userID, userStatsTag(user), uplinkDelta, downlinkDelta, delta)
+					user.TrafficUsedBytes += delta
+					log.Printf("User %s updated TrafficUsedBytes to %d", userID, user.TrafficUsedBytes)
+					if user.Status == UserStatusOnHold {
+						startOnHoldUser(&user, now)
+						log.Printf("INFO: On-hold user %s connected for the first time, time limit starts now", userID)
+					}
+				}
+				if countersChanged(user, runID, observed) {
+					saveTrafficCounters(&user, runID, observed)
+				}
+				userTag := userStatsTag(user)
+				committed[statsCounterName(userTag, "uplink")] = observed.Uplink
+				committed[statsCounterName(userTag, "downlink")] = observed.Downlink
+			}
+			if user.IsActive {
+				if reason := userLimitExceeded(user, now); reason != "" {
+					setUserStatus(&user, limitStatus(reason), reason+" reached", now)
+					log.Printf("INFO: User %s DEACTIVATED due to %s. Used: %d bytes, Limit: %.2f GB, Expires: %s",
+						userID, reason, user.TrafficUsedBytes, user.TrafficLimitGB, formatExpiry(user))
+					deactivatedUsers = append(deactivatedUsers, user)
+					deactivatedFrom[userID] = before
+				}
+			}
+			users[userID] = user
+		}
+		return nil
+	})
+	if err != nil {
+		// Nothing was saved: the same traffic is counted again next cycle.
+		return nil, false, fmt.Errorf("failed to save traffic to %s: %v", store.Describe(), err)
+	}
+
+	accountant.commit(committed)
+	for _, user := range deactivatedUsers {
+		recordAudit(ctx, "user.deactivate", user.ID, deactivatedFrom[user.ID], user)
+	}
+	return deactivatedUsers, true, nil
+}
+
+// commit records counter values whose traffic has been persisted.
+func (a *trafficAccountant) commit(observed map[string]int64) {
+	for name, value := range observed {
+		a.lastSeen[name] = value
+	}
+}
+
+// flushTrafficBeforeStop accounts the traffic of the running V2Ray process
+// right before the supervisor stops it, since its counters die with it.
+// Deactivated users need no HandlerService call: the new process is
+// configured from the saved state.
+func flushTrafficBeforeStop(store UserStore) func() {
+	return func() {
+		if _, _, err := accountTraffic(context.Background(), store); err != nil {
+			log.Printf("WARN: Failed to flush traffic before stopping V2Ray: %v", err)
+		}
+	}
+}
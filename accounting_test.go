@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	statsService "gcvp/internal/v2rayapi/stats/command"
+)
+
+// fakeStatsService answers QueryStats with the counters it is given.
+type fakeStatsService struct {
+	statsService.UnimplementedStatsServiceServer
+
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (f *fakeStatsService) QueryStats(ctx context.Context, req *statsService.QueryStatsRequest) (*statsService.QueryStatsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &statsService.QueryStatsResponse{}
+	for name, value := range f.counters {
+		resp.Stat = append(resp.Stat, &statsService.Stat{Name: name, Value: value})
+	}
+	return resp, nil
+}
+
+// set replaces the counters with uplink and downlink values per user tag.
+func (f *fakeStatsService) set(values map[string][2]int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counters = make(map[string]int64)
+	for tag, v := range values {
+		f.counters[statsCounterName(tag, "uplink")] = v[0]
+		f.counters[statsCounterName(tag, "downlink")] = v[1]
+	}
+}
+
+// useFakeV2Ray serves the stats API from a fake service and pretends a V2Ray
+// process with runID is running, for the duration of the test.
+func useFakeV2Ray(t *testing.T, runID string) *fakeStatsService {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &fakeStatsService{}
+	server := grpc.NewServer()
+	statsService.RegisterStatsServiceServer(server, stats)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2rayAPIConnMutex.Lock()
+	v2rayAPIConn = conn
+	v2rayAPIConnMutex.Unlock()
+
+	previousSupervisor, previousAccountant := v2raySupervisor, accountant
+	v2raySupervisor = &V2RaySupervisor{}
+	setFakeV2RayRun(runID, 1)
+	accountant = &trafficAccountant{lastSeen: make(map[string]int64)}
+	t.Cleanup(func() {
+		resetV2RayAPIConnection()
+		v2raySupervisor, accountant = previousSupervisor, previousAccountant
+	})
+	return stats
+}
+
+// setFakeV2RayRun pretends a new V2Ray process was started.
+func setFakeV2RayRun(runID string, generation int) {
+	v2raySupervisor.mu.Lock()
+	v2raySupervisor.proc = &v2rayProcess{runID: runID, generation: generation}
+	v2raySupervisor.generation = generation
+	v2raySupervisor.mu.Unlock()
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		last, value, want int64
+	}{
+		{0, 0, 0},
+		{0, 100, 100},
+		{100, 150, 50},
+		{100, 100, 0},
+		{100, 30, 30}, // Reset counter: everything is new
+	}
+	for _, tt := range tests {
+		if got := counterDelta(tt.last, tt.value); got != tt.want {
+			t.Errorf("counterDelta(%d, %d) = %d, want %d", tt.last, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUserTraffic(t *testing.T) {
+	now := time.Now().UTC()
+	counters := map[string]int64{
+		statsCounterName("tag-a", "uplink"):   100,
+		statsCounterName("tag-a", "downlink"): 40,
+	}
+	a := &trafficAccountant{lastSeen: map[string]int64{
+		statsCounterName("tag-a", "uplink"):   60,
+		statsCounterName("tag-a", "downlink"): 40,
+	}}
+
+	tests := []struct {
+		name         string
+		user         User
+		wantUp       int64
+		wantDown     int64
+		wantObserved TrafficCounterState
+	}{
+		{"values saved for the run", User{EmailTag: "tag-a", TrafficCounters: map[string]TrafficCounterState{"run-1": {Uplink: 90, Downlink: 10}}}, 10, 30, TrafficCounterState{Uplink: 100, Downlink: 40}},
+		{"values saved for another run only", User{EmailTag: "tag-a", TrafficCounters: map[string]TrafficCounterState{"run-0": {Uplink: 1000, Downlink: 1000}}}, 40, 0, TrafficCounterState{Uplink: 100, Downlink: 40}},
+		{"no saved values", User{EmailTag: "tag-a"}, 40, 0, TrafficCounterState{Uplink: 100, Downlink: 40}},
+		{"no counters yet", User{ID: "b"}, 0, 0, TrafficCounterState{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, down, observed := a.userTraffic(tt.user, "run-1", counters, now)
+			tt.wantObserved.UpdatedAt = now
+			if up != tt.wantUp || down != tt.wantDown || observed != tt.wantObserved {
+				t.Errorf("got %d, %d, %+v, want %d, %d, %+v", up, down, observed, tt.wantUp, tt.wantDown, tt.wantObserved)
+			}
+		})
+	}
+}
+
+func TestSaveTrafficCounters(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	shared := make(map[string]TrafficCounterState)
+	for i := 0; i < trafficCounterRuns; i++ {
+		shared[fmt.Sprintf("run-%d", i)] = TrafficCounterState{Uplink: int64(i), UpdatedAt: start.Add(time.Duration(i) * time.Hour)}
+	}
+	user := User{TrafficCounters: shared}
+
+	observed := TrafficCounterState{Uplink: 7, UpdatedAt: start.Add(24 * time.Hour)}
+	if !countersChanged(user, "run-new", observed) {
+		t.Fatal("countersChanged is false for a run without saved values")
+	}
+	saveTrafficCounters(&user, "run-new", observed)
+
+	if len(user.TrafficCounters) != trafficCounterRuns {
+		t.Fatalf("%d runs kept, want %d", len(user.TrafficCounters), trafficCounterRuns)
+	}
+	if _, ok := user.TrafficCounters["run-0"]; ok {
+		t.Error("the least recently updated run was kept")
+	}
+	if user.TrafficCounters["run-new"] != observed {
+		t.Errorf("saved %+v, want %+v", user.TrafficCounters["run-new"], observed)
+	}
+	if len(shared) != trafficCounterRuns || shared["run-new"] != (TrafficCounterState{}) {
+		t.Error("the map the user shared with others was modified")
+	}
+	if countersChanged(user, "run-new", observed) {
+		t.Error("countersChanged is true right after saving the values")
+	}
+}
+
+func TestAccountTraffic(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	stats := useFakeV2Ray(t, "run-1")
+
+	users := UsersConfig{
+		"a":        {ID: "a", EmailTag: "tag-a", IsActive: true, Status: UserStatusActive, TrafficLimitGB: 1},
+		"small":    {ID: "small", EmailTag: "tag-small", IsActive: true, Status: UserStatusActive, TrafficLimitGB: 100.0 / (1024 * 1024 * 1024)},
+		"disabled": {ID: "disabled", EmailTag: "tag-disabled", Status: UserStatusDisabledByAdmin, TrafficLimitGB: 1},
+	}
+	if err := store.Save(ctx, users); err != nil {
+		t.Fatal(err)
+	}
+	useTestUsers(t, users)
+
+	cycle := func(name string, wantSaved bool, wantDeactivated ...string) UsersConfig {
+		t.Helper()
+		deactivated, saved, err := accountTraffic(ctx, store)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if saved != wantSaved || len(deactivated) != len(wantDeactivated) {
+			t.Fatalf("%s: saved = %v, deactivated %v, want %v, %v", name, saved, deactivated, wantSaved, wantDeactivated)
+		}
+		for i, user := range deactivated {
+			if user.ID != wantDeactivated[i] || user.IsActive {
+				t.Fatalf("%s: deactivated %+v, want %v", name, user, wantDeactivated)
+			}
+		}
+		users, err := store.Load(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return users
+	}
+	used := func(users UsersConfig, id string, want int64) {
+		t.Helper()
+		if got := users[id].TrafficUsedBytes; got != want {
+			t.Fatalf("user %s used %d bytes, want %d", id, got, want)
+		}
+	}
+
+	stats.set(map[string][2]int64{"tag-a": {100, 50}, "tag-disabled": {1000, 1000}})
+	users = cycle("first cycle", true)
+	used(users, "a", 150)
+	used(users, "disabled", 0)
+	if state := users["a"].TrafficCounters["run-1"]; state.Uplink != 100 || state.Downlink != 50 {
+		t.Fatalf("saved counters %+v", state)
+	}
+
+	users = cycle("unchanged counters", false)
+	used(users, "a", 150)
+
+	// A restarted manager knows the saved values only.
+	accountant = &trafficAccountant{lastSeen: make(map[string]int64)}
+	stats.set(map[string][2]int64{"tag-a": {130, 50}})
+	users = cycle("after a manager restart", true)
+	used(users, "a", 180)
+
+	// A new V2Ray process counts from zero again.
+	setFakeV2RayRun("run-2", 2)
+	stats.set(map[string][2]int64{"tag-a": {10, 0}, "tag-small": {60, 60}})
+	users = cycle("new V2Ray process", true, "small")
+	used(users, "a", 190)
+	if len(users["a"].TrafficCounters) != 2 {
+		t.Fatalf("counters of %d runs saved, want 2", len(users["a"].TrafficCounters))
+	}
+	if users["small"].Status != UserStatusLimited {
+		t.Fatalf("user over the limit has status %q", users["small"].Status)
+	}
+
+	v2raySupervisor.mu.Lock()
+	v2raySupervisor.proc = nil
+	v2raySupervisor.mu.Unlock()
+	if _, _, err := accountTraffic(ctx, store); err == nil {
+		t.Fatal("accounting without a running V2Ray succeeded")
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Admins are kept in a registry persisted as the "admins" document of the
+// user store. Each admin has a bcrypt password hash and a role; the role
+// decides which permissions the admin's requests are granted.
+
+const (
+	adminsDocument    = "admins"
+	adminsCacheTTL    = 30 * time.Second // Other instances' changes are picked up this late
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+// AdminRole is what an admin is allowed to do.
+type AdminRole string
+
+const (
+	AdminRoleOwner    AdminRole = "owner"    // Everything, including managing admins
+	AdminRoleOperator AdminRole = "operator" // Manage users
+	AdminRoleViewer   AdminRole = "viewer"   // Read-only
+	AdminRoleReseller AdminRole = "reseller" // Manage own users within a budget, see reseller.go
+)
+
+// Permission is checked per route by requirePermission.
+type Permission string
+
+const (
+	PermUsersRead    Permission = "users:read"
+	PermUsersWrite   Permission = "users:write"
+	PermStatsRead    Permission = "stats:read"
+	PermAdminsManage Permission = "admins:manage"
+)
+
+var rolePermissions = map[AdminRole][]Permission{
+	AdminRoleOwner:    {PermUsersRead, PermUsersWrite, PermStatsRead, PermAdminsManage},
+	AdminRoleOperator: {PermUsersRead, PermUsersWrite, PermStatsRead},
+	AdminRoleViewer:   {PermUsersRead, PermStatsRead},
+	AdminRoleReseller: {PermUsersRead, PermUsersWrite},
+}
+
+func validateAdminRole(role AdminRole) error {
+	if _, ok := rolePermissions[role]; !ok {
+		return invalidRequestf("unknown role %q, expected owner, operator, viewer or reseller", role)
+	}
+	return nil
+}
+
+// Admin is an entry of the admin registry.
+type Admin struct {
+	Username          string          `json:"username"`
+	PasswordHash      string          `json:"password_hash"`
+	Role              AdminRole       `json:"role"`
+	CreatedAt         time.Time       `json:"created_at"`
+	PasswordChangedAt *time.Time      `json:"password_changed_at,omitempty"`
+	Budget            *ResellerBudget `json:"budget,omitempty"`       // Resellers only; nil means no limits
+	Charged           ResellerCharge  `json:"charged"`                // Charged to the budget so far
+	TOTP              *AdminTOTP      `json:"totp,omitempty"`         // Second factor, see twofactor.go
+	OIDCSubject       string          `json:"oidc_subject,omitempty"` // Issuer and subject of SSO admins, see oidc.go
+	Email             string          `json:"email,omitempty"`        // Verified email of SSO admins
+}
+
+// AdminsConfig is the admin registry, keyed by lower-cased username.
+type AdminsConfig map[string]Admin
+
+// adminInfo is what the API shows of an admin: everything but the hash.
+type adminInfo struct {
+	Username          string          `json:"username"`
+	Role              AdminRole       `json:"role"`
+	CreatedAt         time.Time       `json:"created_at"`
+	PasswordChangedAt *time.Time      `json:"password_changed_at,omitempty"`
+	Budget            *ResellerBudget `json:"budget,omitempty"`
+	Charged           *ResellerCharge `json:"charged,omitempty"` // Resellers only
+	TwoFactorEnabled  bool            `json:"two_factor_enabled"`
+	SSO               bool            `json:"sso,omitempty"`
+	Email             string          `json:"email,omitempty"`
+}
+
+func (a Admin) info() adminInfo {
+	info := adminInfo{Username: a.Username, Role: a.Role, CreatedAt: a.CreatedAt, PasswordChangedAt: a.PasswordChangedAt, TwoFactorEnabled: a.twoFactorEnabled(), SSO: a.OIDCSubject != "", Email: a.Email}
+	if a.Role == AdminRoleReseller {
+		charged := a.Charged
+		info.Budget, info.Charged = a.Budget, &charged
+	}
+	return info
+}
+
+var (
+	errAdminNotFound = errors.New("admin not found")
+	errAdminExists   = errors.New("admin already exists")
+	errLastOwner     = errors.New("the last owner cannot be removed or demoted")
+)
+
+func adminKey(username string) string {
+	return strings.ToLower(username)
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", invalidRequestf("password must be %d to %d bytes long", minPasswordLength, maxPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("bcrypt: %v", err)
+	}
+	return string(hash), nil
+}
+
+func (a Admin) checkPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) == nil
+}
+
+// countOwners returns how many owners the registry has.
+func countOwners(admins AdminsConfig) int {
+	owners := 0
+	for _, admin := range admins {
+		if admin.Role == AdminRoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+// adminRegistry caches the admin registry of the store.
+type adminRegistry struct {
+	mu       sync.RWMutex
+	admins   AdminsConfig
+	loadedAt time.Time
+}
+
+var admins = &adminRegistry{}
+
+func decodeAdmins(data []byte) (AdminsConfig, error) {
+	registry := make(AdminsConfig)
+	if data == nil {
+		return registry, nil
+	}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal admins: %v", err)
+	}
+	return registry, nil
+}
+
+func (r *adminRegistry) set(registry AdminsConfig) {
+	r.mu.Lock()
+	r.admins = registry
+	r.loadedAt = time.Now()
+	r.mu.Unlock()
+}
+
+// reload reads the registry from the store.
+func (r *adminRegistry) reload(ctx context.Context, store UserStore) error {
+	data, err := store.LoadDocument(ctx, adminsDocument)
+	if err != nil {
+		return fmt.Errorf("failed to load admins from %s: %v", store.Describe(), err)
+	}
+	registry, err := decodeAdmins(data)
+	if err != nil {
+		return err
+	}
+	r.set(registry)
+	return nil
+}
+
+// lookup returns the admin named username, reloading the registry first if
+// the cached copy is older than adminsCacheTTL.
+func (r *adminRegistry) lookup(ctx context.Context, store UserStore, username string) (Admin, bool, error) {
+	r.mu.RLock()
+	stale := time.Since(r.loadedAt) > adminsCacheTTL
+	r.mu.RUnlock()
+	if stale {
+		if err := r.reload(ctx, store); err != nil {
+			return Admin{}, false, err
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	admin, ok := r.admins[adminKey(username)]
+	return admin, ok, nil
+}
+
+// update applies mutate to the latest stored registry and caches the result.
+func (r *adminRegistry) update(ctx context.Context, store UserStore, mutate func(registry AdminsConfig) error) error {
+	var updated AdminsConfig
+	_, err := store.UpdateDocument(ctx, adminsDocument, func(data []byte) ([]byte, error) {
+		registry, err := decodeAdmins(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := mutate(registry); err != nil {
+			return nil, err
+		}
+		updated = registry
+		return json.MarshalIndent(registry, "", "  ")
+	})
+	if err != nil {
+		return err
+	}
+	r.set(updated)
+	return nil
+}
+
+// list returns the cached admins sorted by username.
+func (r *adminRegistry) list() []adminInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]adminInfo, 0, len(r.admins))
+	for _, admin := range r.admins {
+		list = append(list, admin.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// ensureOwnerAdmin creates the first owner from ADMIN_USERNAME and
+// ADMIN_PASSWORD when the registry is empty. Without ADMIN_PASSWORD a random
+// password is generated and logged once. Once admins exist, the variables
+// are ignored.
+func ensureOwnerAdmin(ctx context.Context, store UserStore) error {
+	if err := admins.reload(ctx, store); err != nil {
+		return err
+	}
+	admins.mu.RLock()
+	existing := len(admins.admins)
+	admins.mu.RUnlock()
+	if existing > 0 {
+		if os.Getenv("ADMIN_PASSWORD") != "" {
+			log.Printf("INFO: %d admin(s) registered, ADMIN_USERNAME/ADMIN_PASSWORD are ignored", existing)
+		}
+		return nil
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	if username == "" {
+		username = "admin"
+		log.Println("ADMIN_USERNAME not set, using default 'admin'")
+	}
+	if err := validateUsername(username); err != nil {
+		return fmt.Errorf("ADMIN_USERNAME: %v", err)
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" && oidcSSO != nil {
+		log.Println("INFO: No admins yet and ADMIN_PASSWORD not set; the first SSO login with an owner rule becomes the owner")
+		return nil
+	}
+	if password == "" {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("crypto/rand: %v", err)
+		}
+		password = hex.EncodeToString(b)
+		log.Printf("WARN: ADMIN_PASSWORD not set, generated password for owner %q: %s (change it after logging in)", username, password)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("ADMIN_PASSWORD: %v", err)
+	}
+
+	log.Printf("Creating owner admin %q", username)
+	return admins.update(ctx, store, func(registry AdminsConfig) error {
+		if len(registry) > 0 {
+			return nil // Another instance got there first
+		}
+		registry[adminKey(username)] = Admin{Username: username, PasswordHash: hash, Role: AdminRoleOwner, CreatedAt: time.Now().UTC()}
+		return nil
+	})
+}
+
+// AdminIdentity is the authenticated admin of a request.
+type AdminIdentity struct {
+	Username string
+	Role     AdminRole
+	APIKeyID string       // Set if the request was authenticated with an API key
+	Scopes   []Permission // The API key's scopes, which further limit the role
+
+	SessionID string // Session and jti of the access token, for logging out
+	TokenID   string
+
+	IP string // Client address, for the audit log
+}
+
+func (id AdminIdentity) can(perm Permission) bool {
+	allowed := false
+	for _, p := range rolePermissions[id.Role] {
+		allowed = allowed || p == perm
+	}
+	if !allowed || id.APIKeyID == "" {
+		return allowed
+	}
+	for _, scope := range id.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// permissions returns every permission id has.
+func (id AdminIdentity) permissions() []Permission {
+	var perms []Permission
+	for _, p := range rolePermissions[id.Role] {
+		if id.can(p) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+type adminIdentityKey struct{}
+
+func withAdminIdentity(ctx context.Context, id AdminIdentity) context.Context {
+	return context.WithValue(ctx, adminIdentityKey{}, id)
+}
+
+// adminIdentityFromContext returns the admin set by jwtAuthMiddleware.
+func adminIdentityFromContext(ctx context.Context) (AdminIdentity, bool) {
+	id, ok := ctx.Value(adminIdentityKey{}).(AdminIdentity)
+	return id, ok
+}
+
+// requirePermission rejects requests whose admin lacks perm. It must run
+// behind jwtAuthMiddleware.
+func requirePermission(perm Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := adminIdentityFromContext(r.Context())
+		if !ok || !id.can(perm) {
+			writeAuthError(w, r, http.StatusForbidden, fmt.Sprintf("Permission %s is required", perm))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireReadWrite requires read for GET and HEAD requests and write for the
+// other methods, for v1 routes that serve both on one path.
+func requireReadWrite(read, write Permission, next http.Handler) http.Handler {
+	reader, writer := requirePermission(read, next), requirePermission(write, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			reader.ServeHTTP(w, r)
+			return
+		}
+		writer.ServeHTTP(w, r)
+	})
+}
+
+// writeAdminError maps admin registry errors to v2 error envelopes.
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errAdminNotFound):
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Admin not found")
+	case errors.Is(err, errAdminExists):
+		writeAPIError(w, http.StatusConflict, apiErrConflict, "An admin with this username already exists")
+	case errors.Is(err, errLastOwner):
+		writeAPIError(w, http.StatusConflict, apiErrConflict, "The last owner cannot be removed or demoted")
+	case errors.Is(err, errAPIKeyNotFound):
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "API key not found")
+	case errors.Is(err, errInvalidSecondFactor):
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid two-factor code")
+	case errors.Is(err, errTwoFactorEnabled), errors.Is(err, errTwoFactorNotEnabled),
+		errors.Is(err, errTwoFactorNotStarted), errors.Is(err, errTwoFactorRequired):
+		writeAPIError(w, http.StatusConflict, apiErrConflict, err.Error())
+	default:
+		writeAPIStoreError(w, err)
+	}
+}
+
+// AdminRequest is the body of POST and PATCH /api/v2/admins. PATCH changes
+// only the fields that are set.
+type AdminRequest struct {
+	Username     string          `json:"username"`
+	Password     string          `json:"password"`
+	Role         AdminRole       `json:"role"`
+	Budget       *ResellerBudget `json:"budget"`        // Required for resellers
+	ResetCharged bool            `json:"reset_charged"` // PATCH only: start charging the budget from zero again
+}
+
+// registerAdminRoutes adds the admin management API to mux.
+func registerAdminRoutes(mux *http.ServeMux, store UserStore) {
+	manage := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, jwtAuthMiddleware(store, requireSession(requirePermission(PermAdminsManage, handler))))
+	}
+	manage("GET /api/v2/admins", listAdminsHandler(store))
+	manage("POST /api/v2/admins", createAdminHandler(store))
+	manage("PATCH /api/v2/admins/{username}", updateAdminHandler(store))
+	manage("DELETE /api/v2/admins/{username}", deleteAdminHandler(store))
+	manage("GET /api/v2/resellers", resellersOverviewHandler(store))
+
+	// Any admin can see and change their own account.
+	mux.Handle("GET /api/v2/me", jwtAuthMiddleware(store, http.HandlerFunc(currentAdminHandler)))
+	mux.Handle("POST /api/v2/me/password", jwtAuthMiddleware(store, requireSession(changeOwnPasswordHandler(store))))
+}
+
+func listAdminsHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := admins.reload(r.Context(), store); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, err.Error())
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, admins.list())
+	}
+}
+
+func createAdminHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AdminRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		if err := validateUsername(req.Username); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		if err := validateAdminRole(req.Role); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		if req.Role == AdminRoleReseller && req.Budget == nil {
+			writeAdminError(w, invalidRequestf("budget is required for resellers"))
+			return
+		}
+		if req.Budget != nil {
+			if err := validateResellerBudget(*req.Budget); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		admin := Admin{Username: req.Username, PasswordHash: hash, Role: req.Role, CreatedAt: time.Now().UTC(), Budget: req.Budget}
+		err = admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			if _, ok := registry[adminKey(admin.Username)]; ok {
+				return errAdminExists
+			}
+			registry[adminKey(admin.Username)] = admin
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		actor, _ := adminIdentityFromContext(r.Context())
+		log.Printf("INFO: Admin %s created admin %s with role %s", actor.Username, admin.Username, admin.Role)
+		recordAudit(r.Context(), "admin.create", admin.Username, nil, admin)
+		writeJSONResponse(w, http.StatusCreated, admin.info())
+	}
+}
+
+func updateAdminHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AdminRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		if req.Role != "" {
+			if err := validateAdminRole(req.Role); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+		}
+		if req.Budget != nil {
+			if err := validateResellerBudget(*req.Budget); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+		}
+		var hash string
+		if req.Password != "" {
+			var err error
+			if hash, err = hashPassword(req.Password); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+		}
+
+		key := adminKey(r.PathValue("username"))
+		var previous, updated Admin
+		err := admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			admin, ok := registry[key]
+			if !ok {
+				return errAdminNotFound
+			}
+			previous = admin
+			if req.Role != "" && req.Role != admin.Role {
+				if admin.Role == AdminRoleOwner && countOwners(registry) == 1 {
+					return errLastOwner
+				}
+				admin.Role = req.Role
+			}
+			if admin.Role == AdminRoleReseller && admin.Budget == nil && req.Budget == nil {
+				return invalidRequestf("budget is required for resellers")
+			}
+			if req.Budget != nil {
+				admin.Budget = req.Budget
+			}
+			if req.ResetCharged {
+				admin.Charged = ResellerCharge{}
+			}
+			if hash != "" {
+				now := time.Now().UTC()
+				admin.PasswordHash = hash
+				admin.PasswordChangedAt = &now
+			}
+			registry[key] = admin
+			updated = admin
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		actor, _ := adminIdentityFromContext(r.Context())
+		log.Printf("INFO: Admin %s updated admin %s (role %s)", actor.Username, updated.Username, updated.Role)
+		recordAudit(r.Context(), "admin.update", updated.Username, previous, updated)
+		if hash != "" {
+			endAllSessions(r.Context(), store, updated.Username)
+		}
+		writeJSONResponse(w, http.StatusOK, updated.info())
+	}
+}
+
+func deleteAdminHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := adminKey(r.PathValue("username"))
+		var deleted Admin
+		err := admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			admin, ok := registry[key]
+			if !ok {
+				return errAdminNotFound
+			}
+			if admin.Role == AdminRoleOwner && countOwners(registry) == 1 {
+				return errLastOwner
+			}
+			deleted = admin
+			delete(registry, key)
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		actor, _ := adminIdentityFromContext(r.Context())
+		log.Printf("INFO: Admin %s deleted admin %s", actor.Username, deleted.Username)
+		recordAudit(r.Context(), "admin.delete", deleted.Username, deleted, nil)
+		endAllSessions(r.Context(), store, r.PathValue("username"))
+		revokeAllAPIKeys(r.Context(), store, r.PathValue("username"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// currentAdminHandler serves GET /api/v2/me.
+func currentAdminHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := adminIdentityFromContext(r.Context())
+	me := map[string]interface{}{
+		"username":    id.Username,
+		"role":        id.Role,
+		"permissions": id.permissions(),
+	}
+	if id.APIKeyID != "" {
+		me["api_key_id"] = id.APIKeyID
+	}
+	writeJSONResponse(w, http.StatusOK, me)
+}
+
+// ChangePasswordRequest is the body of POST /api/v2/me/password.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func changeOwnPasswordHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		hash, err := hashPassword(req.NewPassword)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		id, _ := adminIdentityFromContext(r.Context())
+		key := adminKey(id.Username)
+		err = admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			admin, ok := registry[key]
+			if !ok {
+				return errAdminNotFound
+			}
+			if !admin.checkPassword(req.CurrentPassword) {
+				return invalidRequestf("current_password is wrong")
+			}
+			now := time.Now().UTC()
+			admin.PasswordHash = hash
+			admin.PasswordChangedAt = &now
+			registry[key] = admin
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("INFO: Admin %s changed their password", id.Username)
+		recordAudit(r.Context(), "admin.password_change", id.Username, nil, nil)
+		// Other sessions have to log in with the new password
+		err = endSessions(r.Context(), store, id.Username, func(session Session) bool { return session.ID != id.SessionID })
+		if err != nil {
+			log.Printf("ERROR: Failed to end other sessions of admin %s: %v", id.Username, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The v2 API addresses users by path (/api/v2/users/{id}) using the
+// method-aware ServeMux patterns of Go 1.22 and reports every error in the
+// same envelope: {"error": {"code": "...", "message": "..."}}.
+
+const (
+	apiV2Prefix          = "/api/v2/"
+	defaultUsersPageSize = 50
+	maxUsersPageSize     = 500
+)
+
+// Error codes of the v2 error envelope.
+const (
+	apiErrInvalidRequest   = "invalid_request"
+	apiErrUnauthorized     = "unauthorized"
+	apiErrForbidden        = "forbidden"
+	apiErrNotFound         = "not_found"
+	apiErrMethodNotAllowed = "method_not_allowed"
+	apiErrConflict         = "conflict"
+	apiErrBudgetExceeded   = "budget_exceeded"
+	apiErrV2RaySync        = "v2ray_sync_failed"
+	apiErrInternal         = "internal"
+)
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+// writeAPIError writes a v2 error envelope.
+func writeAPIError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeJSONResponse(w, statusCode, apiErrorEnvelope{Error: apiError{Code: code, Message: message}})
+}
+
+// writeAPIStoreError is the v2 counterpart of writeStoreError.
+func writeAPIStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "User not found")
+	case errors.Is(err, errInvalidRequest):
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, strings.TrimPrefix(err.Error(), errInvalidRequest.Error()+": "))
+	case errors.Is(err, errBudgetExceeded):
+		writeAPIError(w, http.StatusForbidden, apiErrBudgetExceeded, err.Error())
+	case errors.Is(err, errUsernameTaken):
+		writeAPIError(w, http.StatusConflict, apiErrConflict, "Username is already taken")
+	case errors.Is(err, errApplyToV2Ray):
+		writeAPIError(w, http.StatusInternalServerError, apiErrV2RaySync, err.Error())
+	case errors.Is(err, ErrStoreConflict):
+		writeAPIError(w, http.StatusConflict, apiErrConflict, "User was modified concurrently by another instance; reload and try again")
+	default:
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Failed to save configuration: "+err.Error())
+	}
+}
+
+// isAPIV2Request reports whether r should get v2 error envelopes.
+func isAPIV2Request(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiV2Prefix)
+}
+
+// registerAPIV2Routes adds the v2 user API to mux, behind JWT auth and the
+// permission each route needs.
+func registerAPIV2Routes(mux *http.ServeMux, store UserStore) {
+	handle := func(pattern string, perm Permission, handler http.HandlerFunc) {
+		mux.Handle(pattern, jwtAuthMiddleware(store, requirePermission(perm, handler)))
+	}
+	handle("GET /api/v2/users", PermUsersRead, listUsersV2Handler)
+	handle("POST /api/v2/users", PermUsersWrite, createUserV2Handler(store))
+	handle("GET /api/v2/users/{id}", PermUsersRead, getUserV2Handler)
+	handle("PUT /api/v2/users/{id}", PermUsersWrite, modifyUserV2Handler(store))
+	handle("PATCH /api/v2/users/{id}", PermUsersWrite, modifyUserV2Handler(store))
+	handle("DELETE /api/v2/users/{id}", PermUsersWrite, deleteUserV2Handler(store))
+	handle("POST /api/v2/users/{id}/expiry", PermUsersWrite, userExpiryV2Handler(store))
+
+	// Anything else under /api/v2/ gets an envelope instead of the mux's plain
+	// text 404 or 405. The catch-all matches every method, so the mux itself
+	// would never answer 405 for a known path.
+	mux.HandleFunc(apiV2Prefix, func(w http.ResponseWriter, r *http.Request) {
+		if allowed := allowedMethods(mux, r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeAPIError(w, http.StatusMethodNotAllowed, apiErrMethodNotAllowed, fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path))
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, fmt.Sprintf("No route for %s %s", r.Method, r.URL.Path))
+	})
+}
+
+// allowedMethods returns the methods a pattern of mux other than the v2
+// catch-all accepts for the path of r.
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "" && pattern != apiV2Prefix {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// usersListQuery holds the parsed query of GET /api/v2/users.
+type usersListQuery struct {
+	Limit          int
+	Offset         int
+	Statuses       map[UserStatus]bool // Empty means any
+	ExpiringBefore *time.Time
+	OverQuotaPct   *float64
+	Label          string
+	Search         string // Lower-cased
+	SortField      string
+	SortDesc       bool
+}
+
+// parseTimeParam accepts RFC 3339 timestamps and plain dates (midnight UTC).
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func parseUsersListQuery(r *http.Request) (usersListQuery, error) {
+	params := r.URL.Query()
+	q := usersListQuery{Limit: defaultUsersPageSize, SortField: "created_at"}
+
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUsersPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxUsersPageSize)
+		}
+		q.Limit = n
+	}
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("offset must be a non-negative integer")
+		}
+		q.Offset = n
+	}
+	if v := params.Get("status"); v != "" {
+		q.Statuses = make(map[UserStatus]bool)
+		for _, s := range strings.Split(v, ",") {
+			status := UserStatus(strings.TrimSpace(s))
+			switch status {
+			case UserStatusActive, UserStatusDisabledByAdmin, UserStatusLimited, UserStatusExpired, UserStatusOnHold:
+				q.Statuses[status] = true
+			default:
+				return q, fmt.Errorf("unknown status %q", status)
+			}
+		}
+	}
+	if v := params.Get("expiring_before"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			return q, fmt.Errorf("expiring_before must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+		q.ExpiringBefore = &t
+	}
+	if v := params.Get("over_quota_pct"); v != "" {
+		pct, err := strconv.ParseFloat(v, 64)
+		if err != nil || pct < 0 {
+			return q, fmt.Errorf("over_quota_pct must be a non-negative number")
+		}
+		q.OverQuotaPct = &pct
+	}
+	q.Label = params.Get("label")
+	q.Search = strings.ToLower(strings.TrimSpace(params.Get("q")))
+
+	if v := params.Get("sort"); v != "" {
+		q.SortDesc = strings.HasPrefix(v, "-")
+		q.SortField = strings.TrimPrefix(v, "-")
+		switch q.SortField {
+		case "created_at", "usage", "expiry":
+		default:
+			return q, fmt.Errorf("sort must be one of created_at, usage, expiry, optionally prefixed with '-' for descending order")
+		}
+	}
+	return q, nil
+}
+
+// quotaUsedPct returns the share of the traffic limit the user has used, in percent.
+func quotaUsedPct(user User) float64 {
+	limit := user.TrafficLimitGB * 1024 * 1024 * 1024
+	if limit <= 0 {
+		return 0
+	}
+	return float64(user.TrafficUsedBytes) / limit * 100
+}
+
+func (q usersListQuery) matches(user User) bool {
+	if len(q.Statuses) > 0 && !q.Statuses[user.Status] {
+		return false
+	}
+	if q.ExpiringBefore != nil {
+		expiresAt, ok := userExpiry(user)
+		if !ok || !expiresAt.Before(*q.ExpiringBefore) {
+			return false
+		}
+	}
+	if q.OverQuotaPct != nil && quotaUsedPct(user) < *q.OverQuotaPct {
+		return false
+	}
+	if q.Label != "" && !userHasLabel(user, q.Label) {
+		return false
+	}
+	if q.Search != "" && !userMatchesSearch(user, q.Search) {
+		return false
+	}
+	return true
+}
+
+// less orders users by the requested field. Ties, and users without an
+// expiry when sorting by expiry, are ordered by ID so pages are stable.
+func (q usersListQuery) less(a, b User) bool {
+	var cmp int
+	switch q.SortField {
+	case "usage":
+		cmp = compareInt64(a.TrafficUsedBytes, b.TrafficUsedBytes)
+	case "expiry":
+		aExpiry, aOK := userExpiry(a)
+		bExpiry, bOK := userExpiry(b)
+		switch {
+		case aOK && bOK:
+			cmp = aExpiry.Compare(bExpiry)
+		case aOK != bOK:
+			// Users that never expire go last in either direction.
+			return aOK
+		}
+	default:
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if cmp == 0 {
+		return a.ID < b.ID
+	}
+	if q.SortDesc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// usersPage is the response of GET /api/v2/users.
+type usersPage struct {
+	Items      []User `json:"items"`
+	Total      int    `json:"total"` // Users matching the filters
+	Limit      int    `json:"limit"`
+	Offset     int    `json:"offset"`
+	NextOffset *int   `json:"next_offset,omitempty"` // Absent on the last page
+}
+
+// listUsersV2Handler serves GET /api/v2/users with filters, search, sorting and pagination.
+func listUsersV2Handler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseUsersListQuery(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, err.Error())
+		return
+	}
+
+	configMutex.RLock()
+	matched := make([]User, 0, len(currentUsersConfig))
+	for _, user := range currentUsersConfig {
+		if q.matches(user) && userVisibleTo(r.Context(), user) {
+			matched = append(matched, user)
+		}
+	}
+	configMutex.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool { return q.less(matched[i], matched[j]) })
+
+	page := usersPage{Items: []User{}, Total: len(matched), Limit: q.Limit, Offset: q.Offset}
+	if q.Offset < len(matched) {
+		end := q.Offset + q.Limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page.Items = matched[q.Offset:end]
+		if end < len(matched) {
+			page.NextOffset = &end
+		}
+	}
+	writeJSONResponse(w, http.StatusOK, page)
+}
+
+func getUserV2Handler(w http.ResponseWriter, r *http.Request) {
+	user, ok := lookupUser(r.Context(), r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "User not found")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, user)
+}
+
+func createUserV2Handler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var newUser User
+		if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		createdUser, err := createUser(r.Context(), store, newUser)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/v2/users/"+createdUser.ID)
+		writeJSONResponse(w, http.StatusCreated, createdUser)
+	}
+}
+
+// modifyUserV2Handler serves PATCH (partial) and PUT (full replacement).
+func modifyUserV2Handler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var patch UserPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		if r.Method == http.MethodPut {
+			if err := patch.asReplacement(); err != nil {
+				writeAPIStoreError(w, err)
+				return
+			}
+		}
+		updatedUser, err := modifyUser(r.Context(), store, r.PathValue("id"), patch)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, updatedUser)
+	}
+}
+
+func deleteUserV2Handler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deleteUser(r.Context(), store, r.PathValue("id")); err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func userExpiryV2Handler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ExpiryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		updatedUser, err := changeUserExpiry(r.Context(), store, r.PathValue("id"), req)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, updatedUser)
+	}
+}
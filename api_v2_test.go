@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPIV2 serves the v2 routes for requests authenticated as an owner.
+type testAPIV2 struct {
+	mux   *http.ServeMux
+	token string
+}
+
+func newTestAPIV2(t *testing.T) *testAPIV2 {
+	t.Helper()
+	useTestKeyring(t)
+	store := newTestStore(t)
+	admin := addTestAdmin(t, store, Admin{Username: "owner", Role: AdminRoleOwner})
+	mux := http.NewServeMux()
+	registerAPIV2Routes(mux, store)
+	return &testAPIV2{mux: mux, token: startTestSession(t, store, admin).Token}
+}
+
+func (a *testAPIV2) do(method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+a.token)
+	w := httptest.NewRecorder()
+	a.mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestListUsersV2(t *testing.T) {
+	api := newTestAPIV2(t)
+	now := time.Now().UTC()
+	day := func(n int) time.Time { return now.AddDate(0, 0, n) }
+	ptr := func(t time.Time) *time.Time { return &t }
+	const gb = 1 << 30
+	useTestUsers(t, UsersConfig{
+		"a": {ID: "a", CreatedAt: day(-4), Status: UserStatusActive, TrafficLimitGB: 1, TrafficUsedBytes: gb * 95 / 100, ExpiresAt: ptr(day(5)), Username: "alice", Labels: []string{"VIP"}},
+		"b": {ID: "b", CreatedAt: day(-3), Status: UserStatusLimited, TrafficLimitGB: 1, TrafficUsedBytes: gb, Note: "Bob's phone"},
+		"c": {ID: "c", CreatedAt: day(-2), Status: UserStatusOnHold, TrafficLimitGB: 1, TimeLimitDays: 30},
+		"d": {ID: "d", CreatedAt: day(-1), Status: UserStatusExpired, TrafficLimitGB: 2, TrafficUsedBytes: gb / 2, ExpiresAt: ptr(day(-1)), Contact: "carol@example.com", Labels: []string{"vip"}},
+	})
+
+	tests := []struct {
+		query    string
+		want     []string
+		wantNext int // 0 if there is no next page
+		total    int
+	}{
+		{"", []string{"a", "b", "c", "d"}, 0, 4},
+		{"?status=limited,expired", []string{"b", "d"}, 0, 2},
+		{"?status=on_hold", []string{"c"}, 0, 1},
+		{"?expiring_before=" + day(10).Format("2006-01-02"), []string{"a", "d"}, 0, 2},
+		{"?expiring_before=" + now.Format(time.RFC3339), []string{"d"}, 0, 1},
+		{"?over_quota_pct=90", []string{"a", "b"}, 0, 2},
+		{"?label=vip", []string{"a", "d"}, 0, 2},
+		{"?q=ALICE", []string{"a"}, 0, 1},
+		{"?q=phone", []string{"b"}, 0, 1},
+		{"?q=carol@", []string{"d"}, 0, 1},
+		{"?label=vip&status=active", []string{"a"}, 0, 1},
+		{"?sort=-created_at", []string{"d", "c", "b", "a"}, 0, 4},
+		{"?sort=usage", []string{"c", "d", "a", "b"}, 0, 4},
+		{"?sort=expiry", []string{"d", "a", "b", "c"}, 0, 4},
+		{"?sort=-expiry", []string{"a", "d", "b", "c"}, 0, 4},
+		{"?limit=2", []string{"a", "b"}, 2, 4},
+		{"?limit=2&offset=2", []string{"c", "d"}, 0, 4},
+		{"?offset=10", []string{}, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := api.do(http.MethodGet, "/api/v2/users"+tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+			var page usersPage
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(page.Items))
+			for _, user := range page.Items {
+				ids = append(ids, user.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") || page.Total != tt.total {
+				t.Errorf("got %v of %d, want %v of %d", ids, page.Total, tt.want, tt.total)
+			}
+			if next := page.NextOffset; (next == nil) != (tt.wantNext == 0) || next != nil && *next != tt.wantNext {
+				t.Errorf("next_offset %v, want %d", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestListUsersV2InvalidQuery(t *testing.T) {
+	api := newTestAPIV2(t)
+	useTestUsers(t, UsersConfig{})
+	for _, query := range []string{
+		"limit=0",
+		"limit=501",
+		"limit=x",
+		"offset=-1",
+		"status=active,unknown",
+		"expiring_before=tomorrow",
+		"over_quota_pct=-5",
+		"sort=name",
+	} {
+		w := api.do(http.MethodGet, "/api/v2/users?"+query)
+		var envelope apiErrorEnvelope
+		if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil || w.Code != http.StatusBadRequest || envelope.Error.Code != apiErrInvalidRequest {
+			t.Errorf("%s: got %d %s", query, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAPIV2MethodNotAllowed(t *testing.T) {
+	api := newTestAPIV2(t)
+	useTestUsers(t, UsersConfig{})
+	tests := []struct {
+		method, path string
+		want         int
+		allow        string
+		code         string
+	}{
+		{http.MethodDelete, "/api/v2/users", http.StatusMethodNotAllowed, "GET, HEAD, POST", apiErrMethodNotAllowed},
+		{http.MethodPost, "/api/v2/users/u1", http.StatusMethodNotAllowed, "GET, HEAD, PUT, PATCH, DELETE", apiErrMethodNotAllowed},
+		{http.MethodGet, "/api/v2/users/u1/expiry", http.StatusMethodNotAllowed, "POST", apiErrMethodNotAllowed},
+		{http.MethodGet, "/api/v2/nothing", http.StatusNotFound, "", apiErrNotFound},
+		{http.MethodGet, "/api/v2/users/u1", http.StatusNotFound, "", apiErrNotFound},
+	}
+	for _, tt := range tests {
+		w := api.do(tt.method, tt.path)
+		var envelope apiErrorEnvelope
+		if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+			t.Errorf("%s %s: no error envelope: %s", tt.method, tt.path, w.Body)
+			continue
+		}
+		if w.Code != tt.want || w.Header().Get("Allow") != tt.allow || envelope.Error.Code != tt.code {
+			t.Errorf("%s %s: got %d, Allow %q, code %q, want %d, %q, %q", tt.method, tt.path, w.Code, w.Header().Get("Allow"), envelope.Error.Code, tt.want, tt.allow, tt.code)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// API keys let scripts call the API without logging in. A key belongs to an
+// admin and acts with the admin's role, further limited to the key's scopes.
+// Keys look like gcvp_<id>_<secret>; only the SHA-256 hash of the whole key
+// is stored, in the "api_keys" document of the user store, and the key
+// itself is shown once when it is created.
+
+const (
+	apiKeysDocument     = "api_keys"
+	apiKeyPrefix        = "gcvp_"
+	apiKeyIDBytes       = 4
+	apiKeySecretBytes   = 32
+	apiKeyTouchInterval = time.Minute // LastUsedAt is saved at most this often per key
+	maxAPIKeysPerAdmin  = 50
+	maxAPIKeyNameLength = 64
+)
+
+// apiKeyScopes are the permissions an API key may be granted. Managing admins
+// and API keys always requires a login session.
+var apiKeyScopes = []Permission{PermUsersRead, PermUsersWrite, PermStatsRead}
+
+// APIKey is an entry of the API key registry.
+type APIKey struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"` // gcvp_<id>, to recognize the key
+	Hash       string       `json:"hash"`   // SHA-256 of the whole key, hex
+	Owner      string       `json:"owner"`  // Username of the admin the key acts as
+	Scopes     []Permission `json:"scopes"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  *time.Time   `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time   `json:"last_used_at,omitempty"`
+}
+
+// APIKeysConfig is the API key registry, keyed by key ID.
+type APIKeysConfig map[string]APIKey
+
+// apiKeyInfo is what the API shows of a key: everything but the hash.
+type apiKeyInfo struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"`
+	Owner      string       `json:"owner"`
+	Scopes     []Permission `json:"scopes"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  *time.Time   `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time   `json:"last_used_at,omitempty"`
+	Key        string       `json:"key,omitempty"` // Only in the response that created the key
+}
+
+func (k APIKey) info() apiKeyInfo {
+	return apiKeyInfo{ID: k.ID, Name: k.Name, Prefix: k.Prefix, Owner: k.Owner, Scopes: k.Scopes, CreatedAt: k.CreatedAt, ExpiresAt: k.ExpiresAt, LastUsedAt: k.LastUsedAt}
+}
+
+var (
+	errAPIKeyNotFound = errors.New("API key not found")
+	errInvalidAPIKey  = errors.New("invalid API key")
+	errAPIKeyExpired  = errors.New("API key has expired")
+)
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a new key and its ID.
+func newAPIKey() (key, id string, err error) {
+	b := make([]byte, apiKeyIDBytes+apiKeySecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("crypto/rand: %v", err)
+	}
+	id = hex.EncodeToString(b[:apiKeyIDBytes])
+	return apiKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(b[apiKeyIDBytes:]), id, nil
+}
+
+// apiKeyID returns the ID part of a key, or false if key is not shaped like one.
+func apiKeyID(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(id) != 2*apiKeyIDBytes || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// validateAPIKeyScopes checks that scopes are grantable to keys and allowed
+// to the role of the admin creating the key.
+func validateAPIKeyScopes(scopes []Permission, role AdminRole) error {
+	if len(scopes) == 0 {
+		return invalidRequestf("at least one scope is required")
+	}
+	owner := AdminIdentity{Role: role}
+	for _, scope := range scopes {
+		grantable := false
+		for _, allowed := range apiKeyScopes {
+			grantable = grantable || scope == allowed
+		}
+		if !grantable {
+			return invalidRequestf("unknown scope %q, expected users:read, users:write or stats:read", scope)
+		}
+		if !owner.can(scope) {
+			return invalidRequestf("scope %s exceeds the permissions of role %s", scope, role)
+		}
+	}
+	return nil
+}
+
+// apiKeyRegistry caches the API key registry of the store, like adminRegistry.
+type apiKeyRegistry struct {
+	mu       sync.RWMutex
+	keys     APIKeysConfig
+	loadedAt time.Time
+	touched  map[string]time.Time // When LastUsedAt was last saved, by key ID
+}
+
+var apiKeys = &apiKeyRegistry{touched: make(map[string]time.Time)}
+
+func decodeAPIKeys(data []byte) (APIKeysConfig, error) {
+	registry := make(APIKeysConfig)
+	if data == nil {
+		return registry, nil
+	}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal API keys: %v", err)
+	}
+	return registry, nil
+}
+
+func (r *apiKeyRegistry) set(registry APIKeysConfig) {
+	r.mu.Lock()
+	r.keys = registry
+	r.loadedAt = time.Now()
+	r.mu.Unlock()
+}
+
+func (r *apiKeyRegistry) reload(ctx context.Context, store UserStore) error {
+	data, err := store.LoadDocument(ctx, apiKeysDocument)
+	if err != nil {
+		return fmt.Errorf("failed to load API keys from %s: %v", store.Describe(), err)
+	}
+	registry, err := decodeAPIKeys(data)
+	if err != nil {
+		return err
+	}
+	r.set(registry)
+	return nil
+}
+
+// update applies mutate to the latest stored registry and caches the result.
+func (r *apiKeyRegistry) update(ctx context.Context, store UserStore, mutate func(registry APIKeysConfig) error) error {
+	var updated APIKeysConfig
+	_, err := store.UpdateDocument(ctx, apiKeysDocument, func(data []byte) ([]byte, error) {
+		registry, err := decodeAPIKeys(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := mutate(registry); err != nil {
+			return nil, err
+		}
+		updated = registry
+		return json.MarshalIndent(registry, "", "  ")
+	})
+	if err != nil {
+		return err
+	}
+	r.set(updated)
+	return nil
+}
+
+// verify returns the stored key matching key, reloading the registry first
+// if the cached copy is older than adminsCacheTTL. Revoked keys therefore
+// keep working on other instances for up to that long.
+func (r *apiKeyRegistry) verify(ctx context.Context, store UserStore, key string, now time.Time) (APIKey, error) {
+	id, ok := apiKeyID(key)
+	if !ok {
+		return APIKey{}, errInvalidAPIKey
+	}
+	r.mu.RLock()
+	stale := time.Since(r.loadedAt) > adminsCacheTTL
+	r.mu.RUnlock()
+	if stale {
+		if err := r.reload(ctx, store); err != nil {
+			return APIKey{}, err
+		}
+	}
+
+	r.mu.RLock()
+	stored, ok := r.keys[id]
+	r.mu.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashAPIKey(key))) != 1 {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if stored.ExpiresAt != nil && !now.Before(*stored.ExpiresAt) {
+		return APIKey{}, errAPIKeyExpired
+	}
+	return stored, nil
+}
+
+// touch saves that the key was used now, in the background and at most once
+// per apiKeyTouchInterval, so that busy scripts do not cause a store write
+// per request.
+func (r *apiKeyRegistry) touch(store UserStore, id string, now time.Time) {
+	r.mu.Lock()
+	if now.Sub(r.touched[id]) < apiKeyTouchInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.touched[id] = now
+	r.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := r.update(ctx, store, func(registry APIKeysConfig) error {
+			key, ok := registry[id]
+			if !ok {
+				return nil // Revoked meanwhile
+			}
+			key.LastUsedAt = &now
+			registry[id] = key
+			return nil
+		})
+		if err != nil {
+			log.Printf("WARN: Failed to record use of API key %s: %v", id, err)
+		}
+	}()
+}
+
+// list returns the cached keys of owner (all keys if owner is empty), newest first.
+func (r *apiKeyRegistry) list(owner string) []apiKeyInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]apiKeyInfo, 0)
+	for _, key := range r.keys {
+		if owner == "" || adminKey(key.Owner) == adminKey(owner) {
+			list = append(list, key.info())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// apiKeyFromRequest returns the API key of a request: the X-API-Key header,
+// or a bearer token that looks like an API key rather than a JWT.
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "bearer") && strings.HasPrefix(token, apiKeyPrefix) {
+		return token, true
+	}
+	return "", false
+}
+
+// authenticateAPIKey is the API key branch of jwtAuthMiddleware.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, store UserStore, key string, next http.Handler) {
+	now := time.Now().UTC()
+	stored, err := apiKeys.verify(r.Context(), store, key, now)
+	switch {
+	case errors.Is(err, errInvalidAPIKey):
+		writeAuthError(w, r, http.StatusUnauthorized, "Invalid API key")
+		return
+	case errors.Is(err, errAPIKeyExpired):
+		writeAuthError(w, r, http.StatusUnauthorized, "API key has expired")
+		return
+	case err != nil:
+		log.Printf("ERROR: %v", err)
+		writeAuthError(w, r, http.StatusInternalServerError, "Failed to load API keys")
+		return
+	}
+
+	admin, ok, err := admins.lookup(r.Context(), store, stored.Owner)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeAuthError(w, r, http.StatusInternalServerError, "Failed to load admins")
+		return
+	}
+	// A key older than its owner belongs to a deleted admin of the same name
+	if !ok || stored.CreatedAt.Before(admin.CreatedAt) {
+		writeAuthError(w, r, http.StatusUnauthorized, "The admin owning this API key no longer exists")
+		return
+	}
+	// Keys cannot pass a second factor, so they stop working until their
+	// owner sets one up.
+	missing, err := twoFactorMissing(r.Context(), store, admin)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeAuthError(w, r, http.StatusInternalServerError, "Failed to load security settings")
+		return
+	}
+	if missing {
+		writeAuthError(w, r, http.StatusForbidden, "Two-factor authentication is required; the owner of this API key has to set it up")
+		return
+	}
+	apiKeys.touch(store, stored.ID, now)
+	id := AdminIdentity{Username: admin.Username, Role: admin.Role, APIKeyID: stored.ID, Scopes: stored.Scopes, IP: logins.clientIP(r)}
+	next.ServeHTTP(w, r.WithContext(withAdminIdentity(r.Context(), id)))
+}
+
+// requireSession rejects requests authenticated with an API key, for routes
+// that change credentials. It must run behind jwtAuthMiddleware.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := adminIdentityFromContext(r.Context()); id.APIKeyID != "" {
+			writeAuthError(w, r, http.StatusForbidden, "This route requires logging in; API keys are not accepted")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIKeyRequest is the body of POST /api/v2/api-keys.
+type APIKeyRequest struct {
+	Name      string       `json:"name"`
+	Scopes    []Permission `json:"scopes"`
+	ExpiresAt *time.Time   `json:"expires_at"` // Optional; the key never expires without it
+}
+
+// registerAPIKeyRoutes adds the API key management routes to mux. Every admin
+// manages their own keys; admins with admins:manage see and revoke all keys.
+func registerAPIKeyRoutes(mux *http.ServeMux, store UserStore) {
+	session := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, jwtAuthMiddleware(store, requireSession(handler)))
+	}
+	session("GET /api/v2/api-keys", listAPIKeysHandler(store))
+	session("POST /api/v2/api-keys", createAPIKeyHandler(store))
+	session("DELETE /api/v2/api-keys/{id}", revokeAPIKeyHandler(store))
+}
+
+func listAPIKeysHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := apiKeys.reload(r.Context(), store); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, err.Error())
+			return
+		}
+		id, _ := adminIdentityFromContext(r.Context())
+		owner := id.Username
+		if id.can(PermAdminsManage) {
+			owner = ""
+		}
+		writeJSONResponse(w, http.StatusOK, apiKeys.list(owner))
+	}
+}
+
+func createAPIKeyHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || utf8.RuneCountInString(req.Name) > maxAPIKeyNameLength {
+			writeAdminError(w, invalidRequestf("name must be 1 to %d characters long", maxAPIKeyNameLength))
+			return
+		}
+		id, _ := adminIdentityFromContext(r.Context())
+		if err := validateAPIKeyScopes(req.Scopes, id.Role); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		now := time.Now().UTC()
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+			writeAdminError(w, invalidRequestf("expires_at must be in the future"))
+			return
+		}
+
+		key, keyID, err := newAPIKey()
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		apiKey := APIKey{
+			ID:        keyID,
+			Name:      req.Name,
+			Prefix:    apiKeyPrefix + keyID,
+			Hash:      hashAPIKey(key),
+			Owner:     id.Username,
+			Scopes:    req.Scopes,
+			CreatedAt: now,
+			ExpiresAt: req.ExpiresAt,
+		}
+		err = apiKeys.update(r.Context(), store, func(registry APIKeysConfig) error {
+			if _, ok := registry[keyID]; ok {
+				return fmt.Errorf("API key ID %s already taken, retry: %w", keyID, ErrStoreConflict)
+			}
+			owned := 0
+			for _, existing := range registry {
+				if adminKey(existing.Owner) == adminKey(id.Username) {
+					owned++
+				}
+			}
+			if owned >= maxAPIKeysPerAdmin {
+				return invalidRequestf("an admin can have at most %d API keys", maxAPIKeysPerAdmin)
+			}
+			registry[keyID] = apiKey
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("INFO: Admin %s created API key %s (%s) with scopes %v", id.Username, apiKey.Prefix, apiKey.Name, apiKey.Scopes)
+		recordAudit(r.Context(), "api_key.create", apiKey.ID, nil, apiKey)
+		info := apiKey.info()
+		info.Key = key
+		writeJSONResponse(w, http.StatusCreated, info)
+	}
+}
+
+func revokeAPIKeyHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := adminIdentityFromContext(r.Context())
+		keyID := r.PathValue("id")
+		var revoked APIKey
+		err := apiKeys.update(r.Context(), store, func(registry APIKeysConfig) error {
+			key, ok := registry[keyID]
+			if !ok || (adminKey(key.Owner) != adminKey(id.Username) && !id.can(PermAdminsManage)) {
+				return errAPIKeyNotFound
+			}
+			revoked = key
+			delete(registry, keyID)
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("INFO: Admin %s revoked API key %s (%s) of admin %s", id.Username, revoked.Prefix, revoked.Name, revoked.Owner)
+		recordAudit(r.Context(), "api_key.revoke", revoked.ID, revoked, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// revokeAllAPIKeys deletes the keys of username, after the deletion of the
+// account.
+func revokeAllAPIKeys(ctx context.Context, store UserStore, username string) {
+	var revoked []APIKey
+	err := apiKeys.update(ctx, store, func(registry APIKeysConfig) error {
+		revoked = nil
+		for keyID, key := range registry {
+			if adminKey(key.Owner) == adminKey(username) {
+				revoked = append(revoked, key)
+				delete(registry, keyID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to revoke API keys of admin %s: %v", username, err)
+		return
+	}
+	for _, key := range revoked {
+		log.Printf("INFO: Revoked API key %s (%s) of deleted admin %s", key.Prefix, key.Name, username)
+		recordAudit(ctx, "api_key.revoke", key.ID, key, nil)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyFormat(t *testing.T) {
+	key, id, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := apiKeyID(key); !ok || got != id {
+		t.Fatalf("apiKeyID(%q) = %q, %v, want %q", key, got, ok, id)
+	}
+	if hashAPIKey(key) != hashAPIKey(key) || hashAPIKey(key) == hashAPIKey(key+"x") || strings.Contains(hashAPIKey(key), id) {
+		t.Fatal("hashAPIKey is not a stable hash of the whole key")
+	}
+
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"gcvp_1a2b3c4d_secret", true},
+		{"gcvp_1a2b3c4d_", false},
+		{"gcvp_1a2b3c4d", false},
+		{"gcvp_1a2b3c_secret", false},
+		{"1a2b3c4d_secret", false},
+		{"eyJhbGciOiJIUzI1NiJ9.e30.sig", false},
+	}
+	for _, tt := range tests {
+		if _, ok := apiKeyID(tt.key); ok != tt.ok {
+			t.Errorf("apiKeyID(%q) ok = %v, want %v", tt.key, ok, tt.ok)
+		}
+	}
+}
+
+func TestAdminIdentityCan(t *testing.T) {
+	tests := []struct {
+		name string
+		id   AdminIdentity
+		perm Permission
+		want bool
+	}{
+		{"session of an operator", AdminIdentity{Role: AdminRoleOperator}, PermUsersWrite, true},
+		{"beyond the role", AdminIdentity{Role: AdminRoleViewer}, PermUsersWrite, false},
+		{"key within its scopes", AdminIdentity{Role: AdminRoleOperator, APIKeyID: "k", Scopes: []Permission{PermUsersRead}}, PermUsersRead, true},
+		{"key beyond its scopes", AdminIdentity{Role: AdminRoleOperator, APIKeyID: "k", Scopes: []Permission{PermUsersRead}}, PermUsersWrite, false},
+		{"key scope beyond the role", AdminIdentity{Role: AdminRoleViewer, APIKeyID: "k", Scopes: []Permission{PermUsersWrite}}, PermUsersWrite, false},
+		{"key of an owner", AdminIdentity{Role: AdminRoleOwner, APIKeyID: "k", Scopes: []Permission{PermUsersRead, PermStatsRead}}, PermAdminsManage, false},
+		{"key without scopes", AdminIdentity{Role: AdminRoleOwner, APIKeyID: "k"}, PermUsersRead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.id.can(tt.perm); got != tt.want {
+				t.Errorf("can(%s) = %v, want %v", tt.perm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAPIKeyScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []Permission
+		role   AdminRole
+		ok     bool
+	}{
+		{"allowed", []Permission{PermUsersRead, PermStatsRead}, AdminRoleViewer, true},
+		{"none", nil, AdminRoleOwner, false},
+		{"admins:manage is never grantable", []Permission{PermAdminsManage}, AdminRoleOwner, false},
+		{"unknown", []Permission{"users:delete"}, AdminRoleOwner, false},
+		{"beyond the role", []Permission{PermStatsRead}, AdminRoleReseller, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAPIKeyScopes(tt.scopes, tt.role); (err == nil) != tt.ok {
+				t.Errorf("validateAPIKeyScopes = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// addTestAPIKey stores a new key of owner and returns it.
+func addTestAPIKey(t *testing.T, store UserStore, owner string, createdAt time.Time, expiresAt *time.Time) (string, APIKey) {
+	t.Helper()
+	key, id, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey := APIKey{ID: id, Name: "test", Prefix: apiKeyPrefix + id, Hash: hashAPIKey(key), Owner: owner, Scopes: []Permission{PermUsersRead}, CreatedAt: createdAt, ExpiresAt: expiresAt}
+	err = apiKeys.update(context.Background(), store, func(registry APIKeysConfig) error {
+		registry[id] = apiKey
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("apiKeys.update: %v", err)
+	}
+	// Keep touch from writing to the store in the background after the test
+	apiKeys.mu.Lock()
+	apiKeys.touched[id] = time.Now().Add(time.Hour)
+	apiKeys.mu.Unlock()
+	return key, apiKey
+}
+
+func TestAPIKeyVerify(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	expiresAt := now.Add(time.Hour)
+	key, stored := addTestAPIKey(t, store, "alice", now, &expiresAt)
+	id, _ := apiKeyID(key)
+
+	tests := []struct {
+		name string
+		key  string
+		now  time.Time
+		want error
+	}{
+		{"valid", key, now, nil},
+		{"wrong secret", apiKeyPrefix + id + "_wrong", now, errInvalidAPIKey},
+		{"unknown ID", apiKeyPrefix + "00000000_" + strings.SplitN(key, "_", 3)[2], now, errInvalidAPIKey},
+		{"not a key", "nonsense", now, errInvalidAPIKey},
+		{"just before expiry", key, expiresAt.Add(-time.Second), nil},
+		{"expired", key, expiresAt, errAPIKeyExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apiKeys.verify(ctx, store, tt.key, tt.now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("verify err = %v, want %v", err, tt.want)
+			}
+			if err == nil && got.ID != stored.ID {
+				t.Errorf("verify returned key %s, want %s", got.ID, stored.ID)
+			}
+		})
+	}
+}
+
+// callWithAPIKey runs a request with key through authenticateAPIKey and
+// returns the response code and the identity the handler saw.
+func callWithAPIKey(store UserStore, key string) (int, AdminIdentity) {
+	var seen AdminIdentity
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = adminIdentityFromContext(r.Context())
+	})
+	w := httptest.NewRecorder()
+	authenticateAPIKey(w, httptest.NewRequest(http.MethodGet, "/api/v2/users", nil), store, key, next)
+	return w.Code, seen
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	store := newTestStore(t)
+	admin := addTestAdmin(t, store, Admin{Username: "alice", Role: AdminRoleOperator})
+	key, stored := addTestAPIKey(t, store, "alice", admin.CreatedAt, nil)
+
+	code, id := callWithAPIKey(store, key)
+	if code != http.StatusOK || id.Username != "alice" || id.APIKeyID != stored.ID || !id.can(PermUsersRead) || id.can(PermUsersWrite) {
+		t.Fatalf("got %d with identity %+v", code, id)
+	}
+	if code, _ := callWithAPIKey(store, key+"x"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong key: got %d, want 401", code)
+	}
+}
+
+func TestAPIKeyOfDeletedAdmin(t *testing.T) {
+	store := newTestStore(t)
+	addTestAdmin(t, store, Admin{Username: "owner", Role: AdminRoleOwner})
+	bob := addTestAdmin(t, store, Admin{Username: "bob", Role: AdminRoleViewer})
+	key, stored := addTestAPIKey(t, store, "bob", bob.CreatedAt, nil)
+	_, second := addTestAPIKey(t, store, "bob", bob.CreatedAt, nil)
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v2/admins/bob", nil)
+	r.SetPathValue("username", "bob")
+	r = r.WithContext(withAdminIdentity(r.Context(), AdminIdentity{Username: "owner", Role: AdminRoleOwner}))
+	audit.mu.Lock()
+	audit.pending = nil
+	audit.mu.Unlock()
+	w := httptest.NewRecorder()
+	deleteAdminHandler(store)(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting bob: got %d", w.Code)
+	}
+
+	if err := apiKeys.reload(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+	if keys := apiKeys.list("bob"); len(keys) != 0 {
+		t.Fatalf("%d keys of the deleted admin are left", len(keys))
+	}
+	revoked := map[string]bool{}
+	audit.mu.Lock()
+	for _, event := range audit.pending {
+		if event.Action == "api_key.revoke" && event.Actor == "owner" {
+			revoked[event.Target] = true
+		}
+	}
+	audit.mu.Unlock()
+	if !revoked[stored.ID] || !revoked[second.ID] {
+		t.Fatalf("revocations in the audit log: %v, want %s and %s", revoked, stored.ID, second.ID)
+	}
+
+	// A key that survived the deletion does not work for a new admin bob.
+	addTestAdmin(t, store, Admin{Username: "bob", Role: AdminRoleOwner, CreatedAt: time.Now().UTC().Add(time.Second)})
+	err := apiKeys.update(context.Background(), store, func(registry APIKeysConfig) error {
+		registry[stored.ID] = stored
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := callWithAPIKey(store, key); code != http.StatusUnauthorized {
+		t.Fatalf("key of the deleted admin: got %d, want 401", code)
+	}
+}
+
+func TestAPIKeyRequires2FA(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	tests := []struct {
+		admin Admin
+		want  int
+	}{
+		{Admin{Username: "plain", Role: AdminRoleOperator}, http.StatusForbidden},
+		{Admin{Username: "enrolled", Role: AdminRoleOperator, TOTP: &AdminTOTP{Secret: "AAAA", Enabled: true}}, http.StatusOK},
+		{Admin{Username: "sso", Role: AdminRoleOperator, OIDCSubject: "sub"}, http.StatusOK},
+	}
+	keys := make(map[string]string)
+	for _, tt := range tests {
+		admin := addTestAdmin(t, store, tt.admin)
+		keys[admin.Username], _ = addTestAPIKey(t, store, admin.Username, admin.CreatedAt, nil)
+		if code, _ := callWithAPIKey(store, keys[admin.Username]); code != http.StatusOK {
+			t.Fatalf("%s before 2FA is required: got %d", admin.Username, code)
+		}
+	}
+
+	_, err := securitySettings.update(ctx, store, func(settings *SecuritySettings) error {
+		settings.Require2FA = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if code, _ := callWithAPIKey(store, keys[tt.admin.Username]); code != tt.want {
+			t.Errorf("%s with 2FA required: got %d, want %d", tt.admin.Username, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every change made through the API, every login and every automatic
+// deactivation is recorded as an AuditEvent. Events are written to the log
+// (prefixed with AUDIT:) right away and stored by a background writer, which
+// retries until the store accepts them. Each UTC day has an index document
+// ("audit-2006-01-02", see auditDay) and the events are appended to chunks of
+// it ("audit-2006-01-02-1", ...), so no write rewrites the whole day. Events
+// are never changed or deleted through the API; GET /api/audit queries them.
+
+const (
+	auditDocumentPrefix           = "audit-"
+	auditSystemActor              = "@system" // Actor of the monitoring loop; usernames cannot start with "@"
+	auditMaxEventsPerDay          = 50000     // Events with an actor; further ones of the day only go to the log
+	auditMaxAnonymousEventsPerDay = 10000     // Events without an actor, such as failed logins; counted apart so they cannot crowd out the rest
+	auditChunkSize                = 500       // Events per chunk document
+	auditMaxPending               = 10000     // Events waiting for the store; the oldest are dropped beyond this
+	auditRetryDelay               = 10 * time.Second
+	defaultAuditRange             = 7 * 24 * time.Hour
+	maxAuditRange                 = 93 * 24 * time.Hour
+	defaultAuditPageSize          = 100
+	maxAuditPageSize              = 1000
+)
+
+// AuditEvent is an entry of the audit log.
+type AuditEvent struct {
+	Time     time.Time              `json:"time"`
+	Actor    string                 `json:"actor,omitempty"`      // Admin username, @system, or empty for anonymous requests
+	APIKeyID string                 `json:"api_key_id,omitempty"` // Set if the actor used an API key
+	Action   string                 `json:"action"`               // E.g. user.create, admin.delete, auth.login_failed
+	Target   string                 `json:"target,omitempty"`     // User ID or admin username acted on
+	IP       string                 `json:"ip,omitempty"`
+	Changes  map[string]AuditChange `json:"changes,omitempty"` // By JSON field name
+	Detail   string                 `json:"detail,omitempty"`
+}
+
+// AuditChange is the value of a field before and after the action; either
+// is null if the object did not exist then.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// auditRedacted lists fields holding secrets: the log only says they changed.
+var auditRedacted = map[string]bool{
+	"password_hash":      true,
+	"totp":               true,
+	"subscription_token": true,
+	"trojan_password":    true,
+	"ss_key":             true,
+	"hash":               true,
+}
+
+const auditRedactedValue = "[redacted]"
+
+// auditIgnored lists bookkeeping fields left out of the changes.
+var auditIgnored = map[string]bool{
+	"traffic_counters": true,
+}
+
+func auditFields(v interface{}) map[string]interface{} {
+	var fields map[string]interface{}
+	if data, err := json.Marshal(v); err == nil {
+		json.Unmarshal(data, &fields) // A nil v gives no fields
+	}
+	return fields
+}
+
+// auditDiff returns the fields that differ between the JSON forms of before
+// and after, either of which may be nil.
+func auditDiff(before, after interface{}) map[string]AuditChange {
+	old, updated := auditFields(before), auditFields(after)
+	changes := make(map[string]AuditChange)
+	for field, value := range updated {
+		if previous, ok := old[field]; !ok || !reflect.DeepEqual(previous, value) {
+			changes[field] = AuditChange{Before: old[field], After: value}
+		}
+	}
+	for field, value := range old {
+		if _, ok := updated[field]; !ok {
+			changes[field] = AuditChange{Before: value}
+		}
+	}
+	for field, change := range changes {
+		if auditIgnored[field] {
+			delete(changes, field)
+			continue
+		}
+		if auditRedacted[field] {
+			if change.Before != nil {
+				change.Before = auditRedactedValue
+			}
+			if change.After != nil {
+				change.After = auditRedactedValue
+			}
+			changes[field] = change
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// recordAudit records action on target by the admin of ctx, or by the
+// system if ctx carries no admin. before and after are the object's state
+// around the action (nil when it was created or deleted).
+func recordAudit(ctx context.Context, action, target string, before, after interface{}) {
+	event := AuditEvent{Action: action, Target: target, Changes: auditDiff(before, after)}
+	if id, ok := adminIdentityFromContext(ctx); ok {
+		event.Actor, event.APIKeyID, event.IP = id.Username, id.APIKeyID, id.IP
+	} else {
+		event.Actor = auditSystemActor
+	}
+	recordAuditEvent(event)
+}
+
+// recordAuditEvent logs event and queues it for the store.
+func recordAuditEvent(event AuditEvent) {
+	event.Time = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("ERROR: Failed to encode audit event %s: %v", event.Action, err)
+		return
+	}
+	log.Printf("AUDIT: %s", data)
+	audit.add(event)
+}
+
+// auditLog queues events until the writer has appended them to the store.
+type auditLog struct {
+	mu      sync.Mutex
+	pending []AuditEvent
+	store   UserStore // nil until startAuditWriter
+	wake    chan struct{}
+
+	writeMu sync.Mutex // Serializes flushes
+}
+
+var audit = &auditLog{wake: make(chan struct{}, 1)}
+
+func (a *auditLog) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *auditLog) add(event AuditEvent) {
+	a.mu.Lock()
+	if len(a.pending) >= auditMaxPending {
+		log.Printf("WARN: %d audit events are waiting for the store, dropping the oldest (%s)", len(a.pending), a.pending[0].Action)
+		a.pending = a.pending[1:]
+	}
+	a.pending = append(a.pending, event)
+	a.mu.Unlock()
+	a.signal()
+}
+
+// requeue puts events that could not be written back in front of the queue.
+func (a *auditLog) requeue(events []AuditEvent) {
+	a.mu.Lock()
+	a.pending = append(events, a.pending...)
+	if excess := len(a.pending) - auditMaxPending; excess > 0 {
+		log.Printf("WARN: Dropping %d audit events that could not be written to the store", excess)
+		a.pending = a.pending[excess:]
+	}
+	a.mu.Unlock()
+}
+
+func auditDocument(day time.Time) string {
+	return auditDocumentPrefix + day.UTC().Format("2006-01-02")
+}
+
+func auditChunkDocument(day string, chunk int) string {
+	return fmt.Sprintf("%s-%d", day, chunk)
+}
+
+// auditDay is the index document of a day. Writers reserve places for their
+// events in it and then append them to the chunk holding those places, so
+// the chunks never grow beyond auditChunkSize. A place whose write failed
+// stays empty.
+type auditDay struct {
+	Stored    int `json:"stored"`    // Places reserved so far
+	Anonymous int `json:"anonymous"` // Of which for events without an actor
+}
+
+func (d auditDay) chunks() int {
+	return (d.Stored + auditChunkSize - 1) / auditChunkSize
+}
+
+func decodeAuditDay(name string, data []byte) (auditDay, error) {
+	var day auditDay
+	if data == nil {
+		return day, nil
+	}
+	if err := json.Unmarshal(data, &day); err != nil {
+		return auditDay{}, fmt.Errorf("json.Unmarshal %s: %v", name, err)
+	}
+	return day, nil
+}
+
+func decodeAuditEvents(name string, data []byte) ([]AuditEvent, error) {
+	var events []AuditEvent
+	if data == nil {
+		return nil, nil
+	}
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal %s: %v", name, err)
+	}
+	return events, nil
+}
+
+// admit reserves places for the events that fit in the day's quotas and
+// returns them.
+func (d *auditDay) admit(events []AuditEvent) []AuditEvent {
+	var admitted []AuditEvent
+	for _, event := range events {
+		if event.Actor == "" {
+			if d.Anonymous >= auditMaxAnonymousEventsPerDay {
+				continue
+			}
+			d.Anonymous++
+		} else if d.Stored-d.Anonymous >= auditMaxEventsPerDay {
+			continue
+		}
+		d.Stored++
+		admitted = append(admitted, event)
+	}
+	return admitted
+}
+
+// flush appends the queued events to their days.
+func (a *auditLog) flush(ctx context.Context) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	a.mu.Lock()
+	batch, store := a.pending, a.store
+	if store != nil {
+		a.pending = nil
+	}
+	a.mu.Unlock()
+	if store == nil || len(batch) == 0 {
+		return nil
+	}
+
+	var days []string
+	byDay := make(map[string][]AuditEvent)
+	for _, event := range batch {
+		name := auditDocument(event.Time)
+		if _, ok := byDay[name]; !ok {
+			days = append(days, name)
+		}
+		byDay[name] = append(byDay[name], event)
+	}
+	for i, name := range days {
+		if unwritten, err := writeAuditDay(ctx, store, name, byDay[name]); err != nil {
+			for _, rest := range days[i+1:] {
+				unwritten = append(unwritten, byDay[rest]...)
+			}
+			a.requeue(unwritten)
+			return fmt.Errorf("failed to write audit events to %s: %v", store.Describe(), err)
+		}
+	}
+	return nil
+}
+
+// writeAuditDay stores the events of the day name. On failure it returns the
+// events that were not written.
+func writeAuditDay(ctx context.Context, store UserStore, name string, events []AuditEvent) ([]AuditEvent, error) {
+	var admitted []AuditEvent
+	var first int
+	_, err := store.UpdateDocument(ctx, name, func(data []byte) ([]byte, error) {
+		day, err := decodeAuditDay(name, data)
+		if err != nil {
+			return nil, err
+		}
+		first = day.Stored
+		admitted = day.admit(events)
+		return json.Marshal(day)
+	})
+	if err != nil {
+		return events, err
+	}
+	if dropped := len(events) - len(admitted); dropped > 0 {
+		log.Printf("WARN: Audit quota of %s is used up, %d event(s) are only in the log", name, dropped)
+	}
+
+	for len(admitted) > 0 {
+		chunk := first/auditChunkSize + 1
+		part := admitted
+		if room := auditChunkSize - first%auditChunkSize; room < len(part) {
+			part = part[:room]
+		}
+		chunkName := auditChunkDocument(name, chunk)
+		_, err := store.UpdateDocument(ctx, chunkName, func(data []byte) ([]byte, error) {
+			stored, err := decodeAuditEvents(chunkName, data)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(append(stored, part...))
+		})
+		if err != nil {
+			return admitted, err
+		}
+		admitted = admitted[len(part):]
+		first += len(part)
+	}
+	return nil, nil
+}
+
+// loadAuditDay returns the stored events of the day name.
+func loadAuditDay(ctx context.Context, store UserStore, name string) ([]AuditEvent, error) {
+	data, err := store.LoadDocument(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	day, err := decodeAuditDay(name, data)
+	if err != nil {
+		return nil, err
+	}
+	var events []AuditEvent
+	for chunk := 1; chunk <= day.chunks(); chunk++ {
+		chunkName := auditChunkDocument(name, chunk)
+		data, err := store.LoadDocument(ctx, chunkName)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := decodeAuditEvents(chunkName, data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, stored...)
+	}
+	return events, nil
+}
+
+// startAuditWriter starts appending recorded events to store.
+func startAuditWriter(store UserStore) {
+	audit.mu.Lock()
+	audit.store = store
+	audit.mu.Unlock()
+	go func() {
+		for range audit.wake {
+			if err := audit.flush(context.Background()); err != nil {
+				log.Printf("ERROR: %v; retrying in %s", err, auditRetryDelay)
+				time.Sleep(auditRetryDelay)
+				audit.signal()
+			}
+		}
+	}()
+	audit.signal() // Events recorded during startup
+}
+
+// auditQuery holds the filters of GET /api/audit.
+type auditQuery struct {
+	Since, Until time.Time
+	Actor        string
+	Action       string // Exact, or a prefix if it ends with "*"
+	Target       string
+	IP           string
+	Limit        int
+	Offset       int
+}
+
+func parseAuditQuery(r *http.Request, now time.Time) (auditQuery, error) {
+	params := r.URL.Query()
+	q := auditQuery{
+		Until:  now,
+		Actor:  params.Get("actor"),
+		Action: params.Get("action"),
+		Target: params.Get("target"),
+		IP:     params.Get("ip"),
+		Limit:  defaultAuditPageSize,
+	}
+	if v := params.Get("until"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			return q, fmt.Errorf("until must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+		q.Until = t
+	}
+	q.Since = q.Until.Add(-defaultAuditRange)
+	if v := params.Get("since"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			return q, fmt.Errorf("since must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+		q.Since = t
+	}
+	if q.Until.Before(q.Since) || q.Until.Sub(q.Since) > maxAuditRange {
+		return q, fmt.Errorf("since must be before until and at most %d days earlier", int(maxAuditRange.Hours()/24))
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxAuditPageSize)
+		}
+		q.Limit = n
+	}
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("offset must be a non-negative integer")
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+func (q auditQuery) matches(event AuditEvent) bool {
+	if event.Time.Before(q.Since) || event.Time.After(q.Until) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(q.Action, "*"); ok {
+		if !strings.HasPrefix(event.Action, prefix) {
+			return false
+		}
+	} else if q.Action != "" && event.Action != q.Action {
+		return false
+	}
+	return (q.Actor == "" || strings.EqualFold(event.Actor, q.Actor)) &&
+		(q.Target == "" || strings.EqualFold(event.Target, q.Target)) &&
+		(q.IP == "" || event.IP == q.IP)
+}
+
+// auditPage is the response of GET /api/audit, newest events first.
+type auditPage struct {
+	Items      []AuditEvent `json:"items"`
+	Total      int          `json:"total"`
+	Limit      int          `json:"limit"`
+	Offset     int          `json:"offset"`
+	NextOffset *int         `json:"next_offset,omitempty"` // Absent on the last page
+}
+
+// auditLogHandler serves GET /api/audit.
+func auditLogHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only GET method is allowed"})
+			return
+		}
+		q, err := parseAuditQuery(r, time.Now().UTC())
+		if err != nil {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		// Include what this instance recorded a moment ago
+		if err := audit.flush(r.Context()); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+
+		matched := []AuditEvent{}
+		lastDay := q.Until.Truncate(24 * time.Hour)
+		for day := q.Since.Truncate(24 * time.Hour); !day.After(lastDay); day = day.Add(24 * time.Hour) {
+			stored, err := loadAuditDay(r.Context(), store, auditDocument(day))
+			if err != nil {
+				log.Printf("ERROR: Failed to load audit events from %s: %v", store.Describe(), err)
+				writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load audit events"})
+				return
+			}
+			for _, event := range stored {
+				if q.matches(event) {
+					matched = append(matched, event)
+				}
+			}
+		}
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.After(matched[j].Time) })
+
+		page := auditPage{Items: []AuditEvent{}, Total: len(matched), Limit: q.Limit, Offset: q.Offset}
+		if q.Offset < len(matched) {
+			end := q.Offset + q.Limit
+			if end > len(matched) {
+				end = len(matched)
+			}
+			page.Items = matched[q.Offset:end]
+			if end < len(matched) {
+				page.NextOffset = &end
+			}
+		}
+		writeJSONResponse(w, http.StatusOK, page)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditDiff(t *testing.T) {
+	user := User{ID: "u1", Status: UserStatusActive, TrafficLimitGB: 10, SubscriptionToken: "old"}
+	changed := user
+	changed.TrafficLimitGB = 20
+	changed.SubscriptionToken = "new"
+	counted := user
+	counted.TrafficCounters = map[string]TrafficCounterState{"run-1": {Uplink: 1}}
+
+	tests := []struct {
+		name          string
+		before, after interface{}
+		want          map[string]AuditChange
+	}{
+		{"unchanged", user, user, nil},
+		{"changed field", user, changed, map[string]AuditChange{
+			"traffic_limit_gb":   {Before: 10.0, After: 20.0},
+			"subscription_token": {Before: auditRedactedValue, After: auditRedactedValue},
+		}},
+		{"bookkeeping only", user, counted, nil},
+		{"created", nil, map[string]string{"role": "viewer", "password_hash": "x"}, map[string]AuditChange{
+			"role":          {After: "viewer"},
+			"password_hash": {After: auditRedactedValue},
+		}},
+		{"deleted", map[string]string{"role": "viewer"}, nil, map[string]AuditChange{
+			"role": {Before: "viewer"},
+		}},
+		{"field removed", map[string]string{"note": "x", "role": "viewer"}, map[string]string{"role": "viewer"}, map[string]AuditChange{
+			"note": {Before: "x"},
+		}},
+		{"neither", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auditDiff(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuditQuery(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		query   string
+		want    auditQuery
+		wantErr bool
+	}{
+		{query: "", want: auditQuery{Since: now.Add(-defaultAuditRange), Until: now, Limit: defaultAuditPageSize}},
+		{query: "since=2024-05-01&until=2024-05-03", want: auditQuery{Since: day(1), Until: day(3), Limit: defaultAuditPageSize}},
+		{query: "until=2024-05-03T10:00:00%2B02:00", want: auditQuery{Since: day(3).Add(8*time.Hour - defaultAuditRange), Until: day(3).Add(8 * time.Hour), Limit: defaultAuditPageSize}},
+		{query: "actor=alice&action=user.*&target=u1&ip=10.0.0.1&limit=5&offset=10", want: auditQuery{Since: now.Add(-defaultAuditRange), Until: now, Actor: "alice", Action: "user.*", Target: "u1", IP: "10.0.0.1", Limit: 5, Offset: 10}},
+		{query: "since=2024-05-04&until=2024-05-03", wantErr: true},
+		{query: "since=2024-01-01", wantErr: true}, // Over maxAuditRange
+		{query: "since=yesterday", wantErr: true},
+		{query: "until=05/03/2024", wantErr: true},
+		{query: "limit=0", wantErr: true},
+		{query: fmt.Sprintf("limit=%d", maxAuditPageSize+1), wantErr: true},
+		{query: "offset=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseAuditQuery(httptest.NewRequest("GET", "/api/audit?"+tt.query, nil), now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && q != tt.want {
+				t.Errorf("got %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditQueryMatches(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	q := auditQuery{Since: now.Add(-time.Hour), Until: now, Action: "user.*", Actor: "Alice"}
+	tests := []struct {
+		event AuditEvent
+		want  bool
+	}{
+		{AuditEvent{Time: now, Actor: "alice", Action: "user.update"}, true},
+		{AuditEvent{Time: now, Actor: "alice", Action: "admin.update"}, false},
+		{AuditEvent{Time: now, Actor: "bob", Action: "user.update"}, false},
+		{AuditEvent{Time: now.Add(-2 * time.Hour), Actor: "alice", Action: "user.update"}, false},
+	}
+	for _, tt := range tests {
+		if got := q.matches(tt.event); got != tt.want {
+			t.Errorf("matches(%+v) = %v, want %v", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestAuditDayQuotas(t *testing.T) {
+	// One place left in each quota.
+	day := auditDay{Stored: auditMaxEventsPerDay + auditMaxAnonymousEventsPerDay - 2, Anonymous: auditMaxAnonymousEventsPerDay - 1}
+	events := []AuditEvent{{Action: "auth.login_failed"}, {Action: "auth.login_failed"}, {Actor: "alice", Action: "user.update"}, {Actor: "bob", Action: "user.update"}}
+	admitted := day.admit(events)
+	if len(admitted) != 2 || admitted[0].Actor != "" || admitted[1].Actor != "alice" {
+		t.Fatalf("admitted %+v, want one anonymous event and alice's", admitted)
+	}
+	if day.Anonymous != auditMaxAnonymousEventsPerDay || day.Stored != auditMaxEventsPerDay+auditMaxAnonymousEventsPerDay {
+		t.Fatalf("day %+v after admitting", day)
+	}
+
+	// Anonymous events do not use up the quota of the others.
+	day = auditDay{Stored: auditMaxAnonymousEventsPerDay, Anonymous: auditMaxAnonymousEventsPerDay}
+	if admitted := day.admit(events); len(admitted) != 2 || admitted[0].Actor != "alice" || admitted[1].Actor != "bob" {
+		t.Fatalf("admitted %+v once the anonymous quota is used up", admitted)
+	}
+}
+
+func TestWriteAuditDay(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	name := auditDocument(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	batch := func(from, n int) []AuditEvent {
+		events := make([]AuditEvent, n)
+		for i := range events {
+			events[i] = AuditEvent{Actor: "alice", Action: "user.update", Target: fmt.Sprint(from + i)}
+		}
+		return events
+	}
+	// The second write fills the first chunk and starts two more.
+	for _, events := range [][]AuditEvent{batch(0, 300), batch(300, 900)} {
+		if unwritten, err := writeAuditDay(ctx, store, name, events); err != nil {
+			t.Fatalf("%v, %d events unwritten", err, len(unwritten))
+		}
+	}
+	for chunk, want := range []int{auditChunkSize, auditChunkSize, 200} {
+		data, err := store.LoadDocument(ctx, auditChunkDocument(name, chunk+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := decodeAuditEvents(name, data)
+		if err != nil || len(events) != want {
+			t.Fatalf("chunk %d holds %d events (%v), want %d", chunk+1, len(events), err, want)
+		}
+	}
+
+	events, err := loadAuditDay(ctx, store, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1200 {
+		t.Fatalf("loaded %d events, want 1200", len(events))
+	}
+	for i, event := range events {
+		if event.Target != fmt.Sprint(i) {
+			t.Fatalf("event %d is %s", i, event.Target)
+		}
+	}
+
+	// A write that fails after reserving its places returns its events.
+	broken := failingDocumentStore{UserStore: store, document: auditChunkDocument(name, 3)}
+	if unwritten, err := writeAuditDay(ctx, broken, name, batch(1200, 10)); err == nil || len(unwritten) != 10 {
+		t.Fatalf("write to a failing chunk: %v, %d events unwritten", err, len(unwritten))
+	}
+}
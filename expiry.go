@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A user's time limit is ExpiresAt; nil means it never expires.
+// TimeLimitDays is only an input: it is converted into ExpiresAt on create
+// and on update, and for on-hold users it is kept until their first traffic.
+
+// expiryStart is the time TimeLimitDays counts from.
+func expiryStart(user User) time.Time {
+	if user.StartedAt != nil {
+		return *user.StartedAt
+	}
+	return user.CreatedAt
+}
+
+// applyTimeLimitDays turns a day count into ExpiresAt, except for on-hold
+// users, who keep it until their first traffic.
+func applyTimeLimitDays(user *User, days int) {
+	if user.Status == UserStatusOnHold {
+		user.TimeLimitDays = days
+		return
+	}
+	expiresAt := expiryStart(*user).AddDate(0, 0, days)
+	user.ExpiresAt = &expiresAt
+	user.TimeLimitDays = 0
+}
+
+// formatExpiry renders ExpiresAt for logs.
+func formatExpiry(user User) string {
+	if expiresAt, ok := userExpiry(user); ok {
+		return expiresAt.Format(time.RFC3339)
+	}
+	return "never"
+}
+
+// ensureExpiryDates converts the TimeLimitDays of stored users that predate
+// ExpiresAt. On-hold users keep theirs until they connect.
+func ensureExpiryDates(ctx context.Context, store UserStore) error {
+	needsMigration := func(user User) bool {
+		return user.TimeLimitDays > 0 && user.ExpiresAt == nil && user.Status != UserStatusOnHold
+	}
+
+	configMutex.RLock()
+	missing := 0
+	for _, user := range currentUsersConfig {
+		if needsMigration(user) {
+			missing++
+		}
+	}
+	configMutex.RUnlock()
+	if missing == 0 {
+		return nil
+	}
+
+	log.Printf("Converting time_limit_days to expires_at for %d user(s)", missing)
+	return persistUsers(ctx, store, func(users UsersConfig) error {
+		for id, user := range users {
+			if needsMigration(user) {
+				applyTimeLimitDays(&user, user.TimeLimitDays)
+				users[id] = user
+			}
+		}
+		return nil
+	})
+}
+
+// ExpiryRequest is the body of POST /api/user/expiry. Exactly one field must be set.
+type ExpiryRequest struct {
+	ExtendDays int        `json:"extend_days,omitempty"` // Add days to the current expiry (or to now if already expired)
+	Extend     string     `json:"extend,omitempty"`      // Same with a Go duration, e.g. "36h"
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`  // Set an exact date
+	Unlimited  bool       `json:"unlimited,omitempty"`   // Remove the time limit
+}
+
+// applyExpiryRequest changes the user's expiry as requested.
+func applyExpiryRequest(user *User, req ExpiryRequest, now time.Time) error {
+	set := 0
+	var extend time.Duration
+	if req.ExtendDays != 0 {
+		set++
+		if req.ExtendDays < 0 {
+			return fmt.Errorf("%w: extend_days must be positive", errInvalidRequest)
+		}
+	}
+	if req.Extend != "" {
+		set++
+		d, err := time.ParseDuration(req.Extend)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%w: extend must be a positive duration such as \"720h\"", errInvalidRequest)
+		}
+		extend = d
+	}
+	if req.ExpiresAt != nil {
+		set++
+	}
+	if req.Unlimited {
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf("%w: set exactly one of extend_days, extend, expires_at or unlimited", errInvalidRequest)
+	}
+
+	if user.Status == UserStatusOnHold {
+		// The expiry of an on-hold user is fixed at its first traffic.
+		switch {
+		case req.ExtendDays > 0:
+			user.TimeLimitDays += req.ExtendDays
+		case req.Unlimited:
+			user.TimeLimitDays = 0
+		default:
+			return fmt.Errorf("%w: on-hold users can only be extended with extend_days or made unlimited", errInvalidRequest)
+		}
+		return nil
+	}
+
+	switch {
+	case req.Unlimited:
+		user.ExpiresAt = nil
+	case req.ExpiresAt != nil:
+		expiresAt := req.ExpiresAt.UTC()
+		user.ExpiresAt = &expiresAt
+	default:
+		if user.ExpiresAt == nil {
+			return fmt.Errorf("%w: user has no expiry to extend", errInvalidRequest)
+		}
+		base := *user.ExpiresAt
+		if base.Before(now) {
+			base = now // Extending an expired user starts from today
+		}
+		if req.ExtendDays > 0 {
+			base = base.AddDate(0, 0, req.ExtendDays)
+		} else {
+			base = base.Add(extend)
+		}
+		user.ExpiresAt = &base
+	}
+	user.TimeLimitDays = 0
+	return nil
+}
+
+// userExpiryHandler serves POST /api/user/expiry?id=, which extends a user's
+// time limit, sets an exact expiry date or removes it. An expired user that
+// is within its limits afterwards is reactivated.
+func userExpiryHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only POST method is allowed"})
+			return
+		}
+		userID := r.URL.Query().Get("id")
+		if userID == "" {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required in query parameters"})
+			return
+		}
+		var req ExpiryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+
+		updatedUser, err := changeUserExpiry(r.Context(), store, userID, req)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, updatedUser)
+	}
+}
+
+// changeUserExpiry applies req to the stored user and syncs it to V2Ray.
+func changeUserExpiry(ctx context.Context, store UserStore, userID string, req ExpiryRequest) (User, error) {
+	var before, after User
+	now := time.Now().UTC()
+	change := func(user *User) error {
+		if err := applyExpiryRequest(user, req, now); err != nil {
+			return err
+		}
+		reactivateIfWithinLimits(user, now)
+		return nil
+	}
+	reservation, err := reserveForChange(ctx, store, userID, now, change)
+	if err != nil {
+		return User{}, err
+	}
+	err = persistUsers(ctx, store, func(users UsersConfig) error {
+		user, ok := users[userID]
+		if !ok || !userVisibleTo(ctx, user) {
+			return ErrUserNotFound
+		}
+		before = user
+		if err := change(&user); err != nil {
+			return err
+		}
+		if err := reservation.verify(&before, user); err != nil {
+			return err
+		}
+		users[userID] = user
+		after = user
+		return nil
+	})
+	if err != nil {
+		reservation.refund(ctx)
+		log.Printf("ERROR: Failed to change expiry of user %s: %v", userID, err)
+		return User{}, err
+	}
+	log.Printf("INFO: Expiry of user %s changed to %s", userID, formatExpiry(after))
+	recordAudit(ctx, "user.expiry", userID, before, after)
+
+	if err := syncV2RayUser(&before, &after); err != nil {
+		log.Printf("ERROR: Failed to apply updated user to V2Ray: %v", err)
+		return after, fmt.Errorf("%w: %v", errApplyToV2Ray, err)
+	}
+	return after, nil
+}
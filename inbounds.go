@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The user-facing inbounds are configured with V2RAY_INBOUNDS, a JSON array
+// of InboundDefinition. Without it there is a single VLESS inbound on
+// WebSocket path /v2ray, as before. Every user is a client of every inbound:
+// VLESS and VMess authenticate them by their ID, Trojan by TrojanPassword
+// and Shadowsocks 2022 by a key derived from SSKey. All inbounds tag the
+// user with the same email (userStatsTag), so V2Ray sums their traffic into
+// one pair of counters per user.
+
+const (
+	protocolVLESS       = "vless"
+	protocolVMess       = "vmess"
+	protocolTrojan      = "trojan"
+	protocolShadowsocks = "shadowsocks" // Shadowsocks 2022 only: it is the one with per-user keys
+
+	networkWS          = "ws"
+	networkHTTPUpgrade = "httpupgrade"
+	networkTCP         = "tcp" // Listens on a public port of its own instead of behind the proxy
+
+	defaultSSMethod = "2022-blake3-aes-128-gcm"
+	ssKeyBytes      = 32 // Length of User.SSKey; shorter methods use its prefix
+)
+
+// ssMethodKeyBytes lists the Shadowsocks 2022 methods V2Ray serves to many
+// users at once, with their key length.
+var ssMethodKeyBytes = map[string]int{
+	"2022-blake3-aes-128-gcm": 16,
+	"2022-blake3-aes-256-gcm": 32,
+}
+
+// InboundDefinition is an entry of V2RAY_INBOUNDS.
+type InboundDefinition struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"` // vless, vmess, trojan or shadowsocks
+	Network  string `json:"network"`  // ws (default), httpupgrade or tcp
+	Path     string `json:"path"`     // ws and httpupgrade: path proxied from the public port
+	// Port is the loopback port of ws and httpupgrade inbounds (by default
+	// the ports following V2RAY_INTERNAL_PORT) and the public port of tcp ones.
+	Port int `json:"port"`
+	// Shadowsocks only: the method and the server key (base64, 16 or 32
+	// bytes to match the method, e.g. from "openssl rand -base64 16").
+	Method    string `json:"method,omitempty"`
+	ServerKey string `json:"server_key,omitempty"`
+}
+
+// proxied reports whether the inbound is reached through the public HTTP port.
+func (d InboundDefinition) proxied() bool {
+	return d.Network != networkTCP
+}
+
+var v2rayInbounds []InboundDefinition // Set by configureInbounds
+
+// defaultInbounds is the configuration used without V2RAY_INBOUNDS.
+func defaultInbounds() []InboundDefinition {
+	return []InboundDefinition{{Tag: vlessInboundTag, Protocol: protocolVLESS, Network: networkWS, Path: v2rayWSPath}}
+}
+
+// reservedPaths are served by the API server and cannot be proxied to V2Ray.
+var reservedPaths = []string{"/api", "/ui", "/sub"}
+
+// configureInbounds reads and validates V2RAY_INBOUNDS. Proxied inbounds
+// without a port get the loopback ports from basePort (V2RAY_INTERNAL_PORT)
+// upwards; listenPort is the public port they must not collide with.
+func configureInbounds(basePort, listenPort string) ([]InboundDefinition, error) {
+	defs := defaultInbounds()
+	if spec := os.Getenv("V2RAY_INBOUNDS"); spec != "" {
+		defs = nil
+		if err := json.Unmarshal([]byte(spec), &defs); err != nil {
+			return nil, fmt.Errorf("V2RAY_INBOUNDS: %v", err)
+		}
+		if len(defs) == 0 {
+			return nil, fmt.Errorf("V2RAY_INBOUNDS: at least one inbound is required")
+		}
+	}
+	nextPort, err := strconv.Atoi(basePort)
+	if err != nil {
+		return nil, fmt.Errorf("V2RAY_INTERNAL_PORT: %v", err)
+	}
+	public, _ := strconv.Atoi(listenPort)
+
+	tags := make(map[string]bool)
+	paths := make(map[string]bool)
+	ports := map[int]string{public: "PORT", 10085: "the V2Ray API"}
+	requested := make(map[int]bool) // Not assigned to the inbounds without a port
+	for _, d := range defs {
+		requested[d.Port] = true
+	}
+	for i := range defs {
+		d := &defs[i]
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("V2RAY_INBOUNDS entry %d (%s): %s", i+1, d.Tag, fmt.Sprintf(format, args...))
+		}
+		if d.Tag == "" || d.Tag == "API" || tags[d.Tag] {
+			return nil, fail("tag must be set, unique and not API")
+		}
+		tags[d.Tag] = true
+		if d.Network == "" {
+			d.Network = networkWS
+		}
+
+		switch d.Protocol {
+		case protocolVLESS, protocolVMess, protocolTrojan:
+		case protocolShadowsocks:
+			if d.Method == "" {
+				d.Method = defaultSSMethod
+			}
+			keyBytes, ok := ssMethodKeyBytes[d.Method]
+			if !ok {
+				return nil, fail("method must be 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm")
+			}
+			if key, err := base64.StdEncoding.DecodeString(d.ServerKey); err != nil || len(key) != keyBytes {
+				return nil, fail("server_key must be %d random bytes in base64 (openssl rand -base64 %d)", keyBytes, keyBytes)
+			}
+			if d.Network == networkHTTPUpgrade {
+				return nil, fail("shadowsocks clients cannot use httpupgrade, use ws or tcp")
+			}
+		default:
+			return nil, fail("protocol must be vless, vmess, trojan or shadowsocks")
+		}
+
+		switch d.Network {
+		case networkWS, networkHTTPUpgrade:
+			if !strings.HasPrefix(d.Path, "/") || d.Path == "/" || paths[d.Path] {
+				return nil, fail("path must start with / and be unique")
+			}
+			for _, reserved := range reservedPaths {
+				if matchesPath(d.Path, reserved) || matchesPath(reserved, d.Path) {
+					return nil, fail("path %s overlaps %s, which the API server uses", d.Path, reserved)
+				}
+			}
+			paths[d.Path] = true
+			if d.Port == 0 {
+				for ports[nextPort] != "" || requested[nextPort] {
+					nextPort++
+				}
+				d.Port = nextPort
+			}
+		case networkTCP:
+			if d.Port == 0 {
+				return nil, fail("port is required for tcp inbounds")
+			}
+		default:
+			return nil, fail("network must be ws, httpupgrade or tcp")
+		}
+		if d.Port < 1 || d.Port > 65535 {
+			return nil, fail("port must be between 1 and 65535")
+		}
+		if other := ports[d.Port]; other != "" {
+			return nil, fail("port %d is already used by %s", d.Port, other)
+		}
+		ports[d.Port] = d.Tag
+	}
+	for _, d := range defs {
+		log.Printf("Inbound %s: %s over %s, %s", d.Tag, d.Protocol, d.Network, d.describeAddress())
+	}
+	return defs, nil
+}
+
+func (d InboundDefinition) describeAddress() string {
+	if d.proxied() {
+		return fmt.Sprintf("path %s -> %s:%d", d.Path, v2rayInternalListen, d.Port)
+	}
+	return fmt.Sprintf("public port %d", d.Port)
+}
+
+// newTrojanPassword returns a random Trojan password for a user.
+func newTrojanPassword() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// newSSKey returns a random Shadowsocks 2022 key for a user.
+func newSSKey() string {
+	b := make([]byte, ssKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// assignProxyCredentials gives the user the credentials it lacks, so it can
+// use every protocol, including those enabled later.
+func assignProxyCredentials(user *User) bool {
+	changed := false
+	if user.TrojanPassword == "" {
+		user.TrojanPassword = newTrojanPassword()
+		changed = true
+	}
+	if user.SSKey == "" {
+		user.SSKey = newSSKey()
+		changed = true
+	}
+	return changed
+}
+
+// ensureProxyCredentials gives every stored user the credentials it lacks.
+func ensureProxyCredentials(ctx context.Context, store UserStore) error {
+	configMutex.RLock()
+	missing := 0
+	for _, user := range currentUsersConfig {
+		if user.TrojanPassword == "" || user.SSKey == "" {
+			missing++
+		}
+	}
+	configMutex.RUnlock()
+	if missing == 0 {
+		return nil
+	}
+
+	log.Printf("Generating Trojan and Shadowsocks credentials for %d user(s)", missing)
+	return persistUsers(ctx, store, func(users UsersConfig) error {
+		for id, user := range users {
+			if assignProxyCredentials(&user) {
+				users[id] = user
+			}
+		}
+		return nil
+	})
+}
+
+// userSSKey returns the user's key for a Shadowsocks 2022 method: the
+// prefix of SSKey the method's key length needs.
+func userSSKey(user User, method string) string {
+	key, err := base64.StdEncoding.DecodeString(user.SSKey)
+	if err != nil || len(key) < ssMethodKeyBytes[method] {
+		return "" // assignProxyCredentials has not run yet
+	}
+	return base64.StdEncoding.EncodeToString(key[:ssMethodKeyBytes[method]])
+}
+
+// inboundClient returns the user as a client of the inbound.
+func inboundClient(d InboundDefinition, user User) Client {
+	client := Client{Email: userStatsTag(user), Level: v2rayUserLevel}
+	switch d.Protocol {
+	case protocolVLESS, protocolVMess:
+		client.ID = user.ID
+	case protocolTrojan:
+		client.Password = user.TrojanPassword
+	case protocolShadowsocks:
+		client.Password = userSSKey(user, d.Method)
+	}
+	return client
+}
+
+// v2rayInbound renders the definition as a V2Ray inbound serving users.
+func (d InboundDefinition) v2rayInbound(users []User) Inbound {
+	clients := make([]Client, 0, len(users))
+	for _, user := range users {
+		clients = append(clients, inboundClient(d, user))
+	}
+	inbound := Inbound{
+		Port:     strconv.Itoa(d.Port),
+		Listen:   v2rayInternalListen, // Reachable only through the reverse proxy in front of it
+		Protocol: d.Protocol,
+		Settings: InboundSettings{Clients: clients},
+		StreamSettings: StreamSettings{
+			Network:  d.Network,
+			Security: "none", // TLS is typically handled by Cloud Run or a reverse proxy
+		},
+		Tag: d.Tag,
+	}
+	switch d.Network {
+	case networkWS:
+		inbound.StreamSettings.WSSettings = &WebSocketSettings{Path: d.Path}
+	case networkHTTPUpgrade:
+		inbound.StreamSettings.HTTPUpgradeSettings = &HTTPUpgradeSettings{Path: d.Path}
+	case networkTCP:
+		inbound.Listen = "0.0.0.0"
+	}
+	switch d.Protocol {
+	case protocolVLESS:
+		inbound.Settings.Decryption = "none" // Required for VLESS
+	case protocolShadowsocks:
+		inbound.Settings.Method = d.Method
+		inbound.Settings.Password = d.ServerKey
+		inbound.Settings.Network = "tcp"
+		if d.Network == networkTCP {
+			inbound.Settings.Network = "tcp,udp"
+		}
+	}
+	return inbound
+}
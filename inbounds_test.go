@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"gcvp/internal/v2rayapi/proxy/shadowsocks_2022"
+)
+
+func TestConfigureInbounds(t *testing.T) {
+	key16 := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	key32 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    []InboundDefinition
+		wantErr string
+	}{
+		{name: "default", want: []InboundDefinition{{Tag: vlessInboundTag, Protocol: protocolVLESS, Network: networkWS, Path: v2rayWSPath, Port: 10086}}},
+		{
+			name: "ports assigned in order, around requested ones",
+			spec: `[{"tag":"a","protocol":"vless","path":"/a"},{"tag":"b","protocol":"vmess","network":"httpupgrade","path":"/b"},{"tag":"c","protocol":"trojan","path":"/c","port":10087}]`,
+			want: []InboundDefinition{
+				{Tag: "a", Protocol: protocolVLESS, Network: networkWS, Path: "/a", Port: 10086},
+				{Tag: "b", Protocol: protocolVMess, Network: networkHTTPUpgrade, Path: "/b", Port: 10088},
+				{Tag: "c", Protocol: protocolTrojan, Network: networkWS, Path: "/c", Port: 10087},
+			},
+		},
+		{
+			name: "shadowsocks",
+			spec: `[{"tag":"ss","protocol":"shadowsocks","network":"tcp","port":8388,"server_key":"` + key16 + `"},{"tag":"ss256","protocol":"shadowsocks","path":"/ss","method":"2022-blake3-aes-256-gcm","server_key":"` + key32 + `"}]`,
+			want: []InboundDefinition{
+				{Tag: "ss", Protocol: protocolShadowsocks, Network: networkTCP, Port: 8388, Method: defaultSSMethod, ServerKey: key16},
+				{Tag: "ss256", Protocol: protocolShadowsocks, Network: networkWS, Path: "/ss", Port: 10086, Method: "2022-blake3-aes-256-gcm", ServerKey: key32},
+			},
+		},
+		{name: "not JSON", spec: `vless`, wantErr: "V2RAY_INBOUNDS"},
+		{name: "empty", spec: `[]`, wantErr: "at least one inbound"},
+		{name: "duplicate tag", spec: `[{"tag":"a","protocol":"vless","path":"/a"},{"tag":"a","protocol":"vmess","path":"/b"}]`, wantErr: "tag must be set"},
+		{name: "API tag", spec: `[{"tag":"API","protocol":"vless","path":"/a"}]`, wantErr: "tag must be set"},
+		{name: "unknown protocol", spec: `[{"tag":"a","protocol":"socks","path":"/a"}]`, wantErr: "protocol must be"},
+		{name: "unknown network", spec: `[{"tag":"a","protocol":"vless","network":"grpc","path":"/a"}]`, wantErr: "network must be"},
+		{name: "duplicate path", spec: `[{"tag":"a","protocol":"vless","path":"/a"},{"tag":"b","protocol":"vmess","path":"/a"}]`, wantErr: "path must start with / and be unique"},
+		{name: "root path", spec: `[{"tag":"a","protocol":"vless","path":"/"}]`, wantErr: "path must start with / and be unique"},
+		{name: "API path", spec: `[{"tag":"a","protocol":"vless","path":"/api/v2ray"}]`, wantErr: "overlaps /api"},
+		{name: "path sharing a prefix with /ui", spec: `[{"tag":"a","protocol":"vless","path":"/u"}]`, wantErr: ""},
+		{name: "tcp without port", spec: `[{"tag":"a","protocol":"trojan","network":"tcp"}]`, wantErr: "port is required"},
+		{name: "public port", spec: `[{"tag":"a","protocol":"trojan","network":"tcp","port":8080}]`, wantErr: "already used by PORT"},
+		{name: "API port", spec: `[{"tag":"a","protocol":"vless","path":"/a","port":10085}]`, wantErr: "already used by the V2Ray API"},
+		{name: "port out of range", spec: `[{"tag":"a","protocol":"trojan","network":"tcp","port":70000}]`, wantErr: "between 1 and 65535"},
+		{name: "shadowsocks method", spec: `[{"tag":"ss","protocol":"shadowsocks","path":"/ss","method":"aes-256-gcm","server_key":"` + key32 + `"}]`, wantErr: "method must be"},
+		{name: "shadowsocks key length", spec: `[{"tag":"ss","protocol":"shadowsocks","path":"/ss","server_key":"` + key32 + `"}]`, wantErr: "server_key must be 16 random bytes"},
+		{name: "shadowsocks over httpupgrade", spec: `[{"tag":"ss","protocol":"shadowsocks","network":"httpupgrade","path":"/ss","server_key":"` + key16 + `"}]`, wantErr: "cannot use httpupgrade"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("V2RAY_INBOUNDS", tt.spec)
+			defs, err := configureInbounds(defaultV2RayInternal, defaultListenPort)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				return
+			}
+			if len(defs) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", defs, tt.want)
+			}
+			for i := range defs {
+				if defs[i] != tt.want[i] {
+					t.Errorf("inbound %d: got %+v, want %+v", i, defs[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInboundAccountShadowsocks(t *testing.T) {
+	user := User{ID: "u1", EmailTag: "alice", SSKey: newSSKey()}
+	def := InboundDefinition{Tag: "ss", Protocol: protocolShadowsocks, Method: defaultSSMethod}
+
+	// Xray's AddUser expects the account message of the protocol, not its
+	// config's user; the email and level are those of the protocol.User.
+	message := inboundAccount(def, user)
+	if message.Type != "xray.proxy.shadowsocks_2022.Account" {
+		t.Fatalf("account type %s", message.Type)
+	}
+	var account shadowsocks_2022.Account
+	if err := proto.Unmarshal(message.Value, &account); err != nil {
+		t.Fatal(err)
+	}
+	key, err := base64.StdEncoding.DecodeString(account.Key)
+	if err != nil || len(key) != ssMethodKeyBytes[defaultSSMethod] || account.Key != userSSKey(user, def.Method) {
+		t.Errorf("account key %q (%v)", account.Key, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens are signed with HS256 by a keyring. JWT_SIGNING_KEYS lists the keys
+// as "kid:secret" pairs separated by commas: the first one signs new tokens,
+// and every one of them verifies tokens whose "kid" header names it. To
+// rotate, put a new key first and keep the old one listed until the tokens
+// it signed have expired (see sessionTTL). Without JWT_SIGNING_KEYS,
+// JWT_SECRET_KEY is the only key, with kid "default".
+
+const defaultJWTKeyID = "default"
+
+type jwtKeyring struct {
+	activeKID string
+	keys      map[string][]byte
+}
+
+var jwtKeys *jwtKeyring
+
+// loadJWTKeyring reads the keyring from JWT_SIGNING_KEYS or JWT_SECRET_KEY.
+func loadJWTKeyring() (*jwtKeyring, error) {
+	spec := os.Getenv("JWT_SIGNING_KEYS")
+	if spec == "" {
+		secret := os.Getenv("JWT_SECRET_KEY")
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET_KEY or JWT_SIGNING_KEYS environment variable must be set")
+		}
+		return &jwtKeyring{activeKID: defaultJWTKeyID, keys: map[string][]byte{defaultJWTKeyID: []byte(secret)}}, nil
+	}
+	if os.Getenv("JWT_SECRET_KEY") != "" {
+		log.Println("INFO: JWT_SIGNING_KEYS is set, JWT_SECRET_KEY is ignored")
+	}
+
+	keyring := &jwtKeyring{keys: make(map[string][]byte)}
+	for i, entry := range strings.Split(spec, ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS entry %d: expected <kid>:<secret>", i+1)
+		}
+		if _, dup := keyring.keys[kid]; dup {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS: key ID %q is listed twice", kid)
+		}
+		keyring.keys[kid] = []byte(secret)
+		if keyring.activeKID == "" {
+			keyring.activeKID = kid
+		}
+	}
+	log.Printf("JWT keyring: signing with %q, %d key(s) accepted", keyring.activeKID, len(keyring.keys))
+	return keyring, nil
+}
+
+// sign signs claims with the active key and names it in the "kid" header.
+func (k *jwtKeyring) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = k.activeKID
+	signedToken, err := token.SignedString(k.keys[k.activeKID])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return signedToken, nil
+}
+
+// parse verifies a token with the key its "kid" header names.
+func (k *jwtKeyring) parse(tokenString string, options ...jwt.ParserOption) (*jwt.Token, error) {
+	options = append(options, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, options...)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestLoadJWTKeyring(t *testing.T) {
+	tests := []struct {
+		name, signingKeys, secretKey string
+		wantActive                   string
+		wantKeys                     int
+		wantErr                      bool
+	}{
+		{"secret key only", "", "secret", defaultJWTKeyID, 1, false},
+		{"nothing set", "", "", "", 0, true},
+		{"signing keys", "new:secret2, old:secret1", "", "new", 2, false},
+		{"signing keys take precedence", "new:secret2", "secret", "new", 1, false},
+		{"missing secret", "new:", "", "", 0, true},
+		{"missing kid", ":secret", "", "", 0, true},
+		{"no separator", "secret", "", "", 0, true},
+		{"duplicate kid", "a:one,a:two", "", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_SIGNING_KEYS", tt.signingKeys)
+			t.Setenv("JWT_SECRET_KEY", tt.secretKey)
+			keyring, err := loadJWTKeyring()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (keyring.activeKID != tt.wantActive || len(keyring.keys) != tt.wantKeys) {
+				t.Errorf("active %q with %d keys, want %q with %d", keyring.activeKID, len(keyring.keys), tt.wantActive, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestJWTKeyringRotation(t *testing.T) {
+	old := &jwtKeyring{activeKID: "old", keys: map[string][]byte{"old": []byte("secret1")}}
+	rotated := &jwtKeyring{activeKID: "new", keys: map[string][]byte{"new": []byte("secret2"), "old": []byte("secret1")}}
+	retired := &jwtKeyring{activeKID: "new", keys: map[string][]byte{"new": []byte("secret2")}}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	oldToken, err := old.sign(jwt.MapClaims{"exp": exp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := rotated.sign(jwt.MapClaims{"exp": exp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Signed with the secret of "old" but naming "new"
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp})
+	forged.Header["kid"] = "new"
+	forgedToken, _ := forged.SignedString([]byte("secret1"))
+	noKID, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp}).SignedString([]byte("secret2"))
+	hs512 := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{"exp": exp})
+	hs512.Header["kid"] = "new"
+	hs512Token, _ := hs512.SignedString([]byte("secret2"))
+	noExp, _ := retired.sign(jwt.MapClaims{"sub": "alice"})
+
+	tests := []struct {
+		name    string
+		keyring *jwtKeyring
+		token   string
+		valid   bool
+	}{
+		{"old token during the rotation", rotated, oldToken, true},
+		{"new token during the rotation", rotated, newToken, true},
+		{"old token after the rotation", retired, oldToken, false},
+		{"new token after the rotation", retired, newToken, true},
+		{"new token before the rotation", old, newToken, false},
+		{"kid of another key", rotated, forgedToken, false},
+		{"no kid", retired, noKID, false},
+		{"other algorithm", retired, hs512Token, false},
+		{"no expiry", retired, noExp, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.keyring.parse(tt.token)
+			if valid := err == nil && token.Valid; valid != tt.valid {
+				t.Errorf("valid = %v (err %v), want %v", valid, err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins are counted per client IP and per username. After a few free
+// attempts every further one has to wait exponentially longer, and too many
+// failures lock the key out for a while. Attempts that come too early are
+// rejected with 429 before any password is checked. The counters live in
+// memory, or with LOGIN_LOCKOUT_PERSIST=true in the "login_attempts"
+// document of the store, so that all instances share them.
+
+const (
+	loginAttemptsDocument = "login_attempts"
+	loginFailureWindow    = time.Hour // Failures are forgotten after this long without new ones
+	maxLoginKeyLength     = 128
+)
+
+// loginThrottlePolicy is how hard failures on one kind of key are punished.
+type loginThrottlePolicy struct {
+	freeAttempts int           // Failures allowed without delay
+	baseDelay    time.Duration // Delay after the first failure past freeAttempts, doubled for each further one
+	maxDelay     time.Duration
+	lockoutAfter int // Failures that lock the key out
+	lockoutFor   time.Duration
+}
+
+var (
+	// A username is usually attacked from many IPs.
+	usernameThrottlePolicy = loginThrottlePolicy{freeAttempts: 3, baseDelay: time.Second, maxDelay: time.Minute, lockoutAfter: 10, lockoutFor: 15 * time.Minute}
+	// Several admins may share an IP (office NAT), so it gets more slack.
+	ipThrottlePolicy = loginThrottlePolicy{freeAttempts: 10, baseDelay: time.Second, maxDelay: time.Minute, lockoutAfter: 50, lockoutFor: 30 * time.Minute}
+)
+
+func loginThrottlePolicyFor(key string) loginThrottlePolicy {
+	if strings.HasPrefix(key, "ip:") {
+		return ipThrottlePolicy
+	}
+	return usernameThrottlePolicy
+}
+
+// loginAttempts are the recent failures of one key.
+type loginAttempts struct {
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// wait returns how long the key has to wait before its next attempt.
+func (a loginAttempts) wait(policy loginThrottlePolicy, now time.Time) time.Duration {
+	if a.LockedUntil != nil && now.Before(*a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if a.Failures <= policy.freeAttempts {
+		return 0
+	}
+	delay := policy.maxDelay
+	if shift := a.Failures - policy.freeAttempts - 1; shift < 16 {
+		delay = policy.baseDelay << shift
+		if delay > policy.maxDelay {
+			delay = policy.maxDelay
+		}
+	}
+	if remaining := a.LastFailure.Add(delay).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// loginAttemptsState holds the attempts of all keys ("ip:..." and "user:...").
+type loginAttemptsState map[string]loginAttempts
+
+// fail records a failure of key and reports whether it locked the key out.
+func (s loginAttemptsState) fail(key string, now time.Time) bool {
+	policy := loginThrottlePolicyFor(key)
+	attempts := s[key]
+	attempts.Failures++
+	attempts.LastFailure = now
+	locked := false
+	if attempts.Failures >= policy.lockoutAfter {
+		until := now.Add(policy.lockoutFor)
+		attempts.LockedUntil = &until
+		locked = true
+	}
+	s[key] = attempts
+	return locked
+}
+
+// prune drops keys that are neither locked out nor failed recently.
+func (s loginAttemptsState) prune(now time.Time) {
+	for key, attempts := range s {
+		locked := attempts.LockedUntil != nil && now.Before(*attempts.LockedUntil)
+		if !locked && now.Sub(attempts.LastFailure) > loginFailureWindow {
+			delete(s, key)
+		}
+	}
+}
+
+func decodeLoginAttempts(data []byte) (loginAttemptsState, error) {
+	state := make(loginAttemptsState)
+	if data == nil {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal login attempts: %v", err)
+	}
+	return state, nil
+}
+
+// loginGuard throttles logins. With a store set the state is read from and
+// written to it on every attempt, otherwise it is kept in memory.
+type loginGuard struct {
+	mu    sync.Mutex
+	state loginAttemptsState
+	store UserStore // nil unless LOGIN_LOCKOUT_PERSIST is set
+
+	trustedProxyHops int // Proxies in front of the service appending to X-Forwarded-For
+}
+
+var logins = &loginGuard{state: make(loginAttemptsState), trustedProxyHops: 1}
+
+// configureLoginGuard applies LOGIN_LOCKOUT_PERSIST and TRUSTED_PROXY_HOPS.
+func configureLoginGuard(store UserStore) {
+	if hops := os.Getenv("TRUSTED_PROXY_HOPS"); hops != "" {
+		n, err := strconv.Atoi(hops)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid TRUSTED_PROXY_HOPS %q: expected a non-negative integer", hops)
+		}
+		logins.trustedProxyHops = n
+	}
+	if persist, _ := strconv.ParseBool(os.Getenv("LOGIN_LOCKOUT_PERSIST")); persist {
+		logins.store = store
+		log.Printf("Login lockouts are persisted in %s", store.Describe())
+	}
+}
+
+// clientIP returns the address a request came from. Behind Cloud Run it is
+// the X-Forwarded-For entry appended by the outermost trusted proxy; entries
+// before it are supplied by the client and cannot be trusted.
+func (g *loginGuard) clientIP(r *http.Request) string {
+	if g.trustedProxyHops > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		if len(hops) > 0 {
+			i := len(hops) - g.trustedProxyHops
+			if i < 0 {
+				i = 0
+			}
+			if ip := net.ParseIP(strings.TrimSpace(hops[i])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginKeys returns the throttling keys of a login attempt. IPv6 clients are
+// counted per /64, which a single host usually controls entirely.
+func loginKeys(ip, username string) []string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		ip = parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	username = strings.ToLower(username)
+	if len(username) > maxLoginKeyLength {
+		username = username[:maxLoginKeyLength]
+	}
+	return []string{"ip:" + ip, "user:" + username}
+}
+
+// errLoginThrottled aborts the state update of an attempt that must wait,
+// so that rejecting it costs no write.
+var errLoginThrottled = errors.New("login attempt throttled")
+
+// apply runs mutate on the state, through the store if it is persisted. An
+// error from mutate leaves the stored state alone and is returned as is.
+func (g *loginGuard) apply(ctx context.Context, mutate func(state loginAttemptsState) error) error {
+	if g.store == nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return mutate(g.state)
+	}
+	var updated loginAttemptsState
+	var mutateErr error
+	_, err := g.store.UpdateDocument(ctx, loginAttemptsDocument, func(data []byte) ([]byte, error) {
+		state, err := decodeLoginAttempts(data)
+		if err != nil {
+			return nil, err
+		}
+		if mutateErr = mutate(state); mutateErr != nil {
+			return nil, mutateErr
+		}
+		updated = state
+		return json.MarshalIndent(state, "", "  ")
+	})
+	if mutateErr != nil {
+		return mutateErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save login attempts to %s: %v", g.store.Describe(), err)
+	}
+	g.mu.Lock()
+	g.state = updated
+	g.mu.Unlock()
+	return nil
+}
+
+// loginAdmission is an attempt let through by admit. It is counted as a
+// failure right away, in the same update that checked the throttle, so that
+// concurrent attempts cannot all pass the check before any of them fails.
+// fail keeps that failure, succeed and release take it back.
+type loginAdmission struct {
+	keys    []string
+	locked  []string // Keys the provisional failure locked out
+	settled bool     // fail, succeed or release was called
+}
+
+// admit checks the throttle before a login attempt by username and records
+// the attempt as a provisional failure. It answers 429 with Retry-After
+// itself and returns false if the attempt must wait. The admission is passed
+// to fail or succeed afterwards, and to release on every other way out.
+func (g *loginGuard) admit(w http.ResponseWriter, r *http.Request, username string) (*loginAdmission, bool) {
+	ip := g.clientIP(r)
+	admission := &loginAdmission{keys: loginKeys(ip, username)}
+	now := time.Now()
+	var wait time.Duration
+	err := g.apply(r.Context(), func(state loginAttemptsState) error {
+		wait, admission.locked = 0, nil
+		state.prune(now)
+		for _, key := range admission.keys {
+			if w := state[key].wait(loginThrottlePolicyFor(key), now); w > wait {
+				wait = w
+			}
+		}
+		if wait > 0 {
+			return errLoginThrottled
+		}
+		for _, key := range admission.keys {
+			if state.fail(key, now) {
+				admission.locked = append(admission.locked, key)
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLoginThrottled) {
+		log.Printf("ERROR: %v", err)
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+		return nil, false
+	}
+	if wait > 0 {
+		seconds := int(wait.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		logSecurityEvent("login_throttled", username, ip, fmt.Sprintf("retry after %ds", seconds))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeJSONResponse(w, http.StatusTooManyRequests, map[string]string{"error": fmt.Sprintf("Too many failed login attempts; try again in %d seconds", seconds)})
+		return nil, false
+	}
+	return admission, true
+}
+
+// fail keeps the failure admit recorded. reason goes to the security log
+// only, never to the client.
+func (g *loginGuard) fail(r *http.Request, admission *loginAdmission, username, reason string) {
+	admission.settled = true
+	ip := g.clientIP(r)
+	logSecurityEvent("login_failed", username, ip, reason)
+	for _, key := range admission.locked {
+		logSecurityEvent("login_locked_out", username, ip, key)
+	}
+}
+
+// succeed forgets the failures of the admission's keys, the provisional one
+// included.
+func (g *loginGuard) succeed(r *http.Request, admission *loginAdmission, username string) {
+	admission.settled = true
+	logSecurityEvent("login_succeeded", username, g.clientIP(r), "")
+	err := g.apply(r.Context(), func(state loginAttemptsState) error {
+		for _, key := range admission.keys {
+			delete(state, key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// release takes back the provisional failure of an attempt that neither
+// failed nor succeeded, e.g. a correct password that still needs a second
+// factor, or an internal error. It does nothing after fail or succeed.
+func (g *loginGuard) release(r *http.Request, admission *loginAdmission) {
+	if admission.settled {
+		return
+	}
+	admission.settled = true
+	err := g.apply(r.Context(), func(state loginAttemptsState) error {
+		for _, key := range admission.keys {
+			attempts, ok := state[key]
+			if !ok {
+				continue // Cleared by a success meanwhile
+			}
+			attempts.Failures--
+			for _, locked := range admission.locked {
+				if locked == key {
+					attempts.LockedUntil = nil
+				}
+			}
+			if attempts.Failures <= 0 && attempts.LockedUntil == nil {
+				delete(state, key)
+			} else {
+				state[key] = attempts
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// dummyPasswordHash is compared against when the username is unknown, so
+// that unknown and known usernames take the same time to reject.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not the password of any admin"), bcrypt.DefaultCost)
+
+// verifyAdminCredentials returns the admin named username if password is
+// theirs. It always performs one bcrypt comparison.
+func verifyAdminCredentials(ctx context.Context, store UserStore, username, password string) (admin Admin, reason string, err error) {
+	admin, ok, err := admins.lookup(ctx, store, username)
+	if err != nil {
+		return Admin{}, "", err
+	}
+	hash := dummyPasswordHash
+	if ok {
+		hash = []byte(admin.PasswordHash)
+	}
+	passwordOK := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	switch {
+	case !ok:
+		return Admin{}, "unknown username", nil
+	case !passwordOK:
+		return Admin{}, "wrong password", nil
+	}
+	return admin, "", nil
+}
+
+// authenticatedEvents are the security events whose username has proven
+// who they are; for the others it is only the account that was tried.
+var authenticatedEvents = map[string]bool{"login_succeeded": true, "sso_login_succeeded": true, "logout": true}
+
+// logSecurityEvent records an authentication event in the audit log as
+// action "auth.<event>" on the account username (see audit.go).
+func logSecurityEvent(event, username, ip, detail string) {
+	if len(username) > maxLoginKeyLength {
+		username = username[:maxLoginKeyLength]
+	}
+	record := AuditEvent{Action: "auth." + event, Target: username, IP: ip, Detail: detail}
+	if authenticatedEvents[event] {
+		record.Actor = username
+	}
+	recordAuditEvent(record)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptsWait(t *testing.T) {
+	policy := loginThrottlePolicy{freeAttempts: 3, baseDelay: time.Second, maxDelay: time.Minute, lockoutAfter: 10, lockoutFor: 15 * time.Minute}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lockedUntil := now.Add(5 * time.Minute)
+
+	tests := []struct {
+		name     string
+		attempts loginAttempts
+		want     time.Duration
+	}{
+		{"no failures", loginAttempts{}, 0},
+		{"free attempts used up", loginAttempts{Failures: 3, LastFailure: now}, 0},
+		{"first delayed attempt", loginAttempts{Failures: 4, LastFailure: now}, time.Second},
+		{"delay doubles", loginAttempts{Failures: 5, LastFailure: now}, 2 * time.Second},
+		{"and doubles again", loginAttempts{Failures: 7, LastFailure: now}, 8 * time.Second},
+		{"capped at the maximum", loginAttempts{Failures: 10, LastFailure: now}, time.Minute},
+		{"no overflow for many failures", loginAttempts{Failures: 200, LastFailure: now}, time.Minute},
+		{"delay partly over", loginAttempts{Failures: 5, LastFailure: now.Add(-1500 * time.Millisecond)}, 500 * time.Millisecond},
+		{"delay over", loginAttempts{Failures: 5, LastFailure: now.Add(-time.Hour)}, 0},
+		{"locked out", loginAttempts{Failures: 10, LastFailure: now, LockedUntil: &lockedUntil}, 5 * time.Minute},
+		{"lockout over", loginAttempts{Failures: 10, LastFailure: now.Add(-time.Hour), LockedUntil: &now}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.attempts.wait(policy, now); got != tt.want {
+				t.Errorf("wait = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginAttemptsLockout(t *testing.T) {
+	state := make(loginAttemptsState)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := "user:alice"
+
+	for i := 1; i < usernameThrottlePolicy.lockoutAfter; i++ {
+		if state.fail(key, now) {
+			t.Fatalf("locked out after %d failures, want %d", i, usernameThrottlePolicy.lockoutAfter)
+		}
+	}
+	if !state.fail(key, now) {
+		t.Fatalf("not locked out after %d failures", usernameThrottlePolicy.lockoutAfter)
+	}
+	if got := state[key].wait(usernameThrottlePolicy, now); got != usernameThrottlePolicy.lockoutFor {
+		t.Fatalf("wait after lockout = %s, want %s", got, usernameThrottlePolicy.lockoutFor)
+	}
+
+	// IPs get more slack than usernames.
+	for i := 0; i < usernameThrottlePolicy.lockoutAfter; i++ {
+		if state.fail("ip:192.0.2.1", now) {
+			t.Fatalf("IP locked out after %d failures", i+1)
+		}
+	}
+
+	// A lockout outlives the failure window, stale failures do not.
+	state["user:bob"] = loginAttempts{Failures: 1, LastFailure: now.Add(-loginFailureWindow - time.Minute)}
+	state.prune(now)
+	if _, ok := state["user:bob"]; ok {
+		t.Error("stale failures were not pruned")
+	}
+	if _, ok := state[key]; !ok {
+		t.Error("an active lockout was pruned")
+	}
+	state.prune(now.Add(usernameThrottlePolicy.lockoutFor + loginFailureWindow + time.Minute))
+	if _, ok := state[key]; ok {
+		t.Error("an expired lockout was not pruned")
+	}
+}
+
+// tryLogin runs admit for a login attempt by username from ip and returns
+// the admission, or nil and the response code if it was refused.
+func tryLogin(guard *loginGuard, ip, username string) (*loginAdmission, int) {
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	r.RemoteAddr = ip + ":4242"
+	w := httptest.NewRecorder()
+	admission, ok := guard.admit(w, r, username)
+	if !ok {
+		return nil, w.Code
+	}
+	return admission, http.StatusOK
+}
+
+func TestLoginGuardRecordsFailures(t *testing.T) {
+	guard := &loginGuard{state: make(loginAttemptsState)}
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+
+	for i := 0; i <= usernameThrottlePolicy.freeAttempts; i++ {
+		admission, code := tryLogin(guard, "192.0.2.1", "Alice")
+		if admission == nil {
+			t.Fatalf("attempt %d: got %d", i+1, code)
+		}
+		guard.fail(r, admission, "Alice", "wrong password")
+	}
+	if _, code := tryLogin(guard, "192.0.2.1", "alice"); code != http.StatusTooManyRequests {
+		t.Fatalf("after the free attempts: got %d, want 429", code)
+	}
+	// The same username from another IP waits too, another username does not.
+	if _, code := tryLogin(guard, "198.51.100.7", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("the username was not throttled from another IP: got %d", code)
+	}
+	admission, code := tryLogin(guard, "198.51.100.7", "bob")
+	if admission == nil {
+		t.Fatalf("another username from another IP: got %d", code)
+	}
+	guard.succeed(r, admission, "bob")
+	if attempts, ok := guard.state["user:bob"]; ok {
+		t.Errorf("a success left %+v", attempts)
+	}
+
+	// Success clears the failures of its keys.
+	guard.state["user:alice"] = loginAttempts{Failures: usernameThrottlePolicy.freeAttempts, LastFailure: time.Now()}
+	admission, _ = tryLogin(guard, "203.0.113.1", "alice")
+	guard.succeed(r, admission, "alice")
+	if _, ok := guard.state["user:alice"]; ok {
+		t.Fatal("the failures were kept after a success")
+	}
+}
+
+func TestLoginGuardRelease(t *testing.T) {
+	guard := &loginGuard{state: make(loginAttemptsState)}
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+
+	// An attempt that neither failed nor succeeded, such as a correct
+	// password that still needs a second factor, is not counted.
+	for i := 0; i < 2*usernameThrottlePolicy.lockoutAfter; i++ {
+		admission, code := tryLogin(guard, "192.0.2.1", "alice")
+		if admission == nil {
+			t.Fatalf("attempt %d: got %d", i+1, code)
+		}
+		guard.release(r, admission)
+	}
+	if len(guard.state) != 0 {
+		t.Fatalf("released attempts left %v", guard.state)
+	}
+
+	// Release after fail does not take the failure back.
+	admission, _ := tryLogin(guard, "192.0.2.1", "alice")
+	guard.fail(r, admission, "alice", "wrong password")
+	guard.release(r, admission)
+	if got := guard.state["user:alice"].Failures; got != 1 {
+		t.Fatalf("%d failures after fail and release, want 1", got)
+	}
+
+	// A provisional failure that locked the key out is undone with its lockout.
+	guard.state["user:alice"] = loginAttempts{Failures: usernameThrottlePolicy.lockoutAfter - 1, LastFailure: time.Now().Add(-2 * usernameThrottlePolicy.maxDelay)}
+	admission, _ = tryLogin(guard, "192.0.2.1", "alice")
+	if len(admission.locked) != 1 || guard.state["user:alice"].LockedUntil == nil {
+		t.Fatalf("the provisional failure did not lock the key out: %+v", admission)
+	}
+	guard.release(r, admission)
+	if attempts := guard.state["user:alice"]; attempts.LockedUntil != nil || attempts.Failures != usernameThrottlePolicy.lockoutAfter-1 {
+		t.Fatalf("after release: %+v", attempts)
+	}
+}
+
+func TestLoginGuardConcurrentAttempts(t *testing.T) {
+	for _, persisted := range []bool{false, true} {
+		guard := &loginGuard{state: make(loginAttemptsState)}
+		if persisted {
+			guard.store = newTestStore(t)
+		}
+		// Guesses sent at once are admitted no faster than one after another.
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		admitted := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if admission, _ := tryLogin(guard, "192.0.2.1", "alice"); admission != nil {
+					mu.Lock()
+					admitted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if want := usernameThrottlePolicy.freeAttempts + 1; admitted != want {
+			t.Errorf("persisted %v: %d concurrent attempts admitted, want %d", persisted, admitted, want)
+		}
+	}
+}
+
+func TestLoginGuardPersisted(t *testing.T) {
+	store := newTestStore(t)
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+
+	first := &loginGuard{state: make(loginAttemptsState), store: store}
+	for i := 0; i <= usernameThrottlePolicy.freeAttempts; i++ {
+		admission, code := tryLogin(first, "192.0.2.1", "alice")
+		if admission == nil {
+			t.Fatalf("attempt %d: got %d", i+1, code)
+		}
+		first.fail(r, admission, "alice", "wrong password")
+	}
+	// Another instance sees the failures through the store.
+	second := &loginGuard{state: make(loginAttemptsState), store: store}
+	if _, code := tryLogin(second, "192.0.2.1", "alice"); code != http.StatusTooManyRequests {
+		t.Fatalf("second instance: got %d, want 429", code)
+	}
+	data, err := store.LoadDocument(context.Background(), loginAttemptsDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := decodeLoginAttempts(data)
+	if err != nil || state["user:alice"].Failures != usernameThrottlePolicy.freeAttempts+1 {
+		t.Fatalf("stored attempts %+v, %v", state, err)
+	}
+}
+
+func TestLoginKeys(t *testing.T) {
+	tests := []struct {
+		ip, username string
+		want         []string
+	}{
+		{"192.0.2.1", "Alice", []string{"ip:192.0.2.1", "user:alice"}},
+		{"2001:db8:1:2:3:4:5:6", "bob", []string{"ip:2001:db8:1:2::/64", "user:bob"}},
+		{"2001:db8:1:2:ffff::1", "bob", []string{"ip:2001:db8:1:2::/64", "user:bob"}},
+	}
+	for _, tt := range tests {
+		got := loginKeys(tt.ip, tt.username)
+		if len(got) != 2 || got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("loginKeys(%q, %q) = %v, want %v", tt.ip, tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		hops         int
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"no proxy trusted", 0, "203.0.113.9:4242", []string{"192.0.2.1"}, "203.0.113.9"},
+		{"no header", 1, "203.0.113.9:4242", nil, "203.0.113.9"},
+		{"one hop", 1, "10.0.0.1:4242", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"spoofed entry before the trusted one", 1, "10.0.0.1:4242", []string{"198.51.100.66, 192.0.2.1"}, "192.0.2.1"},
+		{"two hops", 2, "10.0.0.1:4242", []string{"198.51.100.66, 192.0.2.1, 10.0.0.2"}, "192.0.2.1"},
+		{"split across headers", 2, "10.0.0.1:4242", []string{"198.51.100.66, 192.0.2.1", "10.0.0.2"}, "192.0.2.1"},
+		{"fewer entries than hops", 3, "10.0.0.1:4242", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"garbage entry", 1, "10.0.0.1:4242", []string{"not-an-ip"}, "10.0.0.1"},
+		{"IPv6 entry", 1, "10.0.0.1:4242", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"IPv6 remote address", 0, "[2001:db8::2]:4242", nil, "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := &loginGuard{trustedProxyHops: tt.hops}
+			r := httptest.NewRequest("POST", "/api/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := guard.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
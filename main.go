@@ -4,29 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"time"
 
 	"errors"
 	"net/http"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
 	"path/filepath" // For joining paths
 
-	"cloud.google.com/go/storage"
 	"github.com/google/uuid"
 	// "github.com/gorilla/mux" // Will be added if chosen for routing
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	// Assuming the generated proto path, adjust if different
-	statsService "main/internal/v2rayapi/stats/command"
-
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -34,23 +25,17 @@ import (
 var (
 	currentUsersConfig UsersConfig
 	configMutex        = &sync.RWMutex{}
-	v2rayCmd           *exec.Cmd
-	v2rayRestartMutex  = &sync.Mutex{}
-
-	// Admin credentials and JWT secret
-	adminUsername  string
-	adminPassword  string
-	jwtSecretKey []byte
+	v2raySupervisor    *V2RaySupervisor
 )
 
 // V2Ray related structures
 type Config struct {
-	Log       LogEntry      `json:"log,omitempty"`
-	API       *APIConfig    `json:"api,omitempty"`    // Pointer to allow omitting if not configured
-	Policy    *PolicyConfig `json:"policy,omitempty"` // Pointer to allow omitting
+	Log       LogEntry       `json:"log,omitempty"`
+	API       *APIConfig     `json:"api,omitempty"`     // Pointer to allow omitting if not configured
+	Policy    *PolicyConfig  `json:"policy,omitempty"`  // Pointer to allow omitting
 	Routing   *RoutingConfig `json:"routing,omitempty"` // Pointer to allow omitting
-	Inbounds  []Inbound     `json:"inbounds,omitempty"`
-	Outbounds []Outbound    `json:"outbounds,omitempty"`
+	Inbounds  []Inbound      `json:"inbounds,omitempty"`
+	Outbounds []Outbound     `json:"outbounds,omitempty"`
 	// Add other fields like dns, transport as needed
 }
 
@@ -61,7 +46,7 @@ type APIConfig struct {
 
 type PolicyConfig struct {
 	Levels map[string]LevelPolicy `json:"levels"`
-	System SystemPolicy         `json:"system"`
+	System SystemPolicy           `json:"system"`
 }
 
 type LevelPolicy struct {
@@ -82,15 +67,14 @@ type RoutingConfig struct {
 }
 
 type RoutingRule struct {
-	Type        string   `json:"type"`              // "field"
+	Type        string   `json:"type"`                 // "field"
 	InboundTag  []string `json:"inboundTag,omitempty"` // Can be nil
 	OutboundTag string   `json:"outboundTag"`
-	Domain      []string `json:"domain,omitempty"`    // Can be nil
-	Protocol    []string `json:"protocol,omitempty"`  // Can be nil
+	Domain      []string `json:"domain,omitempty"`   // Can be nil
+	Protocol    []string `json:"protocol,omitempty"` // Can be nil
 	// Add other rule fields: port, source, user, etc.
 }
 
-
 type LogEntry struct {
 	Loglevel string `json:"loglevel"` // "warning", "error", etc.
 	Access   string `json:"access"`   // Path to access log
@@ -107,27 +91,32 @@ type Inbound struct {
 }
 
 type InboundSettings struct {
-	Clients  []Client `json:"clients"`
-	Decryption string `json:"decryption,omitempty"` // For VLESS
-	Default *DefaultClient `json:"default,omitempty"`
+	Clients    []Client       `json:"clients"`
+	Decryption string         `json:"decryption,omitempty"` // For VLESS
+	Default    *DefaultClient `json:"default,omitempty"`
+	Method     string         `json:"method,omitempty"`   // For Shadowsocks 2022
+	Password   string         `json:"password,omitempty"` // Shadowsocks 2022 server key
+	Network    string         `json:"network,omitempty"`  // Shadowsocks: "tcp" or "tcp,udp"
 }
 
 type Client struct {
-	ID      string `json:"id"` // UUID
-	AlterID int    `json:"alterId"`
-	Email   string `json:"email,omitempty"` // Optional
-	Level   int    `json:"level,omitempty"`
+	ID       string `json:"id,omitempty"` // UUID, for VLESS and VMess
+	AlterID  int    `json:"alterId,omitempty"`
+	Password string `json:"password,omitempty"` // For Trojan and Shadowsocks 2022
+	Email    string `json:"email,omitempty"`    // Optional
+	Level    int    `json:"level,omitempty"`
 }
 
 type DefaultClient struct {
 	AlterID int `json:"alterId"`
-	Level int `json:"level"`
+	Level   int `json:"level"`
 }
 
 type StreamSettings struct {
-	Network     string             `json:"network"`     // "ws", "tcp", "kcp", etc.
-	Security    string             `json:"security"`    // "none", "tls"
-	WSSettings  WebSocketSettings  `json:"wsSettings,omitempty"`
+	Network             string               `json:"network"`  // "ws", "tcp", "kcp", etc.
+	Security            string               `json:"security"` // "none", "tls"
+	WSSettings          *WebSocketSettings   `json:"wsSettings,omitempty"`
+	HTTPUpgradeSettings *HTTPUpgradeSettings `json:"httpupgradeSettings,omitempty"`
 	// TCPSettings tcp.Config         `json:"tcpSettings,omitempty"`
 	// KCPSettings kcp.Config         `json:"kcpSettings,omitempty"`
 	// TLSSettings tls.Config         `json:"tlsSettings,omitempty"` // Usually handled by Cloud Run
@@ -138,6 +127,10 @@ type WebSocketSettings struct {
 	Headers map[string]string `json:"headers,omitempty"`
 }
 
+type HTTPUpgradeSettings struct {
+	Path string `json:"path"`
+}
+
 type Outbound struct {
 	Protocol string           `json:"protocol"`
 	Settings OutboundSettings `json:"settings"`
@@ -149,134 +142,73 @@ type OutboundSettings struct {
 	// For other protocols like SOCKS, HTTP, etc., specific settings are needed
 }
 
-
 // User represents a user with traffic and time limits.
 type User struct {
-	ID             string    `json:"id"`
-	TrafficLimitGB float64   `json:"traffic_limit_gb"`
-	TimeLimitDays  int       `json:"time_limit_days"`
-	CreatedAt      time.Time `json:"created_at"`
-	TrafficUsedBytes int64   `json:"traffic_used_bytes"`
-	IsActive       bool      `json:"is_active"`
+	ID                   string               `json:"id"`
+	TrafficLimitGB       float64              `json:"traffic_limit_gb"`
+	TimeLimitDays        int                  `json:"time_limit_days"` // Input only, converted into ExpiresAt (see expiry.go)
+	CreatedAt            time.Time            `json:"created_at"`
+	TrafficUsedBytes     int64                `json:"traffic_used_bytes"`
+	IsActive             bool                 `json:"is_active"`
+	SubscriptionToken    string               `json:"subscription_token,omitempty"`     // Secret for /sub/{token}
+	TrafficResetStrategy TrafficResetStrategy `json:"traffic_reset_strategy,omitempty"` // When TrafficUsedBytes is zeroed, see quota_reset.go
+	LastTrafficResetAt   *time.Time           `json:"last_traffic_reset_at,omitempty"`
+	Status               UserStatus           `json:"status"`                  // See user_status.go; IsActive mirrors it
+	StatusReason         string               `json:"status_reason,omitempty"` // Why the status was last set
+	StatusChangedAt      *time.Time           `json:"status_changed_at,omitempty"`
+	OnHoldExpireAt       *time.Time           `json:"on_hold_expire_at,omitempty"` // On-hold users that never connect expire at this time
+	StartedAt            *time.Time           `json:"started_at,omitempty"`        // First traffic of a user created on hold; the time limit counts from here
+	ExpiresAt            *time.Time           `json:"expires_at"`                  // End of the time limit, null for unlimited
+	Username             string               `json:"username,omitempty"`          // Unique, see user_profile.go
+	Note                 string               `json:"note,omitempty"`
+	Contact              string               `json:"contact,omitempty"` // Email, Telegram handle, ...
+	Labels               []string             `json:"labels,omitempty"`
+	EmailTag             string               `json:"email_tag,omitempty"`       // V2Ray email for logs and stats, fixed at creation
+	TrojanPassword       string               `json:"trojan_password,omitempty"` // Trojan credential, see inbounds.go
+	SSKey                string               `json:"ss_key,omitempty"`          // Shadowsocks 2022 key (base64)
+	CreatedBy            string               `json:"created_by,omitempty"`      // Admin who created the user; resellers only see their own
+	// Counter values already included in TrafficUsedBytes, per V2Ray process (see accounting.go)
+	TrafficCounters map[string]TrafficCounterState `json:"traffic_counters,omitempty"`
 }
 
 // UsersConfig is a map of users, with User.ID as the key.
 type UsersConfig map[string]User
 
-// loadUsersConfig loads the user configuration from GCS.
-// If the object is not found, it returns an empty UsersConfig and nil error.
-func loadUsersConfig(bucketName, objectName string) (UsersConfig, error) {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("storage.NewClient: %v", err)
-	}
-	defer client.Close()
-
-	rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
-	if err == storage.ErrObjectNotExist {
-		log.Printf("Object %s in bucket %s not found, returning empty config", objectName, bucketName)
-		return make(UsersConfig), nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %v", objectName, err)
-	}
-	defer rc.Close()
-
-	data, err := ioutil.ReadAll(rc)
-	if err != nil {
-		return nil, fmt.Errorf("ioutil.ReadAll: %v", err)
+// userExpiry returns when the user's time limit ends, if it has one. On-hold
+// users have no expiry yet: it is set at their first traffic.
+func userExpiry(user User) (time.Time, bool) {
+	if user.Status == UserStatusOnHold || user.ExpiresAt == nil {
+		return time.Time{}, false
 	}
-
-	var users UsersConfig
-	if err := json.Unmarshal(data, &users); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %v", err)
-	}
-	return users, nil
+	return *user.ExpiresAt, true
 }
 
-// saveUsersConfig saves the user configuration to GCS.
-func saveUsersConfig(bucketName, objectName string, users UsersConfig) error {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return fmt.Errorf("storage.NewClient: %v", err)
-	}
-	defer client.Close()
-
-	data, err := json.MarshalIndent(users, "", "  ")
-	if err != nil {
-		return fmt.Errorf("json.MarshalIndent: %v", err)
-	}
-
-	wc := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
-	if _, err := wc.Write(data); err != nil {
-		return fmt.Errorf("Writer.Write: %v", err)
-	}
-	if err := wc.Close(); err != nil {
-		return fmt.Errorf("Writer.Close: %v", err)
-	}
-	log.Printf("Successfully saved config to gs://%s/%s", bucketName, objectName)
-	return nil
-}
-
-// queryV2RayStats queries the V2Ray StatsService for a user's traffic.
-// userEmailTag is the value set in client's Email field (e.g., "user_UUID").
-// resetCounter determines if the counter should be reset after querying.
-func queryV2RayStats(client statsService.StatsServiceClient, userEmailTag string, resetCounter bool) (uplink int64, downlink int64, err error) {
-	if client == nil {
-		return 0, 0, fmt.Errorf("StatsServiceClient is nil")
-	}
-	req := &statsService.GetStatsRequest{
-		Name:  fmt.Sprintf("user>>>%s>>>traffic>>>uplink", userEmailTag), // Pattern for user uplink
-		Reset: resetCounter,
-	}
-	respUp, err := client.GetStats(context.Background(), req)
-	if err != nil {
-		// It's possible the stat doesn't exist yet if user had no traffic
-		// V2Ray might return an error or an empty response. Handle gracefully.
-		// log.Printf("Debug: GetStats uplink for %s: err %v, resp %v", userEmailTag, err, respUp)
-		// For now, assume error means no data or actual error
-	}
-	if respUp != nil && respUp.Stat != nil {
-		uplink = respUp.Stat.Value
-	}
-
-	req.Name = fmt.Sprintf("user>>>%s>>>traffic>>>downlink", userEmailTag) // Pattern for user downlink
-	req.Reset = resetCounter // Reset for downlink should be same as uplink
-
-	respDown, err := client.GetStats(context.Background(), req)
-	if err != nil {
-		// log.Printf("Debug: GetStats downlink for %s: err %v, resp %v", userEmailTag, err, respDown)
+// userLimitExceeded returns which limit ("traffic limit", "time limit" or
+// "on-hold deadline") the user has reached at now, or an empty string if none.
+func userLimitExceeded(user User, now time.Time) string {
+	// Check against limit (GB to Bytes: limit * 1024^3)
+	if user.TrafficUsedBytes >= int64(user.TrafficLimitGB*1024*1024*1024) {
+		return "traffic limit"
 	}
-	if respDown != nil && respDown.Stat != nil {
-		downlink = respDown.Stat.Value
+	if user.Status == UserStatusOnHold {
+		if user.OnHoldExpireAt != nil && now.After(*user.OnHoldExpireAt) {
+			return "on-hold deadline"
+		}
+		return ""
 	}
-
-	// If there was an error for either, return it (uplink error takes precedence for simplicity)
-	// A more robust error handling might combine errors or check specific error types from V2Ray.
-	if err != nil { // Prioritizing uplink error, but downlink might also have one.
-		return uplink, downlink, fmt.Errorf("failed to get stats for %s (uplink or downlink): %v", userEmailTag, err)
+	if expiresAt, ok := userExpiry(user); ok && now.After(expiresAt) {
+		return "time limit"
 	}
-
-	return uplink, downlink, nil
+	return ""
 }
 
 // startTrafficMonitoringLoop periodically checks user traffic and deactivates them if limits are exceeded.
-func startTrafficMonitoringLoop(grpcApiAddress string, checkInterval time.Duration, gcsBucket, gcsObject, v2rayPort string) {
+func startTrafficMonitoringLoop(grpcApiAddress string, checkInterval time.Duration, store UserStore) {
 	log.Printf("Starting traffic monitoring loop. gRPC API: %s, Interval: %s", grpcApiAddress, checkInterval)
 
-	// Setup gRPC connection
-	// Note: This connection is long-lived. If it breaks, the loop will continuously fail.
-	// Production systems might need more robust connection handling (e.g., retry dialing).
-	conn, err := grpc.Dial(grpcApiAddress, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	if err != nil {
-		log.Fatalf("FATAL: Failed to connect to V2Ray gRPC API at %s: %v", grpcApiAddress, err)
-		return // Should not happen with WithBlock if server is up, but good practice.
-	}
-	defer conn.Close()
-	statsClient := statsService.NewStatsServiceClient(conn)
-	log.Printf("Successfully connected to V2Ray gRPC API at %s", grpcApiAddress)
+	// The gRPC connection is shared with the user handlers and is redialed
+	// whenever the supervisor reports a new V2Ray process generation.
+	lastGeneration := 0
 
 	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
@@ -285,174 +217,159 @@ func startTrafficMonitoringLoop(grpcApiAddress string, checkInterval time.Durati
 		select {
 		case <-ticker.C:
 			log.Println("Traffic monitoring tick: checking user stats...")
-			configMutex.Lock() // Lock for the entire check cycle to prevent concurrent API modifications
-
-			var configChanged bool = false
-			var needsV2RayRestart bool = false
-
-			usersToUpdate := make(map[string]User) // Store users that need updating in currentUsersConfig
-
-			for userID, user := range currentUsersConfig {
-				if !user.IsActive {
-					continue
-				}
-
-				userTag := "user_" + user.ID
-				// Query stats and reset them on V2Ray's side
-				uplink, downlink, err := queryV2RayStats(statsClient, userTag, true)
-				if err != nil {
-					// Log error but continue, as other users might be fine.
-					// V2Ray returns an error if the stat entry doesn't exist (e.g. user had no traffic yet)
-					// This is normal, so we might want to reduce log spam for "not found" errors.
-					// For now, logging all errors from queryV2RayStats.
-					log.Printf("WARN: Error querying stats for user %s (tag: %s): %v", userID, userTag, err)
-					continue
-				}
-
-				currentPeriodTraffic := uplink + downlink
-				if currentPeriodTraffic > 0 {
-					log.Printf("Traffic for user %s (tag: %s): Uplink=%d, Downlink=%d, Total Current Period=%d", userID, userTag, uplink, downlink, currentPeriodTraffic)
-					user.TrafficUsedBytes += currentPeriodTraffic
-					configChanged = true
-					log.Printf("User %s (tag: %s) updated TrafficUsedBytes to %d", userID, userTag, user.TrafficUsedBytes)
-				}
-
-				// Check against limit (GB to Bytes: limit * 1024^3)
-				if user.TrafficUsedBytes >= int64(user.TrafficLimitGB*1024*1024*1024) {
-					user.IsActive = false
-					log.Printf("INFO: User %s (tag: %s) DEACTIVATED due to traffic limit. Used: %d bytes, Limit: %.2f GB",
-						userID, userTag, user.TrafficUsedBytes, user.TrafficLimitGB)
-					configChanged = true
-					needsV2RayRestart = true // V2Ray needs to be reconfigured to remove/disable user
-				}
-
-				// Time limit check (only if user is still active)
-				if user.IsActive && user.TimeLimitDays > 0 {
-					expirationTime := user.CreatedAt.AddDate(0, 0, user.TimeLimitDays)
-					if time.Now().UTC().After(expirationTime) {
-						log.Printf("INFO: User %s (tag: %s) DEACTIVATED due to time limit. Created: %s, Limit: %d days, Expires: %s",
-							userID, userTag, user.CreatedAt.Format(time.RFC3339), user.TimeLimitDays, expirationTime.Format(time.RFC3339))
-						user.IsActive = false
-						configChanged = true
-						needsV2RayRestart = true
-					}
+			if !v2raySupervisor.IsRunning() {
+				log.Printf("Traffic monitoring tick skipped: V2Ray is %s", v2raySupervisor.Status().State)
+				continue
+			}
+			if generation := v2raySupervisor.Generation(); generation != lastGeneration {
+				if lastGeneration != 0 {
+					log.Printf("V2Ray restarted (generation %d -> %d), redialing gRPC API at %s", lastGeneration, generation, grpcApiAddress)
 				}
-				usersToUpdate[userID] = user
+				resetV2RayAPIConnection()
+				lastGeneration = generation
 			}
 
-			// Apply updates to currentUsersConfig
-			for uid, u := range usersToUpdate {
-				currentUsersConfig[uid] = u
+			deactivatedUsers, saved, err := accountTraffic(context.Background(), store)
+			if err != nil {
+				log.Printf("ERROR: Traffic accounting failed, it will be retried next tick: %v", err)
+				continue
+			}
+			if !saved {
+				log.Println("Traffic monitoring tick: no reportable traffic changes or deactivations.")
+			} else {
+				log.Printf("Successfully saved updated user config to %s.", store.Describe())
 			}
 
-			if configChanged {
-				log.Println("Configuration changed due to traffic updates/deactivations.")
-				// Create a deep copy for saving, to avoid holding lock during GCS operation for too long
-				configToSave := make(UsersConfig)
-				for k, v := range currentUsersConfig {
-					configToSave[k] = v
-				}
-				// Unlock before GCS save and potential V2Ray restart
-				configMutex.Unlock()
-
-				if err := saveUsersConfig(gcsBucket, gcsObject, configToSave); err != nil {
-					log.Printf("ERROR: Failed to save user config to GCS after traffic update/deactivation: %v", err)
-				} else {
-					log.Println("Successfully saved updated user config to GCS.")
+			for _, u := range deactivatedUsers {
+				before := u
+				before.IsActive = true
+				if err := syncV2RayUser(&before, &u); err != nil {
+					log.Printf("ERROR: Failed to remove deactivated user %s from V2Ray: %v", u.ID, err)
 				}
+			}
 
-				if needsV2RayRestart {
-					log.Println("V2Ray restart needed due to user deactivation.")
-					if err := handleRestartV2Ray(v2rayPort); err != nil {
-						log.Printf("ERROR: Failed to restart V2Ray after deactivating user(s): %v", err)
-					} else {
-						log.Println("V2Ray restarted successfully after user deactivation(s).")
-					}
+			// Resets run after accounting so traffic of the ending period is
+			// still counted against it.
+			reactivatedUsers, err := applyTrafficResets(context.Background(), store)
+			if err != nil {
+				log.Printf("ERROR: Traffic reset failed, it will be retried next tick: %v", err)
+				continue
+			}
+			for _, u := range reactivatedUsers {
+				before := u
+				before.IsActive = false
+				if err := syncV2RayUser(&before, &u); err != nil {
+					log.Printf("ERROR: Failed to add reactivated user %s to V2Ray: %v", u.ID, err)
 				}
-			} else {
-				configMutex.Unlock() // No changes, just unlock
-				log.Println("Traffic monitoring tick: no reportable traffic changes or deactivations.")
 			}
-		// TODO: Add a quit channel to gracefully stop this goroutine if needed.
-		// case <-quitChannel:
-		// 	 log.Println("Stopping traffic monitoring loop.")
-		// 	 return
+			// TODO: Add a quit channel to gracefully stop this goroutine if needed.
+			// case <-quitChannel:
+			// 	 log.Println("Stopping traffic monitoring loop.")
+			// 	 return
 		}
 	}
 }
 
 // --- HTTP Handlers ---
 
-// generateJWT creates a new JWT for the given username.
-func generateJWT(username string) (string, error) {
-	claims := jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
-		"iat":      time.Now().Unix(),
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(jwtSecretKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to sign token: %v", err)
-	}
-	return signedToken, nil
-}
-
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only POST method is allowed"})
-		return
-	}
+func loginHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only POST method is allowed"})
+			return
+		}
 
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
-		return
-	}
+		var req LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
+			return
+		}
 
-	// Check credentials
-	if req.Username == adminUsername && req.Password == adminPassword {
-		tokenString, err := generateJWT(req.Username)
+		// Too many recent failures for this IP or username get a 429 (login_guard.go)
+		admission, ok := logins.admit(w, r, req.Username)
+		if !ok {
+			return
+		}
+		defer logins.release(r, admission) // Unless it failed or succeeded
+
+		// Check credentials against the admin registry
+		admin, reason, err := verifyAdminCredentials(r.Context(), store, req.Username, req.Password)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load admins"})
+			return
+		}
+		if reason != "" {
+			logins.fail(r, admission, req.Username, reason)
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid username or password"})
+			return
+		}
+		// With 2FA the password only earns a challenge for /api/auth/login/2fa
+		challenge, err := loginChallenge(r.Context(), store, admin)
 		if err != nil {
-			log.Printf("ERROR: Failed to generate JWT: %v", err)
+			log.Printf("ERROR: %v", err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to start login"})
+			return
+		}
+		if challenge != nil {
+			writeJSONResponse(w, http.StatusOK, challenge)
+			return
+		}
+		tokens, err := startSession(r, store, admin)
+		if err != nil {
+			log.Printf("ERROR: Failed to start session: %v", err)
 			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
 			return
 		}
-		writeJSONResponse(w, http.StatusOK, map[string]string{"token": tokenString})
-	} else {
-		writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid username or password"})
+		logins.succeed(r, admission, admin.Username)
+		writeJSONResponse(w, http.StatusOK, tokens)
 	}
 }
 
-// jwtAuthMiddleware validates the JWT token from the Authorization header.
-func jwtAuthMiddleware(next http.Handler) http.Handler {
+// writeAuthError reports a failed authentication (401) or authorization
+// (403), using the v2 error envelope for v2 API routes.
+func writeAuthError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	if isAPIV2Request(r) {
+		code := apiErrUnauthorized
+		if statusCode == http.StatusForbidden {
+			code = apiErrForbidden
+		}
+		writeAPIError(w, statusCode, code, message)
+		return
+	}
+	writeJSONResponse(w, statusCode, map[string]string{"error": message})
+}
+
+// jwtAuthMiddleware validates the JWT token from the Authorization header and
+// puts the admin it names, with the role from the registry, into the request
+// context (see adminIdentityFromContext). API keys are accepted as well, in
+// the Authorization or X-API-Key header (apikeys.go).
+func jwtAuthMiddleware(store UserStore, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := apiKeyFromRequest(r); ok {
+			authenticateAPIKey(w, r, store, key, next)
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Authorization header required"})
+			writeAuthError(w, r, http.StatusUnauthorized, "Authorization header required")
 			return
 		}
 
 		bearerToken := strings.Split(authHeader, " ")
 		if len(bearerToken) != 2 || strings.ToLower(bearerToken[0]) != "bearer" {
-			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid token format; expected 'Bearer <token>'"})
+			writeAuthError(w, r, http.StatusUnauthorized, "Invalid token format; expected 'Bearer <token>'")
 			return
 		}
 
 		tokenString := bearerToken[1]
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// Check the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return jwtSecretKey, nil
-		})
+		token, err := jwtKeys.parse(tokenString) // Verified with the key named by its "kid" (jwt_keys.go)
 
 		if err != nil {
 			log.Printf("Token validation error: %v", err)
@@ -462,20 +379,51 @@ func jwtAuthMiddleware(next http.Handler) http.Handler {
 			} else if errors.Is(err, jwt.ErrTokenNotValidYet) {
 				errorMsg = "Token not valid yet"
 			}
-			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": errorMsg})
+			writeAuthError(w, r, http.StatusUnauthorized, errorMsg)
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			// Optionally, add claims to context for later handlers
-			// For example: username := claims["username"].(string)
-			// ctx := context.WithValue(r.Context(), "username", username)
-			// next.ServeHTTP(w, r.WithContext(ctx))
-			log.Printf("Authenticated user: %s", claims["username"])
-			next.ServeHTTP(w, r)
-		} else {
-			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid token claims"})
+		claims, ok := token.Claims.(jwt.MapClaims)
+		username, _ := claims["username"].(string)
+		tokenType, _ := claims["typ"].(string) // Login challenges are not access tokens
+		jti, _ := claims["jti"].(string)
+		sessionID, _ := claims["sid"].(string)
+		if !ok || !token.Valid || username == "" || tokenType != tokenTypeAccess || jti == "" || sessionID == "" {
+			writeAuthError(w, r, http.StatusUnauthorized, "Invalid token claims")
+			return
+		}
+		revoked, err := revokedTokens.contains(r.Context(), store, jti, sessionID)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			writeAuthError(w, r, http.StatusInternalServerError, "Failed to load revoked tokens")
+			return
+		}
+		if revoked {
+			writeAuthError(w, r, http.StatusUnauthorized, "Token has been revoked")
+			return
 		}
+		admin, ok, err := admins.lookup(r.Context(), store, username)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			writeAuthError(w, r, http.StatusInternalServerError, "Failed to load admins")
+			return
+		}
+		if !ok {
+			writeAuthError(w, r, http.StatusUnauthorized, "Admin account no longer exists")
+			return
+		}
+		missing, err := twoFactorSetupMissing(store, admin, r)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			writeAuthError(w, r, http.StatusInternalServerError, "Failed to load security settings")
+			return
+		}
+		if missing {
+			writeAuthError(w, r, http.StatusForbidden, "Two-factor authentication is required; set it up at /api/v2/me/2fa")
+			return
+		}
+		id := AdminIdentity{Username: admin.Username, Role: admin.Role, SessionID: sessionID, TokenID: jti, IP: logins.clientIP(r)}
+		next.ServeHTTP(w, r.WithContext(withAdminIdentity(r.Context(), id)))
 	})
 }
 
@@ -490,28 +438,47 @@ func writeJSONResponse(w http.ResponseWriter, statusCode int, data interface{})
 	}
 }
 
+// writeStoreError maps persistence errors to HTTP responses.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+	case errors.Is(err, errInvalidRequest):
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": strings.TrimPrefix(err.Error(), errInvalidRequest.Error()+": ")})
+	case errors.Is(err, errBudgetExceeded):
+		writeJSONResponse(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	case errors.Is(err, errUsernameTaken):
+		writeJSONResponse(w, http.StatusConflict, map[string]string{"error": "Username is already taken"})
+	case errors.Is(err, errApplyToV2Ray):
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to apply user to V2Ray: " + strings.TrimPrefix(err.Error(), errApplyToV2Ray.Error()+": ")})
+	case errors.Is(err, ErrStoreConflict):
+		writeJSONResponse(w, http.StatusConflict, map[string]string{"error": "User was modified concurrently by another instance; reload and try again"})
+	default:
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save configuration: " + err.Error()})
+	}
+}
+
 func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	configMutex.RLock()
 	defer configMutex.RUnlock()
 
 	usersList := []User{}
 	for _, user := range currentUsersConfig {
-		usersList = append(usersList, user)
+		if userVisibleTo(r.Context(), user) {
+			usersList = append(usersList, user)
+		}
 	}
 	writeJSONResponse(w, http.StatusOK, usersList)
 }
 
 func getUserHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("id")
+	userID := userIDFromRequest(r)
 	if userID == "" {
 		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required"})
 		return
 	}
 
-	configMutex.RLock()
-	defer configMutex.RUnlock()
-
-	user, exists := currentUsersConfig[userID]
+	user, exists := lookupUser(r.Context(), userID)
 	if !exists {
 		writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User not found"})
 		return
@@ -519,157 +486,156 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSONResponse(w, http.StatusOK, user)
 }
 
-func createUserHandler(gcsBucket, gcsObject, v2rayPort string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var newUser User
-		if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
-			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
-			return
-		}
-
-		// Validate required fields (example: TrafficLimitGB and TimeLimitDays)
-		// More specific validation can be added here.
-		if newUser.TrafficLimitGB <= 0 || newUser.TimeLimitDays <= 0 {
-			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "TrafficLimitGB and TimeLimitDays must be positive values"})
-			return
-		}
-
-		newUser.ID = uuid.NewString()
-		newUser.CreatedAt = time.Now().UTC()
-		newUser.IsActive = true      // Default to active
-		newUser.TrafficUsedBytes = 0 // Initialize traffic used
+// errApplyToV2Ray marks a change that was saved but could not be applied to
+// the running V2Ray process.
+var errApplyToV2Ray = errors.New("failed to apply user to V2Ray")
 
-		configMutex.Lock()
-		if currentUsersConfig == nil {
-			currentUsersConfig = make(UsersConfig)
-		}
-		currentUsersConfig[newUser.ID] = newUser
-		// Create a deep copy for saving, to avoid holding lock during GCS operation for too long
-		configToSave := make(UsersConfig)
-		for k, v := range currentUsersConfig {
-			configToSave[k] = v
+// createUser validates newUser, fills in the server-side fields, saves it and
+// adds it to the running V2Ray.
+func createUser(ctx context.Context, store UserStore, newUser User) (User, error) {
+	// Validate required fields. Without time_limit_days or expires_at
+	// the user never expires.
+	if newUser.TrafficLimitGB <= 0 || newUser.TimeLimitDays < 0 {
+		return User{}, invalidRequestf("TrafficLimitGB must be positive and TimeLimitDays must not be negative")
+	}
+	if newUser.ExpiresAt != nil && (newUser.TimeLimitDays > 0 || newUser.Status == UserStatusOnHold) {
+		return User{}, invalidRequestf("expires_at cannot be combined with time_limit_days or on_hold")
+	}
+	if err := validateTrafficResetStrategy(newUser.TrafficResetStrategy); err != nil {
+		return User{}, invalidRequestf("%v", err)
+	}
+	if err := validateAdminStatus(newUser.Status); err != nil {
+		return User{}, invalidRequestf("%v", err)
+	}
+	if newUser.Username != "" {
+		if err := validateUsername(newUser.Username); err != nil {
+			return User{}, err
 		}
-		configMutex.Unlock() // Unlock before potentially long I/O operations
-
-		if err := saveUsersConfig(gcsBucket, gcsObject, configToSave); err != nil {
-			log.Printf("ERROR: Failed to save user config to GCS: %v", err)
-			// Potentially revert currentUsersConfig change or handle inconsistency?
-			// For now, log and proceed with restart, but the state might be inconsistent.
-			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save configuration: " + err.Error()})
-			return
+	}
+	if err := validateProfileText(newUser.Note, newUser.Contact); err != nil {
+		return User{}, err
+	}
+	labels, err := normalizeLabels(newUser.Labels)
+	if err != nil {
+		return User{}, err
+	}
+	newUser.Labels = labels
+
+	newUser.ID = uuid.NewString()
+	newUser.CreatedAt = time.Now().UTC()
+	newUser.StartedAt = nil
+	switch newUser.Status {
+	case UserStatusDisabledByAdmin:
+		setUserStatus(&newUser, UserStatusDisabledByAdmin, "created disabled", newUser.CreatedAt)
+	case UserStatusOnHold:
+		setUserStatus(&newUser, UserStatusOnHold, "waiting for first connection", newUser.CreatedAt)
+	default:
+		setUserStatus(&newUser, UserStatusActive, "", newUser.CreatedAt) // Default to active
+	}
+	if newUser.Status != UserStatusOnHold {
+		newUser.OnHoldExpireAt = nil
+	}
+	if newUser.ExpiresAt != nil {
+		expiresAt := newUser.ExpiresAt.UTC()
+		newUser.ExpiresAt = &expiresAt
+	}
+	if newUser.TimeLimitDays > 0 {
+		applyTimeLimitDays(&newUser, newUser.TimeLimitDays)
+	}
+	newUser.TrafficUsedBytes = 0 // Initialize traffic used
+	newUser.TrafficCounters = nil
+	newUser.SubscriptionToken = newSubscriptionToken()
+	newUser.TrojanPassword, newUser.SSKey = "", ""
+	assignProxyCredentials(&newUser)
+	newUser.LastTrafficResetAt = nil
+	newUser.CreatedBy = ""
+	if id, ok := adminIdentityFromContext(ctx); ok {
+		newUser.CreatedBy = id.Username
+	}
+
+	reservation, err := reserveResellerBudget(ctx, store, nil, newUser, newUser.CreatedAt)
+	if err != nil {
+		return User{}, err
+	}
+	err = persistUsers(ctx, store, func(users UsersConfig) error {
+		if err := checkUsernameFree(users, newUser.ID, newUser.Username); err != nil {
+			return err
 		}
-
-		if err := handleRestartV2Ray(v2rayPort); err != nil {
-			log.Printf("ERROR: Failed to restart V2Ray after creating user: %v", err)
-			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to restart V2Ray: " + err.Error()})
-			return
+		if err := reservation.checkUserCount(users); err != nil {
+			return err
 		}
+		assignEmailTag(users, &newUser)
+		users[newUser.ID] = newUser
+		return nil
+	})
+	if err != nil {
+		reservation.refund(ctx)
+		log.Printf("ERROR: Failed to save user to %s: %v", store.Describe(), err)
+		return User{}, err
+	}
+	recordAudit(ctx, "user.create", newUser.ID, nil, newUser)
 
-		writeJSONResponse(w, http.StatusCreated, newUser)
+	if err := syncV2RayUser(nil, &newUser); err != nil {
+		log.Printf("ERROR: Failed to apply new user to V2Ray: %v", err)
+		return newUser, fmt.Errorf("%w: %v", errApplyToV2Ray, err)
 	}
+	return newUser, nil
 }
 
-func updateUserHandler(gcsBucket, gcsObject, v2rayPort string) http.HandlerFunc {
+func createUserHandler(store UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := r.URL.Query().Get("id")
-		if userID == "" {
-			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required in query parameters"})
-			return
-		}
-
-		var updatedUserData User
-		if err := json.NewDecoder(r.Body).Decode(&updatedUserData); err != nil {
+		var newUser User
+		if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
 			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
 			return
 		}
 
-		configMutex.Lock()
-		existingUser, exists := currentUsersConfig[userID]
-		if !exists {
-			configMutex.Unlock()
-			writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		createdUser, err := createUser(r.Context(), store, newUser)
+		if err != nil {
+			writeStoreError(w, err)
 			return
 		}
+		writeJSONResponse(w, http.StatusCreated, createdUser)
+	}
+}
 
-		// Update fields (ID and CreatedAt should not change)
-		// Only update if new value is provided or has a meaningful zero value for the type
-		if updatedUserData.TrafficLimitGB > 0 {
-			existingUser.TrafficLimitGB = updatedUserData.TrafficLimitGB
-		}
-		if updatedUserData.TimeLimitDays > 0 {
-			existingUser.TimeLimitDays = updatedUserData.TimeLimitDays
-		}
-		// For IsActive, even if false, it's a valid update
-		// We need a way to distinguish "not provided" from "false" if IsActive was a pointer or using a wrapper struct.
-		// Assuming direct update for IsActive for now.
-		existingUser.IsActive = updatedUserData.IsActive
-
-		// TrafficUsedBytes is usually updated internally, not by client, but allow if needed.
-		// For this example, let's assume it can be reset or adjusted via API.
-		if updatedUserData.TrafficUsedBytes >= 0 { // Allow reset to 0
-			existingUser.TrafficUsedBytes = updatedUserData.TrafficUsedBytes
-		}
-
-
-		currentUsersConfig[userID] = existingUser
-
-		configToSave := make(UsersConfig)
-		for k, v := range currentUsersConfig {
-			configToSave[k] = v
-		}
-		configMutex.Unlock() // Unlock before I/O
-
-		if err := saveUsersConfig(gcsBucket, gcsObject, configToSave); err != nil {
-			log.Printf("ERROR: Failed to save user config to GCS during update: %v", err)
-			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save configuration: " + err.Error()})
-			return
+// deleteUser removes the user from the store and from the running V2Ray.
+func deleteUser(ctx context.Context, store UserStore, userID string) error {
+	var deletedUser User
+	err := persistUsers(ctx, store, func(users UsersConfig) error {
+		storedUser, ok := users[userID]
+		if !ok || !userVisibleTo(ctx, storedUser) {
+			return ErrUserNotFound
 		}
+		deletedUser = storedUser
+		delete(users, userID)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to delete user from %s: %v", store.Describe(), err)
+		// The in-memory config is only changed once the store accepted the write,
+		// so on failure the running V2Ray is left untouched.
+		return err
+	}
+	recordAudit(ctx, "user.delete", userID, deletedUser, nil)
 
-		if err := handleRestartV2Ray(v2rayPort); err != nil {
-			log.Printf("ERROR: Failed to restart V2Ray after updating user: %v", err)
-			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to restart V2Ray: " + err.Error()})
-			return
-		}
-		writeJSONResponse(w, http.StatusOK, existingUser)
+	if err := syncV2RayUser(&deletedUser, nil); err != nil {
+		log.Printf("ERROR: Failed to remove deleted user from V2Ray: %v", err)
+		return fmt.Errorf("%w: %v", errApplyToV2Ray, err)
 	}
+	return nil
 }
 
-func deleteUserHandler(gcsBucket, gcsObject, v2rayPort string) http.HandlerFunc {
+func deleteUserHandler(store UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := r.URL.Query().Get("id")
+		userID := userIDFromRequest(r)
 		if userID == "" {
 			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required in query parameters"})
 			return
 		}
 
-		configMutex.Lock()
-		_, exists := currentUsersConfig[userID]
-		if !exists {
-			configMutex.Unlock()
-			writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User not found"})
-			return
-		}
-
-		delete(currentUsersConfig, userID)
-
-		configToSave := make(UsersConfig)
-		for k, v := range currentUsersConfig {
-			configToSave[k] = v
-		}
-		configMutex.Unlock() // Unlock before I/O
-
-		if err := saveUsersConfig(gcsBucket, gcsObject, configToSave); err != nil {
-			log.Printf("ERROR: Failed to save user config to GCS after deleting user: %v", err)
-			// If saving fails, the user is deleted in memory but not in GCS.
-			// This leads to inconsistency. Consider how to handle this.
-			// For now, we'll log the error and proceed with V2Ray restart based on in-memory state.
-			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save configuration: " + err.Error()})
-			return
-		}
-
-		if err := handleRestartV2Ray(v2rayPort); err != nil {
-			log.Printf("ERROR: Failed to restart V2Ray after deleting user: %v", err)
-			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to restart V2Ray: " + err.Error()})
+		if err := deleteUser(r.Context(), store, userID); err != nil {
+			writeStoreError(w, err)
 			return
 		}
 		writeJSONResponse(w, http.StatusNoContent, nil)
@@ -677,67 +643,105 @@ func deleteUserHandler(gcsBucket, gcsObject, v2rayPort string) http.HandlerFunc
 }
 
 func main() {
-	// Initialize admin credentials and JWT secret key first
-	adminUsername = os.Getenv("ADMIN_USERNAME")
-	if adminUsername == "" {
-		adminUsername = "admin"
-		log.Println("ADMIN_USERNAME not set, using default 'admin'")
+	// Initialize the JWT signing keys first
+	keyring, err := loadJWTKeyring()
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	jwtKeys = keyring
+
+	listenPort := os.Getenv("PORT")               // PORT is the single public port (provided by Cloud Run)
+	v2rayPort := os.Getenv("V2RAY_INTERNAL_PORT") // First loopback port of the inbounds behind the proxy
+
+	if listenPort == "" {
+		listenPort = defaultListenPort
+		log.Printf("PORT environment variable not set, using default %s", listenPort)
+	}
+	if v2rayPort == "" {
+		v2rayPort = defaultV2RayInternal
+	}
+	if v2rayPort == listenPort {
+		log.Fatalf("V2RAY_INTERNAL_PORT must differ from PORT (%s)", listenPort)
 	}
-	adminPassword = os.Getenv("ADMIN_PASSWORD")
-	if adminPassword == "" {
-		adminPassword = "password" // In a real scenario, use a strong, non-default password
-		log.Println("ADMIN_PASSWORD not set, using default 'password'. THIS IS INSECURE.")
+	// User-facing inbounds from V2RAY_INBOUNDS (a VLESS one by default)
+	inbounds, err := configureInbounds(v2rayPort, listenPort)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
 	}
-	jwtSecretKeyStr := os.Getenv("JWT_SECRET_KEY")
-	if jwtSecretKeyStr == "" {
-		log.Fatal("FATAL: JWT_SECRET_KEY environment variable must be set.")
+	v2rayInbounds = inbounds
+
+	// Open the user store selected by USER_STORE (GCS by default)
+	store, err := newUserStoreFromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to open user store: %v", err)
 	}
-	jwtSecretKey = []byte(jwtSecretKeyStr)
+	defer store.Close()
 
-	gcsBucketName := os.Getenv("GCS_BUCKET_NAME")
-	gcsObjectName := os.Getenv("GCS_OBJECT_NAME")
-	v2rayPort := os.Getenv("PORT") // PORT is for V2Ray service itself
+	configureLoginGuard(store)
+	startAuditWriter(store)
 
-	if gcsBucketName == "" || gcsObjectName == "" {
-		log.Fatal("GCS_BUCKET_NAME and GCS_OBJECT_NAME environment variables must be set")
+	// Optional SSO through an OpenID Connect provider (OIDC_ISSUER_URL)
+	sso, err := oidcProviderFromEnv()
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
 	}
-	if v2rayPort == "" {
-		v2rayPort = "8080" // Default V2Ray port
-		log.Printf("PORT environment variable for V2Ray not set, using default %s", v2rayPort)
+	oidcSSO = sso
+
+	// The first owner is created from ADMIN_USERNAME/ADMIN_PASSWORD
+	if err := ensureOwnerAdmin(context.Background(), store); err != nil {
+		log.Fatalf("Failed to initialize admins: %v", err)
 	}
 
 	// Load initial users config
-	log.Printf("Loading initial users config from gs://%s/%s", gcsBucketName, gcsObjectName)
-	loadedUsers, err := loadUsersConfig(gcsBucketName, gcsObjectName)
+	log.Printf("Loading initial users config from %s", store.Describe())
+	loadedUsers, err := store.Load(context.Background())
 	if err != nil {
 		log.Fatalf("Failed to load initial users config: %v", err)
 	}
 	currentUsersConfig = loadedUsers // Assign to global
 	log.Printf("Loaded %d users initially.", len(currentUsersConfig))
+	if err := ensureSubscriptionTokens(context.Background(), store); err != nil {
+		log.Fatalf("Failed to generate subscription tokens: %v", err)
+	}
+	if err := ensureUserStatuses(context.Background(), store); err != nil {
+		log.Fatalf("Failed to infer user statuses: %v", err)
+	}
+	if err := ensureExpiryDates(context.Background(), store); err != nil {
+		log.Fatalf("Failed to convert time limits to expiry dates: %v", err)
+	}
+	if err := ensureEmailTags(context.Background(), store); err != nil {
+		log.Fatalf("Failed to record V2Ray email tags: %v", err)
+	}
+	if err := ensureProxyCredentials(context.Background(), store); err != nil {
+		log.Fatalf("Failed to generate Trojan and Shadowsocks credentials: %v", err)
+	}
 
 	// Initial V2Ray start
+	v2raySupervisor = NewV2RaySupervisor(v2rayInbounds, flushTrafficBeforeStop(store))
 	go func() {
 		log.Println("Starting initial V2Ray process...")
-		if err := handleRestartV2Ray(v2rayPort); err != nil {
+		if err := handleRestartV2Ray(); err != nil {
 			log.Fatalf("FATAL: Failed to start initial V2Ray process: %v", err)
 		}
 	}()
 
 	// Setup HTTP API server
-	apiPort := os.Getenv("API_PORT")
-	if apiPort == "" {
-		apiPort = "8000" // Default API port
-		log.Printf("API_PORT environment variable not set, using default %s", apiPort)
-	}
-
 	// Using standard http.ServeMux
 	mux := http.NewServeMux()
 
 	// --- Public routes ---
-	mux.HandleFunc("/api/auth/login", loginHandler)
+	mux.HandleFunc("/api/auth/login", loginHandler(store))
+	mux.HandleFunc("/api/auth/refresh", refreshHandler(store))
+	mux.Handle("POST /api/auth/logout", jwtAuthMiddleware(store, requireSession(logoutHandler(store))))
+	registerOIDCRoutes(mux, store)
+	mux.HandleFunc("/sub/", subscriptionHandler) // Protected by the per-user token in the path
 
 	// --- Protected User Management API routes ---
-	// Wrap existing handlers with method dispatching and JWT auth
+	// Wrap existing handlers with method dispatching, JWT auth and the
+	// permissions of the admin's role: read for GET, write for the rest
+	protect := func(read, write Permission, handler http.Handler) http.Handler {
+		return jwtAuthMiddleware(store, requireReadWrite(read, write, handler))
+	}
 
 	// Handler for /api/users
 	usersAPIHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -745,37 +749,54 @@ func main() {
 		case http.MethodGet:
 			getUsersHandler(w, r)
 		case http.MethodPost:
-			createUserHandler(gcsBucketName, gcsObjectName, v2rayPort)(w, r)
+			createUserHandler(store)(w, r)
 		default:
 			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed for /api/users"})
 		}
 	})
-	mux.Handle("/api/users", jwtAuthMiddleware(usersAPIHandler))
+	mux.Handle("/api/users", protect(PermUsersRead, PermUsersWrite, usersAPIHandler))
 
 	// Handler for /api/user (e.g., /api/user?id=...)
 	userAPIHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			getUserHandler(w, r)
-		case http.MethodPut:
-			updateUserHandler(gcsBucketName, gcsObjectName, v2rayPort)(w, r)
+		case http.MethodPut, http.MethodPatch:
+			modifyUserHandler(store)(w, r)
 		case http.MethodDelete:
-			deleteUserHandler(gcsBucketName, gcsObjectName, v2rayPort)(w, r)
+			deleteUserHandler(store)(w, r)
 		default:
 			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed for /api/user"})
 		}
 	})
-	mux.Handle("/api/user", jwtAuthMiddleware(userAPIHandler))
+	mux.Handle("/api/user", protect(PermUsersRead, PermUsersWrite, userAPIHandler))
+	// Same operations addressed by path: /api/users/{id}
+	mux.Handle("/api/users/", protect(PermUsersRead, PermUsersWrite, userAPIHandler))
+
+	// Handler for /api/user/subscription?id=... (rotates the subscription token)
+	mux.Handle("/api/user/subscription", protect(PermUsersWrite, PermUsersWrite, rotateSubscriptionTokenHandler(store)))
+	// Handler for /api/user/expiry?id=... (extend, set or remove the time limit)
+	mux.Handle("/api/user/expiry", protect(PermUsersWrite, PermUsersWrite, userExpiryHandler(store)))
+	// Share links and QR codes built from the running inbound configuration
+	mux.Handle("/api/user/links", protect(PermUsersRead, PermUsersRead, http.HandlerFunc(userLinksHandler)))
+	mux.Handle("/api/user/qr", protect(PermUsersRead, PermUsersRead, http.HandlerFunc(userQRHandler)))
+
+	// Handler for /api/audit (who changed what, see audit.go)
+	mux.Handle("/api/audit", protect(PermAdminsManage, PermAdminsManage, auditLogHandler(store)))
+
+	// Handler for /api/v2ray/status (state of the supervised V2Ray process)
+	mux.Handle("/api/v2ray/status", protect(PermStatsRead, PermStatsRead, http.HandlerFunc(v2rayStatusHandler)))
+
+	// RESTful v2 user API: /api/v2/users[/{id}[/expiry]]
+	registerAPIV2Routes(mux, store)
+	// Admin accounts: /api/v2/admins[/{username}] and /api/v2/me
+	registerAdminRoutes(mux, store)
+	registerTwoFactorRoutes(mux, store)
+	registerAPIKeyRoutes(mux, store)
 
-	log.Printf("Starting API server on port %s", apiPort)
 	// The http.Server is started further down, after initializing traffic monitoring.
-	// This is a bit mixed up, let's ensure ListenAndServe is called once.
-	// The previous structure had ListenAndServe then traffic monitoring init.
-	// For clarity, server setup should be together.
-
-	// Define V2Ray gRPC API address and traffic check interval
-	v2rayGrpcApiAddress := "127.0.0.1:10085" // As configured in generateV2RayConfig
 
+	// Define traffic check interval
 	trafficCheckIntervalStr := os.Getenv("TRAFFIC_CHECK_INTERVAL_SECONDS")
 	trafficCheckInterval := 5 * time.Minute // Default
 	if secs, err := time.ParseDuration(trafficCheckIntervalStr + "s"); err == nil && secs > 0 {
@@ -785,9 +806,8 @@ func main() {
 		log.Printf("WARN: Invalid TRAFFIC_CHECK_INTERVAL_SECONDS value '%s', using default %s", trafficCheckIntervalStr, trafficCheckInterval)
 	}
 
-
 	// Start traffic monitoring loop
-	go startTrafficMonitoringLoop(v2rayGrpcApiAddress, trafficCheckInterval, gcsBucketName, gcsObjectName, v2rayPort)
+	go startTrafficMonitoringLoop(v2rayGrpcAPIAddress, trafficCheckInterval, store)
 
 	// --- Serve Static UI Files ---
 	uiStaticDir := "/app/ui_static_files" // Path where UI files are copied in Dockerfile
@@ -822,47 +842,54 @@ func main() {
 			// ServeMux handles this by default if no other pattern matches.
 			// However, if /api/ was not handled by a sub-router or more specific patterns,
 			// this could inadvertently catch /api requests. But current setup is fine.
-			http.NotFound(w,r)
+			http.NotFound(w, r)
 		}
 	})
 
+	// Requests on the V2Ray transport paths are proxied to the loopback inbounds,
+	// so the proxy, the API and the UI all share the single public port.
+	var proxyRoutes []proxyRoute
+	for _, inbound := range v2rayInbounds {
+		if inbound.proxied() {
+			backend := fmt.Sprintf("%s:%d", v2rayInternalListen, inbound.Port)
+			proxyRoutes = append(proxyRoutes, proxyRoute{path: inbound.Path, handler: newV2RayReverseProxy(backend)})
+		}
+	}
+
 	// Start the HTTP server (this will be the final blocking call in main)
-	log.Printf("API server and UI listening on :%s", apiPort)
-	if err := http.ListenAndServe(":"+apiPort, mux); err != nil {
+	log.Printf("API server, UI and V2Ray proxy (%d inbound path(s)) listening on :%s", len(proxyRoutes), listenPort)
+	if err := http.ListenAndServe(":"+listenPort, newFrontHandler(mux, proxyRoutes)); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
 // generateV2RayConfig creates a V2Ray JSON configuration.
-func generateV2RayConfig(users UsersConfig, port string) ([]byte, error) {
-	v2rayClients := []Client{}
-	const userLevel = 0 // Define user level for policy
+func generateV2RayConfig(users UsersConfig, inbounds []InboundDefinition) ([]byte, error) {
+	activeUsers := []User{}
+	const userLevel = v2rayUserLevel // Define user level for policy
 
-	activeUsers := 0
 	for _, user := range users {
+		// IsActive covers on-hold users too: they must be able to connect,
+		// since their first traffic is what starts their time limit.
 		if user.IsActive {
-			v2rayClients = append(v2rayClients, Client{
-				ID:      user.ID,
-				// AlterID: 0, // Not used by VLESS
-				Email:   "user_" + user.ID, // Tag for stats: "user_UUID"
-				Level:   userLevel,
-			})
-			activeUsers++
+			activeUsers = append(activeUsers, user)
 		}
 	}
 
-	if activeUsers == 0 {
+	if len(activeUsers) == 0 {
 		log.Println("No active users found in config. Generating a default user for V2Ray.")
-		defaultUserID := uuid.NewString()
-		v2rayClients = append(v2rayClients, Client{
-			ID:      defaultUserID,
-			// AlterID: 0, // Not used by VLESS
-			Email:   "user_" + defaultUserID, // Consistent email format for stats
-			Level:   userLevel, // Use the defined userLevel
-		})
-		log.Printf("Default VLESS user ID: %s, Email for stats: user_%s", defaultUserID, defaultUserID)
+		defaultUser := User{ID: uuid.NewString()} // Tagged "user_"+ID for stats, see userStatsTag
+		assignProxyCredentials(&defaultUser)
+		activeUsers = append(activeUsers, defaultUser)
+		log.Printf("Default user ID: %s, Email for stats: user_%s", defaultUser.ID, defaultUser.ID)
 	} else {
-		log.Printf("Using %d active user(s) for V2Ray config.", len(v2rayClients))
+		log.Printf("Using %d active user(s) for V2Ray config.", len(activeUsers))
+	}
+
+	// Every user is a client of every user-facing inbound, see inbounds.go
+	proxyInbounds := make([]Inbound, 0, len(inbounds)+1)
+	for _, inbound := range inbounds {
+		proxyInbounds = append(proxyInbounds, inbound.v2rayInbound(activeUsers))
 	}
 
 	apiTag := "API" // Tag for API inbound and routing
@@ -875,7 +902,7 @@ func generateV2RayConfig(users UsersConfig, port string) ([]byte, error) {
 		},
 		API: &APIConfig{
 			Tag:      apiTag,
-			Services: []string{"StatsService"}, // Enable StatsService
+			Services: []string{"HandlerService", "StatsService"}, // HandlerService for hot user changes, StatsService for traffic
 		},
 		Policy: &PolicyConfig{
 			Levels: map[string]LevelPolicy{
@@ -900,26 +927,10 @@ func generateV2RayConfig(users UsersConfig, port string) ([]byte, error) {
 				// Potentially other rules, e.g., for blocking ads or specific sites
 			},
 		},
-		Inbounds: []Inbound{
-			{
-				Port:     port,
-				Protocol: "vless", // Changed from vmess to vless
-				Settings: InboundSettings{
-					Clients:    v2rayClients,
-					Decryption: "none", // Required for VLESS
-				},
-				StreamSettings: StreamSettings{
-					Network:  "ws",
-					Security: "none", // TLS is typically handled by Cloud Run or a reverse proxy
-					WSSettings: WebSocketSettings{
-						Path: "/v2ray", // Changed WebSocket path for VLESS
-					},
-				},
-				Tag: "vless-in", // Main inbound for user traffic
-			},
-			{ // Inbound for V2Ray API
-				Port:     "10085", // Local port for API
-				Listen:   "127.0.0.1",  // Listen on localhost only
+		Inbounds: append(proxyInbounds,
+			Inbound{ // Inbound for V2Ray API
+				Port:     "10085",     // Local port for API
+				Listen:   "127.0.0.1", // Listen on localhost only
 				Protocol: "dokodemo-door",
 				Settings: InboundSettings{ // Basic settings for dokodemo-door
 					// Address should ideally be the API's intended listening address if it were external,
@@ -929,7 +940,7 @@ func generateV2RayConfig(users UsersConfig, port string) ([]byte, error) {
 				},
 				Tag: apiTag, // Tag this inbound as "API"
 			},
-		},
+		),
 		Outbounds: []Outbound{
 			{
 				Protocol: "freedom",
@@ -937,9 +948,9 @@ func generateV2RayConfig(users UsersConfig, port string) ([]byte, error) {
 				Tag:      "direct-out", // Default outbound
 			},
 			{ // Outbound for API routing rule
-				Protocol: "blackhole", // Can be blackhole as it's handled by API service
+				Protocol: "blackhole",        // Can be blackhole as it's handled by API service
 				Settings: OutboundSettings{}, // Empty settings for blackhole
-				Tag:      apiTag,       // Must match outboundTag in API routing rule
+				Tag:      apiTag,             // Must match outboundTag in API routing rule
 			},
 		},
 	}
@@ -954,83 +965,15 @@ func generateV2RayConfig(users UsersConfig, port string) ([]byte, error) {
 
 // handleRestartV2Ray stops the current V2Ray process (if any) and starts a new one.
 // It assumes configMutex is NOT held by the caller, as it will acquire it.
-func handleRestartV2Ray(port string) error {
-	v2rayRestartMutex.Lock() // Serialize V2Ray restarts
-	defer v2rayRestartMutex.Unlock()
-
-	// Stop existing V2Ray process
-	if v2rayCmd != nil && v2rayCmd.Process != nil {
-		log.Println("Stopping existing V2Ray process...")
-		if err := v2rayCmd.Process.Signal(os.Interrupt); err != nil {
-			log.Printf("Failed to send interrupt signal to V2Ray process: %v. Attempting to kill.", err)
-			if killErr := v2rayCmd.Process.Kill(); killErr != nil {
-				log.Printf("Failed to kill V2Ray process: %v", killErr)
-				// Continue, as we might still be ableto start a new one if the old one is defunct
-			}
-		}
-		// Wait for a short period to allow the process to exit gracefully
-		// This part can be tricky. A proper solution might involve a channel or cmd.Wait() in a goroutine.
-		// For now, a small sleep, but this is not robust.
-		// On second thought, cmd.Wait() is called in a goroutine below for the new process.
-		// For the old process, we've sent a signal. If it doesn't die, the new one might fail to bind port.
-		// This needs careful handling in a production system.
-		// Let's assume Signal/Kill is usually effective.
-		log.Println("Sent stop signal to V2Ray process.")
-		// We'll rely on the OS to clean up if the process didn't exit immediately.
-		// Or the new process might fail if the port is still in use.
-	}
-
-	configMutex.RLock()
-	usersToConfigure := make(UsersConfig) // Create a deep copy for thread safety
-	for k, v := range currentUsersConfig {
-		usersToConfigure[k] = v
-	}
-	configMutex.RUnlock()
-
-	log.Println("Generating new V2Ray config for restart...")
-	v2rayConfigBytes, err := generateV2RayConfig(usersToConfigure, port)
-	if err != nil {
-		return fmt.Errorf("failed to generate V2Ray config for restart: %v", err)
-	}
-
-	v2rayConfigPath := "/tmp/v2ray_config.json" // Same path as used in main
-	if err := ioutil.WriteFile(v2rayConfigPath, v2rayConfigBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write V2Ray config to %s for restart: %v", v2rayConfigPath, err)
-	}
-	log.Printf("New V2Ray config written to %s for restart", v2rayConfigPath)
-
-	log.Println("Starting new V2Ray process...")
-	newCmd := exec.Command("v2ray", "-config", v2rayConfigPath)
-	newCmd.Stdout = log.Output()
-	newCmd.Stderr = log.Output()
+func handleRestartV2Ray() error {
+	return v2raySupervisor.Restart()
+}
 
-	if err := newCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start new V2Ray process: %v", err)
+// v2rayStatusHandler reports the state of the supervised V2Ray process.
+func v2rayStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only GET method is allowed"})
+		return
 	}
-	v2rayCmd = newCmd // Store the new command
-	log.Printf("New V2Ray process started with PID: %d", v2rayCmd.Process.Pid)
-
-	// Goroutine to wait for the command to complete and log its exit
-	go func() {
-		if v2rayCmd == nil || v2rayCmd.Process == nil {
-			log.Println("V2Ray command or process is nil in Wait goroutine, cannot Wait.")
-			return
-		}
-		processState, err := v2rayCmd.Process.Wait()
-		pid := -1
-		if processState != nil { // processState can be nil if Start() failed but Process was set
-			pid = processState.Pid()
-		} else if v2rayCmd.Process != nil { // Fallback to process if state is nil
-		    pid = v2rayCmd.Process.Pid
-		}
-
-
-		if err != nil {
-			log.Printf("V2Ray process (PID: %d) finished with error: %v. Status: %s", pid, err, processState)
-		} else {
-			log.Printf("V2Ray process (PID: %d) finished successfully. Status: %s", pid, processState)
-		}
-	}()
-
-	return nil
+	writeJSONResponse(w, http.StatusOK, v2raySupervisor.Status())
 }
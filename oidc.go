@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Admins can log in through an OpenID Connect provider (authorization code
+// flow with PKCE). The provider is found by discovery from OIDC_ISSUER_URL
+// and ID tokens are verified against its JWKS. OIDC_ROLE_RULES maps the
+// verified email, email domain or groups to a role; the first matching rule
+// wins, and without a match the login is refused. Every SSO identity gets an
+// admin entry of its own (without a password), whose role follows the rules
+// on every login, and the login ends in the same session as a password login.
+
+const (
+	oidcStateCookie      = "gcvp_oidc"
+	oidcStateTTL         = 10 * time.Minute
+	oidcStateType        = "oidc_state"
+	oidcKeysRefetchAfter = time.Minute // Unknown kids trigger a JWKS refetch at most this often
+	oidcCallbackPath     = "/api/auth/oidc/callback"
+	oidcPanelLoginPath   = "/ui/login" // Receives the tokens or the error in the URL fragment
+)
+
+// oidcRoleRule maps an identity to a role: kind is "email", "domain" or "group".
+type oidcRoleRule struct {
+	kind  string
+	value string
+	role  AdminRole
+}
+
+// parseOIDCRoleRules parses OIDC_ROLE_RULES, e.g.
+// "group:vpn-admins=owner,domain:example.com=viewer".
+func parseOIDCRoleRules(spec string) ([]oidcRoleRule, error) {
+	var rules []oidcRoleRule
+	for i, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		match, role, ok := strings.Cut(entry, "=")
+		kind, value, ok2 := strings.Cut(match, ":")
+		if !ok || !ok2 || value == "" {
+			return nil, fmt.Errorf("OIDC_ROLE_RULES entry %d: expected <email|domain|group>:<value>=<role>", i+1)
+		}
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		if kind != "email" && kind != "domain" && kind != "group" {
+			return nil, fmt.Errorf("OIDC_ROLE_RULES entry %d: unknown kind %q, expected email, domain or group", i+1, kind)
+		}
+		rule := oidcRoleRule{kind: kind, value: strings.TrimSpace(value), role: AdminRole(strings.TrimSpace(role))}
+		if rule.role != AdminRoleOwner && rule.role != AdminRoleOperator && rule.role != AdminRoleViewer {
+			// Resellers need a budget, which an SSO login cannot provide
+			return nil, fmt.Errorf("OIDC_ROLE_RULES entry %d: role must be owner, operator or viewer", i+1)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// oidcIdentity is what a verified ID token says about the admin.
+type oidcIdentity struct {
+	Subject string // Issuer and subject, unique across providers
+	Email   string
+	Groups  []string
+}
+
+func (id oidcIdentity) role(rules []oidcRoleRule) (AdminRole, bool) {
+	_, domain, _ := strings.Cut(id.Email, "@")
+	for _, rule := range rules {
+		switch rule.kind {
+		case "email":
+			if id.Email != "" && strings.EqualFold(id.Email, rule.value) {
+				return rule.role, true
+			}
+		case "domain":
+			if domain != "" && strings.EqualFold(domain, rule.value) {
+				return rule.role, true
+			}
+		case "group":
+			for _, group := range id.Groups {
+				if group == rule.value {
+					return rule.role, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// oidcDiscovery is the part of the provider metadata the login flow needs.
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// jsonWebKey is an RSA or EC public key of the provider's JWKS.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: n: %v", k.Kid, err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("key %s: invalid e", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("key %s: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: x: %v", k.Kid, err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: y: %v", k.Kid, err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported key type %q", k.Kid, k.Kty)
+}
+
+// oidcProvider is the configured identity provider. Its metadata and keys
+// are fetched on first use and cached.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string // Empty for public clients, which rely on PKCE alone
+	redirectURL  string // Empty to derive it from the request
+	scopes       []string
+	groupsClaim  string
+	rules        []oidcRoleRule
+	client       *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{} // By kid
+	keysFetchedAt time.Time
+}
+
+var oidcSSO *oidcProvider // nil unless OIDC_ISSUER_URL is set
+
+// oidcProviderFromEnv configures SSO from the OIDC_* variables. It returns
+// nil if OIDC_ISSUER_URL is not set.
+func oidcProviderFromEnv() (*oidcProvider, error) {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER_URL"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	p := &oidcProvider{
+		issuer:       issuer,
+		clientID:     os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		groupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if p.clientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID must be set with OIDC_ISSUER_URL")
+	}
+	if len(p.scopes) == 0 {
+		p.scopes = []string{"openid", "email", "profile"}
+	}
+	if p.groupsClaim == "" {
+		p.groupsClaim = "groups"
+	}
+	rules, err := parseOIDCRoleRules(os.Getenv("OIDC_ROLE_RULES"))
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		log.Println("WARN: OIDC_ROLE_RULES is empty, nobody can log in with SSO")
+	}
+	p.rules = rules
+	log.Printf("SSO enabled with OpenID provider %s (%d role rule(s))", issuer, len(rules))
+	return p, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	return nil
+}
+
+// metadata returns the provider metadata, discovering it on first use.
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %v", err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match OIDC_ISSUER_URL %q", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: authorization_endpoint, token_endpoint and jwks_uri are required")
+	}
+	if len(d.CodeChallengeMethods) > 0 {
+		s256 := false
+		for _, method := range d.CodeChallengeMethods {
+			s256 = s256 || method == "S256"
+		}
+		if !s256 {
+			return nil, errors.New("OIDC discovery: the provider does not support PKCE with S256")
+		}
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the provider key kid, refetching the JWKS if the kid is
+// unknown, since providers rotate their keys.
+func (p *oidcProvider) key(ctx context.Context, d *oidcDiscovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lookup := func() (interface{}, bool) {
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key, true
+			}
+		}
+		key, ok := p.keys[kid]
+		return key, ok
+	}
+	if key, ok := lookup(); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeysRefetchAfter {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("OIDC JWKS: %v", err)
+	}
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("WARN: Skipping OIDC key: %v", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys, p.keysFetchedAt = keys, time.Now()
+	if key, ok := lookup(); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// callbackURL is the redirect_uri registered with the provider.
+func (p *oidcProvider) callbackURL(r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	return publicEndpointFromRequest(r).baseURL() + oidcCallbackPath
+}
+
+// exchangeCode redeems the authorization code for the ID token.
+func (p *oidcProvider) exchangeCode(ctx context.Context, d *oidcDiscovery, code, verifier, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response (%s): %v", resp.Status, err)
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("token request: %s: %s", body.Error, body.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token request: %s without id_token", resp.Status)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry
+// and nonce, and returns the identity it asserts.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, idToken, nonce string) (oidcIdentity, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, d, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return oidcIdentity{}, fmt.Errorf("ID token: %v", err)
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return oidcIdentity{}, errors.New("ID token: nonce mismatch")
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.clientID {
+			return oidcIdentity{}, errors.New("ID token: azp does not name this client")
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return oidcIdentity{}, errors.New("ID token: sub is missing")
+	}
+
+	id := oidcIdentity{Subject: d.Issuer + "|" + subject}
+	// Rules grant roles by email, so only an email the provider vouches for
+	// counts; some providers let users set any address and omit the claim.
+	if email, _ := claims["email"].(string); email != "" {
+		if verified, _ := claims["email_verified"].(bool); verified {
+			id.Email = strings.ToLower(email)
+		}
+	}
+	switch groups := claims[p.groupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if s, ok := group.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// oidcState is what the login request hands to the callback, in a signed cookie.
+type oidcState struct {
+	State    string
+	Nonce    string
+	Verifier string // PKCE code_verifier
+}
+
+func randomURLToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("crypto/rand: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func newOIDCState() (oidcState, error) {
+	var s oidcState
+	var err error
+	if s.State, err = randomURLToken(); err != nil {
+		return s, err
+	}
+	if s.Nonce, err = randomURLToken(); err != nil {
+		return s, err
+	}
+	s.Verifier, err = randomURLToken()
+	return s, err
+}
+
+// oidcSSOStatusHandler serves GET /api/auth/oidc, telling the panel whether
+// to offer SSO.
+func oidcSSOStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcSSO == nil {
+		writeJSONResponse(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"enabled": true, "login_url": "/api/auth/oidc/login"})
+}
+
+// oidcLoginHandler serves GET /api/auth/oidc/login: it redirects the browser
+// to the provider, remembering state, nonce and PKCE verifier in a cookie.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcSSO == nil {
+		writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "SSO is not configured"})
+		return
+	}
+	d, err := oidcSSO.metadata(r.Context())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeJSONResponse(w, http.StatusBadGateway, map[string]string{"error": "Identity provider is unavailable"})
+		return
+	}
+	state, err := newOIDCState()
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to start SSO login"})
+		return
+	}
+	cookie, err := jwtKeys.sign(jwt.MapClaims{
+		"typ":      oidcStateType,
+		"state":    state.State,
+		"nonce":    state.Nonce,
+		"verifier": state.Verifier,
+		"exp":      time.Now().Add(oidcStateTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to start SSO login"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    cookie,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   publicEndpointFromRequest(r).TLS,
+		SameSite: http.SameSiteLaxMode, // Sent along with the provider's redirect back
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcSSO.clientID},
+		"redirect_uri":          {oidcSSO.callbackURL(r)},
+		"scope":                 {strings.Join(oidcSSO.scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// readOIDCState verifies the state cookie of the callback request.
+func readOIDCState(r *http.Request) (oidcState, error) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return oidcState{}, errors.New("state cookie is missing; start the login again")
+	}
+	token, err := jwtKeys.parse(cookie.Value)
+	if err != nil {
+		return oidcState{}, fmt.Errorf("state cookie: %v", err)
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	var s oidcState
+	typ, _ := claims["typ"].(string)
+	s.State, _ = claims["state"].(string)
+	s.Nonce, _ = claims["nonce"].(string)
+	s.Verifier, _ = claims["verifier"].(string)
+	if typ != oidcStateType || s.State == "" || s.Nonce == "" || s.Verifier == "" {
+		return oidcState{}, errors.New("state cookie: invalid claims")
+	}
+	return s, nil
+}
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// oidcUsername picks a free admin username for a new SSO identity, from the
+// local part of the email if there is one.
+func oidcUsername(registry AdminsConfig, id oidcIdentity) string {
+	local, _, _ := strings.Cut(id.Email, "@")
+	base := strings.Trim(usernameInvalidChars.ReplaceAllString(strings.ToLower(local), "-"), "-_.")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	if validateUsername(base) != nil {
+		sum := sha256.Sum256([]byte(id.Subject))
+		base = "sso-" + hex.EncodeToString(sum[:4])
+	}
+	username := base
+	for i := 2; ; i++ {
+		if _, taken := registry[adminKey(username)]; !taken {
+			return username
+		}
+		username = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// upsertOIDCAdmin returns the admin of an SSO identity, creating it on the
+// first login and applying the role the rules give it now.
+func upsertOIDCAdmin(ctx context.Context, store UserStore, id oidcIdentity, role AdminRole, ip string) (Admin, error) {
+	var admin Admin
+	var previous *Admin // nil if the admin was created
+	err := admins.update(ctx, store, func(registry AdminsConfig) error {
+		previous = nil
+		for key, existing := range registry {
+			if existing.OIDCSubject != id.Subject {
+				continue
+			}
+			before := existing
+			previous = &before
+			if existing.Role != role {
+				if existing.Role == AdminRoleOwner && countOwners(registry) == 1 {
+					log.Printf("WARN: SSO rules give the last owner %s role %s; keeping owner", existing.Username, role)
+				} else {
+					log.Printf("INFO: SSO rules changed the role of admin %s from %s to %s", existing.Username, existing.Role, role)
+					existing.Role = role
+				}
+			}
+			existing.Email = id.Email
+			registry[key] = existing
+			admin = existing
+			return nil
+		}
+		admin = Admin{
+			Username:    oidcUsername(registry, id),
+			Role:        role,
+			CreatedAt:   time.Now().UTC(),
+			OIDCSubject: id.Subject,
+			Email:       id.Email,
+		}
+		registry[adminKey(admin.Username)] = admin
+		log.Printf("INFO: Created admin %s with role %s for SSO identity %s", admin.Username, role, id.Email)
+		return nil
+	})
+	if err != nil {
+		return Admin{}, err
+	}
+	event := AuditEvent{Actor: admin.Username, Action: "admin.update", Target: admin.Username, IP: ip, Detail: "SSO login"}
+	if previous == nil {
+		event.Action, event.Changes = "admin.create", auditDiff(nil, admin)
+	} else {
+		event.Changes = auditDiff(*previous, admin)
+	}
+	if previous == nil || event.Changes != nil {
+		recordAuditEvent(event)
+	}
+	return admin, nil
+}
+
+// redirectToPanel ends the SSO flow in the panel's login page, passing the
+// result in the URL fragment, which browsers do not send to servers.
+func redirectToPanel(w http.ResponseWriter, r *http.Request, fragment url.Values) {
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc/", MaxAge: -1})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, oidcPanelLoginPath+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// oidcCallbackHandler serves GET /api/auth/oidc/callback, where the provider
+// sends the browser back with the authorization code.
+func oidcCallbackHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidcSSO == nil {
+			writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "SSO is not configured"})
+			return
+		}
+		ip := logins.clientIP(r)
+		fail := func(detail, message string) {
+			logSecurityEvent("sso_login_failed", "", ip, detail)
+			redirectToPanel(w, r, url.Values{"sso_error": {message}})
+		}
+
+		query := r.URL.Query()
+		if providerErr := query.Get("error"); providerErr != "" {
+			fail(providerErr+": "+query.Get("error_description"), "The identity provider refused the login")
+			return
+		}
+		state, err := readOIDCState(r)
+		if err != nil {
+			fail(err.Error(), "The login took too long or was started elsewhere; try again")
+			return
+		}
+		if query.Get("state") != state.State {
+			fail("state mismatch", "The login took too long or was started elsewhere; try again")
+			return
+		}
+
+		d, err := oidcSSO.metadata(r.Context())
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			fail(err.Error(), "Identity provider is unavailable")
+			return
+		}
+		idToken, err := oidcSSO.exchangeCode(r.Context(), d, query.Get("code"), state.Verifier, oidcSSO.callbackURL(r))
+		if err != nil {
+			fail(err.Error(), "Failed to complete the login with the identity provider")
+			return
+		}
+		id, err := oidcSSO.verifyIDToken(r.Context(), d, idToken, state.Nonce)
+		if err != nil {
+			fail(err.Error(), "The identity provider's answer could not be verified")
+			return
+		}
+		role, ok := id.role(oidcSSO.rules)
+		if !ok {
+			fail(fmt.Sprintf("no role rule matches %s (groups %v)", id.Email, id.Groups), "Your account is not allowed to use this panel")
+			return
+		}
+
+		admin, err := upsertOIDCAdmin(r.Context(), store, id, role, ip)
+		if err != nil {
+			log.Printf("ERROR: Failed to save SSO admin %s: %v", id.Email, err)
+			fail(err.Error(), "Failed to log in")
+			return
+		}
+		// Unless SSO admins are exempt, the login continues at /api/auth/login/2fa
+		challenge, err := loginChallenge(r.Context(), store, admin)
+		if err != nil {
+			log.Printf("ERROR: Failed to check the second factor of SSO admin %s: %v", admin.Username, err)
+			fail(err.Error(), "Failed to log in")
+			return
+		}
+		if challenge != nil {
+			logSecurityEvent("sso_login_challenged", admin.Username, ip, id.Email)
+			redirectToPanel(w, r, url.Values{
+				"challenge_token":     {challenge.ChallengeToken},
+				"enrollment_required": {strconv.FormatBool(challenge.EnrollmentRequired)},
+				"expires_in":          {fmt.Sprint(challenge.ExpiresIn)},
+			})
+			return
+		}
+		tokens, err := startSession(r, store, admin)
+		if err != nil {
+			log.Printf("ERROR: Failed to start session: %v", err)
+			fail(err.Error(), "Failed to log in")
+			return
+		}
+		logSecurityEvent("sso_login_succeeded", admin.Username, ip, id.Email)
+		redirectToPanel(w, r, url.Values{
+			"token":         {tokens.Token},
+			"refresh_token": {tokens.RefreshToken},
+			"expires_in":    {fmt.Sprint(tokens.ExpiresIn)},
+		})
+	}
+}
+
+// registerOIDCRoutes adds the SSO login routes to mux.
+func registerOIDCRoutes(mux *http.ServeMux, store UserStore) {
+	mux.HandleFunc("GET /api/auth/oidc", oidcSSOStatusHandler)
+	mux.HandleFunc("GET /api/auth/oidc/login", oidcLoginHandler)
+	mux.HandleFunc("GET "+oidcCallbackPath, oidcCallbackHandler(store))
+}
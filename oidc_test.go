@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testOIDCClientID = "panel"
+
+// mockOIDCProvider is an OpenID provider serving discovery, its JWKS and a
+// token endpoint that checks the PKCE verifier of each code.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu         sync.Mutex
+	challenges map[string]string        // code_challenge by authorization code
+	claims     map[string]jwt.MapClaims // Claims of the ID token by authorization code
+	redeemed   int
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDCProvider{key: key, challenges: make(map[string]string), claims: make(map[string]jwt.MapClaims)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, http.StatusOK, oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+			CodeChallengeMethods:  []string{"S256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, http.StatusOK, map[string][]jsonWebKey{"keys": {{
+			Kty: "RSA",
+			Kid: "k1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("client_id") != testOIDCClientID {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		code := r.Form.Get("code")
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		challenge, ok := m.challenges[code]
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		delete(m.challenges, code)
+		m.redeemed++
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, m.claims[code])
+		token.Header["kid"] = "k1"
+		idToken, err := token.SignedString(m.key)
+		if err != nil {
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "server_error", "error_description": err.Error()})
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOIDCProvider) sign(t *testing.T, claims jwt.MapClaims, key *rsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// provider returns an oidcProvider configured for m.
+func (m *mockOIDCProvider) provider(rules []oidcRoleRule) *oidcProvider {
+	return &oidcProvider{
+		issuer:      m.URL,
+		clientID:    testOIDCClientID,
+		redirectURL: "https://panel.example.com" + oidcCallbackPath,
+		scopes:      []string{"openid", "email"},
+		groupsClaim: "groups",
+		rules:       rules,
+		client:      m.Client(),
+	}
+}
+
+// idTokenClaims returns the claims of a valid ID token.
+func (m *mockOIDCProvider) idTokenClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            testOIDCClientID,
+		"sub":            "user-1",
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "Alice@Example.com",
+		"email_verified": true,
+		"groups":         []string{"vpn-users"},
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	p := m.provider(nil)
+	ctx := context.Background()
+	d, err := p.metadata(ctx)
+	if err != nil {
+		t.Fatalf("discovery: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		mutate    func(claims jwt.MapClaims)
+		key       *rsa.PrivateKey
+		wantErr   bool
+		wantEmail string
+	}{
+		{name: "valid", wantEmail: "alice@example.com"},
+		{name: "nonce mismatch", mutate: func(c jwt.MapClaims) { c["nonce"] = "other" }, wantErr: true},
+		{name: "no nonce", mutate: func(c jwt.MapClaims) { delete(c, "nonce") }, wantErr: true},
+		{name: "wrong issuer", mutate: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "wrong audience", mutate: func(c jwt.MapClaims) { c["aud"] = "another-client" }, wantErr: true},
+		{name: "expired", mutate: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, wantErr: true},
+		{name: "expired within the leeway", mutate: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }, wantEmail: "alice@example.com"},
+		{name: "no expiry", mutate: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: true},
+		{name: "no subject", mutate: func(c jwt.MapClaims) { delete(c, "sub") }, wantErr: true},
+		{name: "several audiences without azp", mutate: func(c jwt.MapClaims) { c["aud"] = []string{testOIDCClientID, "another-client"} }, wantErr: true},
+		{name: "several audiences with azp of another client", mutate: func(c jwt.MapClaims) {
+			c["aud"], c["azp"] = []string{testOIDCClientID, "another-client"}, "another-client"
+		}, wantErr: true},
+		{name: "several audiences with azp of this client", mutate: func(c jwt.MapClaims) {
+			c["aud"], c["azp"] = []string{testOIDCClientID, "another-client"}, testOIDCClientID
+		}, wantEmail: "alice@example.com"},
+		{name: "signed by another key", key: otherKey, wantErr: true},
+		{name: "unverified email", mutate: func(c jwt.MapClaims) { c["email_verified"] = false }, wantEmail: ""},
+		{name: "email without email_verified", mutate: func(c jwt.MapClaims) { delete(c, "email_verified") }, wantEmail: ""},
+		{name: "email_verified as a string", mutate: func(c jwt.MapClaims) { c["email_verified"] = "true" }, wantEmail: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := m.idTokenClaims("nonce-1")
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+			key := m.key
+			if tt.key != nil {
+				key = tt.key
+			}
+			id, err := p.verifyIDToken(ctx, d, m.sign(t, claims, key), "nonce-1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if id.Subject != m.URL+"|user-1" || id.Email != tt.wantEmail || len(id.Groups) != 1 || id.Groups[0] != "vpn-users" {
+				t.Errorf("identity %+v, want email %q", id, tt.wantEmail)
+			}
+		})
+	}
+}
+
+// startOIDCLogin runs the login handler and returns the state cookie and the
+// query of the redirect to the provider.
+func startOIDCLogin(t *testing.T) (*http.Cookie, url.Values) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	oidcLoginHandler(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login did not set the state cookie")
+	}
+	return cookie, location.Query()
+}
+
+// finishOIDCLogin runs the callback handler and returns the URL fragment it
+// hands to the panel.
+func finishOIDCLogin(t *testing.T, store UserStore, cookie *http.Cookie, code, state string) url.Values {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, oidcCallbackPath+"?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	oidcCallbackHandler(store)(w, r)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(location, oidcPanelLoginPath+"#") {
+		t.Fatalf("callback: got %d to %q", w.Code, location)
+	}
+	fragment, err := url.ParseQuery(strings.TrimPrefix(location, oidcPanelLoginPath+"#"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragment
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	useTestKeyring(t)
+	store := newTestStore(t)
+	m := newMockOIDCProvider(t)
+	previous := oidcSSO
+	oidcSSO = m.provider([]oidcRoleRule{{kind: "group", value: "vpn-admins", role: AdminRoleOwner}, {kind: "domain", value: "example.com", role: AdminRoleViewer}})
+	t.Cleanup(func() { oidcSSO = previous })
+
+	cookie, query := startOIDCLogin(t)
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != testOIDCClientID || query.Get("redirect_uri") != oidcSSO.redirectURL {
+		t.Fatalf("unexpected authorization request %v", query)
+	}
+	state, err := readOIDCState(&http.Request{Header: http.Header{"Cookie": {cookie.String()}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := sha256.Sum256([]byte(state.Verifier))
+	if query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(verifier[:]) || query.Get("state") != state.State || query.Get("nonce") != state.Nonce {
+		t.Fatal("the authorization request does not match the state cookie")
+	}
+
+	// The provider redirects back with a code bound to the challenge.
+	issue := func(code string, query url.Values) {
+		m.mu.Lock()
+		m.challenges[code] = query.Get("code_challenge")
+		m.claims[code] = m.idTokenClaims(query.Get("nonce"))
+		m.mu.Unlock()
+	}
+
+	issue("code-1", query)
+	if fragment := finishOIDCLogin(t, store, cookie, "code-1", "forged-state"); fragment.Get("sso_error") == "" || fragment.Get("token") != "" {
+		t.Fatalf("state mismatch: got %v", fragment)
+	}
+	if m.redeemed != 0 {
+		t.Fatal("the code was redeemed despite the state mismatch")
+	}
+
+	// The code of this login with the cookie of another one fails PKCE.
+	otherCookie, otherQuery := startOIDCLogin(t)
+	if fragment := finishOIDCLogin(t, store, otherCookie, "code-1", otherQuery.Get("state")); fragment.Get("sso_error") == "" {
+		t.Fatalf("verifier of another login: got %v", fragment)
+	}
+
+	fragment := finishOIDCLogin(t, store, cookie, "code-1", query.Get("state"))
+	if fragment.Get("sso_error") != "" || fragment.Get("token") == "" || fragment.Get("refresh_token") == "" {
+		t.Fatalf("login: got %v", fragment)
+	}
+	admin, ok, err := admins.lookup(context.Background(), store, "alice")
+	if err != nil || !ok {
+		t.Fatalf("SSO admin not created: %v", err)
+	}
+	if admin.Role != AdminRoleViewer || admin.OIDCSubject != m.URL+"|user-1" || admin.Email != "alice@example.com" || admin.PasswordHash != "" {
+		t.Fatalf("SSO admin %+v", admin)
+	}
+
+	// Unless SSO admins are exempt, required 2FA turns the login into a challenge.
+	if _, err := securitySettings.update(context.Background(), store, func(settings *SecuritySettings) error {
+		settings.Require2FA, settings.SSOExempt = true, false
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cookie, query = startOIDCLogin(t)
+	issue("code-3", query)
+	fragment = finishOIDCLogin(t, store, cookie, "code-3", query.Get("state"))
+	if fragment.Get("token") != "" || fragment.Get("enrollment_required") != "true" {
+		t.Fatalf("login with required 2FA: got %v", fragment)
+	}
+	if challenge, err := parseChallengeToken(fragment.Get("challenge_token")); err != nil || challenge.username != "alice" {
+		t.Fatalf("challenge %+v, %v", challenge, err)
+	}
+
+	// Without a matching rule the login is refused.
+	cookie, query = startOIDCLogin(t)
+	issue("code-2", query)
+	m.mu.Lock()
+	m.claims["code-2"]["email"] = "mallory@elsewhere.example"
+	m.mu.Unlock()
+	if fragment := finishOIDCLogin(t, store, cookie, "code-2", query.Get("state")); fragment.Get("sso_error") == "" {
+		t.Fatalf("no matching rule: got %v", fragment)
+	}
+}
+
+func TestOIDCIdentityRole(t *testing.T) {
+	rules, err := parseOIDCRoleRules("group:vpn-admins=owner, email:bob@example.com=operator, domain:Example.com=viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		id   oidcIdentity
+		want AdminRole
+		ok   bool
+	}{
+		{"group", oidcIdentity{Email: "bob@example.com", Groups: []string{"staff", "vpn-admins"}}, AdminRoleOwner, true},
+		{"email", oidcIdentity{Email: "Bob@Example.com"}, AdminRoleOperator, true},
+		{"domain", oidcIdentity{Email: "carol@example.com"}, AdminRoleViewer, true},
+		{"subdomain", oidcIdentity{Email: "carol@mail.example.com"}, "", false},
+		{"group names are case-sensitive", oidcIdentity{Groups: []string{"VPN-Admins"}}, "", false},
+		{"no verified email", oidcIdentity{}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, ok := tt.id.role(rules)
+			if role != tt.want || ok != tt.ok {
+				t.Errorf("role = %q, %v, want %q, %v", role, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUpsertOIDCAdmin(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	addTestAdmin(t, store, Admin{Username: "alice", Role: AdminRoleOperator, PasswordHash: "hash"})
+	alice := oidcIdentity{Subject: "https://idp|1", Email: "alice@example.com"}
+
+	admin, err := upsertOIDCAdmin(ctx, store, alice, AdminRoleOwner, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Username != "alice-2" || admin.Role != AdminRoleOwner || admin.OIDCSubject != alice.Subject {
+		t.Fatalf("created %+v", admin)
+	}
+	// Its only owner is not demoted by the rules.
+	if admin, err = upsertOIDCAdmin(ctx, store, alice, AdminRoleViewer, "192.0.2.1"); err != nil || admin.Role != AdminRoleOwner {
+		t.Fatalf("demoting the last owner: %+v, %v", admin, err)
+	}
+
+	addTestAdmin(t, store, Admin{Username: "root", Role: AdminRoleOwner})
+	alice.Email = "alice@example.org"
+	if admin, err = upsertOIDCAdmin(ctx, store, alice, AdminRoleViewer, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if admin.Username != "alice-2" || admin.Role != AdminRoleViewer || admin.Email != "alice@example.org" {
+		t.Fatalf("updated %+v", admin)
+	}
+
+	// An identity without a usable email gets a name from its subject.
+	anonymous, err := upsertOIDCAdmin(ctx, store, oidcIdentity{Subject: "https://idp|2"}, AdminRoleViewer, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(anonymous.Username, "sso-") || validateUsername(anonymous.Username) != nil {
+		t.Fatalf("username %q", anonymous.Username)
+	}
+
+	data, err := store.LoadDocument(ctx, adminsDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := decodeAdmins(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registry) != 4 {
+		t.Fatalf("%d admins stored, want 4", len(registry))
+	}
+}
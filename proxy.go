@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+const (
+	v2rayWSPath          = "/v2ray"    // WebSocket path of the default VLESS inbound
+	v2rayInternalListen  = "127.0.0.1" // V2Ray inbounds only listen on loopback
+	defaultV2RayInternal = "10086"     // Default first loopback port of the proxied inbounds
+	defaultListenPort    = "8080"      // Default public port when $PORT is not set
+)
+
+// proxyRoute sends requests for an HTTP-based V2Ray transport path to the
+// loopback inbound that serves it.
+type proxyRoute struct {
+	path    string
+	handler http.Handler
+}
+
+// newV2RayReverseProxy returns a reverse proxy to a V2Ray inbound listening on
+// backendAddr. httputil.ReverseProxy handles WebSocket and other Upgrade
+// requests natively; FlushInterval -1 keeps streaming transports unbuffered.
+func newV2RayReverseProxy(backendAddr string) http.Handler {
+	target := &url.URL{Scheme: "http", Host: backendAddr}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("WARN: Proxying %s to V2Ray at %s failed: %v", r.URL.Path, backendAddr, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// matchesPath reports whether requestPath is routePath or lies below it.
+func matchesPath(requestPath, routePath string) bool {
+	routePath = strings.TrimSuffix(routePath, "/")
+	return requestPath == routePath || strings.HasPrefix(requestPath, routePath+"/")
+}
+
+// newFrontHandler builds the handler that owns the public port. Requests on a
+// V2Ray transport path are proxied to V2Ray, everything else (/api, /ui, ...)
+// goes to mux.
+func newFrontHandler(mux http.Handler, routes []proxyRoute) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, route := range routes {
+			if matchesPath(r.URL.Path, route.path) {
+				route.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// TrafficResetStrategy selects when a user's TrafficUsedBytes is zeroed.
+type TrafficResetStrategy string
+
+const (
+	TrafficResetNone               TrafficResetStrategy = "none"                // Lifetime quota (default)
+	TrafficResetDaily              TrafficResetStrategy = "daily"               // Every day at 00:00 UTC
+	TrafficResetWeekly             TrafficResetStrategy = "weekly"              // Every Monday at 00:00 UTC
+	TrafficResetMonthly            TrafficResetStrategy = "monthly"             // On the 1st of every month, 00:00 UTC
+	TrafficResetMonthlyAnniversary TrafficResetStrategy = "monthly_anniversary" // Every month on the day the user was created
+)
+
+// validateTrafficResetStrategy rejects unknown strategies. The empty string
+// means TrafficResetNone.
+func validateTrafficResetStrategy(strategy TrafficResetStrategy) error {
+	switch strategy {
+	case "", TrafficResetNone, TrafficResetDaily, TrafficResetWeekly, TrafficResetMonthly, TrafficResetMonthlyAnniversary:
+		return nil
+	default:
+		return fmt.Errorf("unknown traffic_reset_strategy %q, expected one of: none, daily, weekly, monthly, monthly_anniversary", strategy)
+	}
+}
+
+// orNone maps the empty strategy of users stored before schedules existed
+// to TrafficResetNone.
+func (s TrafficResetStrategy) orNone() TrafficResetStrategy {
+	if s == "" {
+		return TrafficResetNone
+	}
+	return s
+}
+
+// trafficResetPeriodStart returns the start of the reset period containing
+// now, or the zero time if the user's usage is never reset.
+func trafficResetPeriodStart(user User, now time.Time) time.Time {
+	now = now.UTC()
+	year, month, day := now.Date()
+	switch user.TrafficResetStrategy {
+	case TrafficResetDaily:
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	case TrafficResetWeekly:
+		daysSinceMonday := (int(now.Weekday()) + 6) % 7
+		return time.Date(year, month, day-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+	case TrafficResetMonthly:
+		return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	case TrafficResetMonthlyAnniversary:
+		anniversary := monthlyAnniversary(user.CreatedAt, year, month)
+		if anniversary.After(now) {
+			anniversary = monthlyAnniversary(user.CreatedAt, year, month-1)
+		}
+		return anniversary
+	default:
+		return time.Time{}
+	}
+}
+
+// monthlyAnniversary returns the anniversary of createdAt in the given month.
+// Days that do not exist in that month (e.g. the 31st) fall on its last day.
+func monthlyAnniversary(createdAt time.Time, year int, month time.Month) time.Time {
+	createdAt = createdAt.UTC()
+	firstOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	day := createdAt.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(firstOfMonth.Year(), firstOfMonth.Month(), day,
+		createdAt.Hour(), createdAt.Minute(), createdAt.Second(), 0, time.UTC)
+}
+
+// trafficResetDue reports whether a new reset period started since the user's
+// usage was last reset (or since it was created).
+func trafficResetDue(user User, now time.Time) bool {
+	periodStart := trafficResetPeriodStart(user, now)
+	if periodStart.IsZero() {
+		return false
+	}
+	lastReset := user.CreatedAt
+	if user.LastTrafficResetAt != nil {
+		lastReset = *user.LastTrafficResetAt
+	}
+	return periodStart.After(lastReset)
+}
+
+// resetUserTraffic zeroes the user's usage and reactivates the user if it was
+// limited by its traffic quota.
+func resetUserTraffic(user *User, now time.Time) {
+	user.TrafficUsedBytes = 0
+	resetAt := now.UTC()
+	user.LastTrafficResetAt = &resetAt
+
+	reactivateIfWithinLimits(user, now)
+}
+
+// applyTrafficResets resets the usage of every user whose reset period has
+// rolled over. It returns the users that were reactivated so the caller can
+// add them back to the running inbound.
+func applyTrafficResets(ctx context.Context, store UserStore) (reactivatedUsers []User, err error) {
+	now := time.Now().UTC()
+
+	configMutex.RLock()
+	due := 0
+	for _, user := range currentUsersConfig {
+		if trafficResetDue(user, now) {
+			due++
+		}
+	}
+	configMutex.RUnlock()
+	if due == 0 {
+		return nil, nil
+	}
+
+	var resets [][2]User // Before and after, for the audit log
+	err = persistUsers(ctx, store, func(users UsersConfig) error {
+		reactivatedUsers, resets = nil, nil
+		for userID, user := range users {
+			if !trafficResetDue(user, now) {
+				continue
+			}
+			before := user
+			wasActive := user.IsActive
+			resetUserTraffic(&user, now)
+			log.Printf("INFO: Traffic of user %s reset (%s schedule)", userID, user.TrafficResetStrategy)
+			if !wasActive && user.IsActive {
+				log.Printf("INFO: User %s REACTIVATED after traffic reset", userID)
+				reactivatedUsers = append(reactivatedUsers, user)
+			}
+			users[userID] = user
+			resets = append(resets, [2]User{before, user})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save traffic resets to %s: %v", store.Describe(), err)
+	}
+	for _, reset := range resets {
+		recordAudit(ctx, "user.traffic_reset", reset[1].ID, reset[0], reset[1])
+	}
+	return reactivatedUsers, nil
+}
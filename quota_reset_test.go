@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficResetDue(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	ptr := func(value string) *time.Time {
+		parsed := at(value)
+		return &parsed
+	}
+
+	tests := []struct {
+		name      string
+		strategy  TrafficResetStrategy
+		createdAt string
+		lastReset *time.Time
+		now       string
+		want      bool
+	}{
+		{"no strategy", "", "2024-01-01T00:00:00Z", nil, "2025-01-01T00:00:00Z", false},
+		{"none", TrafficResetNone, "2024-01-01T00:00:00Z", nil, "2025-01-01T00:00:00Z", false},
+
+		{"daily, same day", TrafficResetDaily, "2024-03-10T08:00:00Z", nil, "2024-03-10T23:59:59Z", false},
+		{"daily, next day", TrafficResetDaily, "2024-03-10T08:00:00Z", nil, "2024-03-11T00:00:00Z", true},
+		{"daily, reset today", TrafficResetDaily, "2024-03-01T08:00:00Z", ptr("2024-03-11T00:00:05Z"), "2024-03-11T12:00:00Z", false},
+		{"daily, in another time zone", TrafficResetDaily, "2024-03-10T20:00:00Z", nil, "2024-03-11T01:00:00+03:00", false},
+
+		// 2024-03-11 is a Monday.
+		{"weekly, before Monday", TrafficResetWeekly, "2024-03-06T00:00:00Z", nil, "2024-03-10T23:00:00Z", false},
+		{"weekly, Monday", TrafficResetWeekly, "2024-03-06T00:00:00Z", nil, "2024-03-11T00:00:00Z", true},
+		{"weekly, reset this week", TrafficResetWeekly, "2024-03-06T00:00:00Z", ptr("2024-03-11T00:01:00Z"), "2024-03-17T23:00:00Z", false},
+
+		{"monthly, same month", TrafficResetMonthly, "2024-03-05T00:00:00Z", nil, "2024-03-31T23:59:59Z", false},
+		{"monthly, next month", TrafficResetMonthly, "2024-03-05T00:00:00Z", nil, "2024-04-01T00:00:00Z", true},
+		{"monthly, missed months", TrafficResetMonthly, "2024-03-05T00:00:00Z", ptr("2024-04-01T00:00:00Z"), "2024-07-15T00:00:00Z", true},
+
+		{"anniversary, before the day", TrafficResetMonthlyAnniversary, "2024-01-15T10:00:00Z", nil, "2024-02-15T09:59:59Z", false},
+		{"anniversary, on the day", TrafficResetMonthlyAnniversary, "2024-01-15T10:00:00Z", nil, "2024-02-15T10:00:00Z", true},
+		{"anniversary, reset this month", TrafficResetMonthlyAnniversary, "2024-01-15T10:00:00Z", ptr("2024-02-15T10:00:30Z"), "2024-03-14T00:00:00Z", false},
+		{"anniversary of the 31st in February", TrafficResetMonthlyAnniversary, "2024-01-31T00:00:00Z", nil, "2024-02-29T00:00:00Z", true},
+		{"anniversary of the 31st, before the last day of February", TrafficResetMonthlyAnniversary, "2024-01-31T00:00:00Z", nil, "2024-02-28T23:00:00Z", false},
+		{"anniversary across the year", TrafficResetMonthlyAnniversary, "2024-12-20T00:00:00Z", nil, "2025-01-20T00:00:00Z", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{TrafficResetStrategy: tt.strategy, CreatedAt: at(tt.createdAt), LastTrafficResetAt: tt.lastReset}
+			if got := trafficResetDue(user, at(tt.now)); got != tt.want {
+				t.Errorf("trafficResetDue = %v, want %v (period start %s)", got, tt.want, trafficResetPeriodStart(user, at(tt.now)))
+			}
+		})
+	}
+}
+
+func TestResetUserTraffic(t *testing.T) {
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	future := now.Add(24 * time.Hour)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		user   User
+		want   UserStatus
+		active bool
+	}{
+		{"limited by traffic", User{Status: UserStatusLimited, TrafficLimitGB: 1, ExpiresAt: &future, StartedAt: &past}, UserStatusActive, true},
+		{"expired", User{Status: UserStatusExpired, TrafficLimitGB: 1, ExpiresAt: &past, StartedAt: &past}, UserStatusExpired, false},
+		{"disabled by an admin", User{Status: UserStatusDisabledByAdmin, TrafficLimitGB: 1}, UserStatusDisabledByAdmin, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			user.TrafficUsedBytes = 5 << 30
+			resetUserTraffic(&user, now)
+			if user.TrafficUsedBytes != 0 || user.LastTrafficResetAt == nil || !user.LastTrafficResetAt.Equal(now) {
+				t.Fatalf("usage %d, last reset %v", user.TrafficUsedBytes, user.LastTrafficResetAt)
+			}
+			if user.Status != tt.want || user.IsActive != tt.active {
+				t.Errorf("status %q, active %v, want %q, %v", user.Status, user.IsActive, tt.want, tt.active)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resellers are admins that only see and manage the users they created
+// (User.CreatedBy). Every user they create or extend is charged to their
+// budget: the traffic limit they hand out in GB and the days of access. The
+// cost of a change is computed on a copy of the user and reserved in the
+// admin registry before the user is saved, and refunded if saving fails.
+
+// errBudgetExceeded is returned when a reseller's budget cannot pay for a change.
+var errBudgetExceeded = errors.New("reseller budget exceeded")
+
+// ResellerBudget is what a reseller may hand out. A zero limit means no limit.
+type ResellerBudget struct {
+	MaxUsers  int     `json:"max_users"`  // Users the reseller may have at the same time
+	TrafficGB float64 `json:"traffic_gb"` // Total traffic limit over all created and raised users
+	Days      int     `json:"days"`       // Total days of access over all created and extended users
+}
+
+// ResellerCharge is the cost of user changes, and the running total charged
+// to a reseller.
+type ResellerCharge struct {
+	TrafficGB float64 `json:"traffic_gb"`
+	Days      int     `json:"days"`
+}
+
+func (c ResellerCharge) isZero() bool {
+	return c.TrafficGB == 0 && c.Days == 0
+}
+
+func validateResellerBudget(budget ResellerBudget) error {
+	if budget.MaxUsers < 0 || budget.TrafficGB < 0 || budget.Days < 0 {
+		return invalidRequestf("budget limits must not be negative")
+	}
+	return nil
+}
+
+// userVisibleTo reports whether the admin of ctx may see and manage user:
+// resellers only see their own users, other admins see everyone.
+func userVisibleTo(ctx context.Context, user User) bool {
+	id, ok := adminIdentityFromContext(ctx)
+	return !ok || id.Role != AdminRoleReseller || strings.EqualFold(user.CreatedBy, id.Username)
+}
+
+// paidDays returns how many days of access the user has left: the day count
+// of an on-hold user, or the days until ExpiresAt (rounded up). ok is false
+// when the user has no time limit.
+func paidDays(user User, now time.Time) (days int, ok bool) {
+	if user.Status == UserStatusOnHold {
+		return user.TimeLimitDays, user.TimeLimitDays > 0
+	}
+	if user.ExpiresAt == nil {
+		return 0, false
+	}
+	remaining := user.ExpiresAt.Sub(now)
+	if remaining <= 0 {
+		return 0, true
+	}
+	return int(math.Ceil(remaining.Hours() / 24)), true
+}
+
+// resellerCharge checks that a reseller may turn before (nil for a new user)
+// into after and returns what it costs: the traffic limit added and the days
+// of access added.
+func resellerCharge(before *User, after User, now time.Time) (ResellerCharge, error) {
+	if after.TrafficResetStrategy.orNone() != TrafficResetNone {
+		return ResellerCharge{}, invalidRequestf("resellers cannot set traffic reset schedules")
+	}
+	afterDays, ok := paidDays(after, now)
+	if !ok {
+		return ResellerCharge{}, invalidRequestf("users of resellers must have a time limit")
+	}
+
+	var beforeDays int
+	var beforeGB float64
+	if before != nil {
+		if after.TrafficUsedBytes < before.TrafficUsedBytes {
+			return ResellerCharge{}, invalidRequestf("resellers cannot reset traffic usage")
+		}
+		beforeDays, _ = paidDays(*before, now)
+		beforeGB = before.TrafficLimitGB
+	}
+
+	var charge ResellerCharge
+	if after.TrafficLimitGB > beforeGB {
+		charge.TrafficGB = after.TrafficLimitGB - beforeGB
+	}
+	if afterDays > beforeDays {
+		charge.Days = afterDays - beforeDays
+	}
+	return charge, nil
+}
+
+// checkBudget reports errBudgetExceeded if charged plus charge is over budget.
+func checkBudget(budget *ResellerBudget, charged, charge ResellerCharge) error {
+	if budget == nil {
+		return nil
+	}
+	if budget.TrafficGB > 0 && charged.TrafficGB+charge.TrafficGB > budget.TrafficGB {
+		return fmt.Errorf("%w: %g of %g GB already used, %g GB more needed", errBudgetExceeded, charged.TrafficGB, budget.TrafficGB, charge.TrafficGB)
+	}
+	if budget.Days > 0 && charged.Days+charge.Days > budget.Days {
+		return fmt.Errorf("%w: %d of %d days already used, %d days more needed", errBudgetExceeded, charged.Days, budget.Days, charge.Days)
+	}
+	return nil
+}
+
+// resellerReservation is the budget reserved for one user change by a
+// reseller. A nil reservation (changes by other admins) does nothing.
+type resellerReservation struct {
+	store    UserStore
+	username string
+	charge   ResellerCharge
+	maxUsers int // From the budget, 0 for no limit
+	now      time.Time
+}
+
+// reserveResellerBudget prices a change made by the admin of ctx: after is
+// the user as the change would leave it, before the user as it is now (nil
+// when creating one). For resellers the cost is charged to their budget.
+func reserveResellerBudget(ctx context.Context, store UserStore, before *User, after User, now time.Time) (*resellerReservation, error) {
+	id, ok := adminIdentityFromContext(ctx)
+	if !ok || id.Role != AdminRoleReseller {
+		return nil, nil
+	}
+	charge, err := resellerCharge(before, after, now)
+	if err != nil {
+		return nil, err
+	}
+	reservation := &resellerReservation{store: store, username: id.Username, charge: charge, now: now}
+	admin, ok, err := admins.lookup(ctx, store, id.Username)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errAdminNotFound
+	}
+	if admin.Budget != nil {
+		reservation.maxUsers = admin.Budget.MaxUsers
+	}
+	if charge.isZero() {
+		return reservation, nil
+	}
+	err = admins.update(ctx, store, func(registry AdminsConfig) error {
+		admin, ok := registry[adminKey(id.Username)]
+		if !ok {
+			return errAdminNotFound
+		}
+		if err := checkBudget(admin.Budget, admin.Charged, charge); err != nil {
+			return err
+		}
+		admin.Charged.TrafficGB += charge.TrafficGB
+		admin.Charged.Days += charge.Days
+		registry[adminKey(id.Username)] = admin
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// reserveForChange prices change applied to a copy of the current user.
+func reserveForChange(ctx context.Context, store UserStore, userID string, now time.Time, change func(user *User) error) (*resellerReservation, error) {
+	id, ok := adminIdentityFromContext(ctx)
+	if !ok || id.Role != AdminRoleReseller {
+		return nil, nil
+	}
+	before, ok := lookupUser(ctx, userID)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	after := before
+	if err := change(&after); err != nil {
+		return nil, err
+	}
+	return reserveResellerBudget(ctx, store, &before, after, now)
+}
+
+// verify checks, inside the store's read-modify-write, that the change as
+// applied to the latest stored user costs what was reserved. It fails with
+// ErrStoreConflict if the user was changed meanwhile.
+func (r *resellerReservation) verify(before *User, after User) error {
+	if r == nil {
+		return nil
+	}
+	charge, err := resellerCharge(before, after, r.now)
+	if err != nil {
+		return err
+	}
+	if charge != r.charge {
+		return fmt.Errorf("user changed while being updated: %w", ErrStoreConflict)
+	}
+	return nil
+}
+
+// checkUserCount reports errBudgetExceeded if the reseller already has as
+// many users as its budget allows. It runs inside the store's
+// read-modify-write when a user is created.
+func (r *resellerReservation) checkUserCount(users UsersConfig) error {
+	if r == nil || r.maxUsers == 0 {
+		return nil
+	}
+	owned := 0
+	for _, user := range users {
+		if strings.EqualFold(user.CreatedBy, r.username) {
+			owned++
+		}
+	}
+	if owned >= r.maxUsers {
+		return fmt.Errorf("%w: %d of %d users already created", errBudgetExceeded, owned, r.maxUsers)
+	}
+	return nil
+}
+
+// refund gives back the reserved budget after the change failed.
+func (r *resellerReservation) refund(ctx context.Context) {
+	if r == nil || r.charge.isZero() {
+		return
+	}
+	err := admins.update(ctx, r.store, func(registry AdminsConfig) error {
+		admin, ok := registry[adminKey(r.username)]
+		if !ok {
+			return nil
+		}
+		admin.Charged.TrafficGB = math.Max(0, admin.Charged.TrafficGB-r.charge.TrafficGB)
+		admin.Charged.Days -= r.charge.Days
+		if admin.Charged.Days < 0 {
+			admin.Charged.Days = 0
+		}
+		registry[adminKey(r.username)] = admin
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to refund %g GB / %d days to reseller %s: %v", r.charge.TrafficGB, r.charge.Days, r.username, err)
+	}
+}
+
+// resellerOverview is one entry of GET /api/v2/resellers.
+type resellerOverview struct {
+	Username         string          `json:"username"`
+	Budget           *ResellerBudget `json:"budget"`
+	Charged          ResellerCharge  `json:"charged"`
+	Users            int             `json:"users"`
+	ActiveUsers      int             `json:"active_users"`
+	TrafficUsedBytes int64           `json:"traffic_used_bytes"` // Current usage of the reseller's users
+}
+
+// resellersOverviewHandler serves GET /api/v2/resellers: the budget and
+// consumption of every reseller.
+func resellersOverviewHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := admins.reload(r.Context(), store); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, err.Error())
+			return
+		}
+
+		overview := make(map[string]*resellerOverview)
+		admins.mu.RLock()
+		for key, admin := range admins.admins {
+			if admin.Role == AdminRoleReseller {
+				overview[key] = &resellerOverview{Username: admin.Username, Budget: admin.Budget, Charged: admin.Charged}
+			}
+		}
+		admins.mu.RUnlock()
+
+		configMutex.RLock()
+		for _, user := range currentUsersConfig {
+			entry, ok := overview[adminKey(user.CreatedBy)]
+			if !ok {
+				continue
+			}
+			entry.Users++
+			if user.IsActive {
+				entry.ActiveUsers++
+			}
+			entry.TrafficUsedBytes += user.TrafficUsedBytes
+		}
+		configMutex.RUnlock()
+
+		list := make([]resellerOverview, 0, len(overview))
+		for _, entry := range overview {
+			list = append(list, *entry)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+		writeJSONResponse(w, http.StatusOK, list)
+	}
+}
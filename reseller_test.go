@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResellerCharge(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	in := func(days int) *time.Time {
+		at := now.AddDate(0, 0, days)
+		return &at
+	}
+	existing := User{Status: UserStatusActive, TrafficLimitGB: 10, TrafficUsedBytes: 100, ExpiresAt: in(10)}
+
+	tests := []struct {
+		name    string
+		before  *User
+		after   User
+		want    ResellerCharge
+		wantErr bool
+	}{
+		{"new user", nil, User{Status: UserStatusActive, TrafficLimitGB: 10, ExpiresAt: in(30)}, ResellerCharge{TrafficGB: 10, Days: 30}, false},
+		{"new on-hold user", nil, User{Status: UserStatusOnHold, TrafficLimitGB: 5, TimeLimitDays: 7}, ResellerCharge{TrafficGB: 5, Days: 7}, false},
+		{"partial day rounds up", nil, User{Status: UserStatusActive, TrafficLimitGB: 1, ExpiresAt: func() *time.Time { at := now.Add(36 * time.Hour); return &at }()}, ResellerCharge{TrafficGB: 1, Days: 2}, false},
+		{"raised limit", &existing, User{Status: UserStatusActive, TrafficLimitGB: 15, TrafficUsedBytes: 100, ExpiresAt: in(10)}, ResellerCharge{TrafficGB: 5}, false},
+		{"extended", &existing, User{Status: UserStatusActive, TrafficLimitGB: 10, TrafficUsedBytes: 100, ExpiresAt: in(40)}, ResellerCharge{Days: 30}, false},
+		{"lowered limits are free", &existing, User{Status: UserStatusActive, TrafficLimitGB: 5, TrafficUsedBytes: 100, ExpiresAt: in(5)}, ResellerCharge{}, false},
+		{"no time limit", nil, User{Status: UserStatusActive, TrafficLimitGB: 10}, ResellerCharge{}, true},
+		{"reset schedule", nil, User{Status: UserStatusActive, TrafficLimitGB: 10, ExpiresAt: in(30), TrafficResetStrategy: TrafficResetMonthly}, ResellerCharge{}, true},
+		{"usage reset", &existing, User{Status: UserStatusActive, TrafficLimitGB: 10, ExpiresAt: in(10)}, ResellerCharge{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			charge, err := resellerCharge(tt.before, tt.after, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if charge != tt.want {
+				t.Errorf("charge %+v, want %+v", charge, tt.want)
+			}
+		})
+	}
+}
+
+// chargedTo returns what is currently charged to the reseller.
+func chargedTo(t *testing.T, store UserStore, username string) ResellerCharge {
+	t.Helper()
+	admin, ok, err := admins.lookup(context.Background(), store, username)
+	if err != nil || !ok {
+		t.Fatalf("lookup %s: %v", username, err)
+	}
+	return admin.Charged
+}
+
+func TestResellerReservation(t *testing.T) {
+	store := newTestStore(t)
+	addTestAdmin(t, store, Admin{Username: "shop", Role: AdminRoleReseller, Budget: &ResellerBudget{MaxUsers: 2, TrafficGB: 20, Days: 60}})
+	ctx := withAdminIdentity(context.Background(), AdminIdentity{Username: "shop", Role: AdminRoleReseller})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	expiresAt := now.AddDate(0, 0, 30)
+	user := User{Status: UserStatusActive, TrafficLimitGB: 10, ExpiresAt: &expiresAt, CreatedBy: "shop"}
+
+	first, err := reserveResellerBudget(ctx, store, nil, user, now)
+	if err != nil {
+		t.Fatalf("first reservation: %v", err)
+	}
+	if charged := chargedTo(t, store, "shop"); charged != (ResellerCharge{TrafficGB: 10, Days: 30}) {
+		t.Fatalf("charged %+v after the first reservation", charged)
+	}
+
+	// The second one would take the traffic over the budget.
+	bigger := user
+	bigger.TrafficLimitGB = 15
+	if _, err := reserveResellerBudget(ctx, store, nil, bigger, now); !errors.Is(err, errBudgetExceeded) {
+		t.Fatalf("reservation over the budget: err = %v, want errBudgetExceeded", err)
+	}
+	if charged := chargedTo(t, store, "shop"); charged != (ResellerCharge{TrafficGB: 10, Days: 30}) {
+		t.Fatalf("a refused reservation was charged: %+v", charged)
+	}
+	second, err := reserveResellerBudget(ctx, store, nil, user, now)
+	if err != nil {
+		t.Fatalf("second reservation: %v", err)
+	}
+
+	// The change must still cost what was reserved when it is saved.
+	if err := first.verify(nil, user); err != nil {
+		t.Fatalf("verify of the reserved change: %v", err)
+	}
+	if err := first.verify(nil, bigger); !errors.Is(err, ErrStoreConflict) {
+		t.Fatalf("verify of a more expensive change: err = %v, want ErrStoreConflict", err)
+	}
+
+	// The user count is checked against the stored users.
+	if err := first.checkUserCount(UsersConfig{"a": {CreatedBy: "shop"}, "b": {CreatedBy: "other"}}); err != nil {
+		t.Fatalf("one of two users: %v", err)
+	}
+	if err := first.checkUserCount(UsersConfig{"a": {CreatedBy: "shop"}, "b": {CreatedBy: "SHOP"}}); !errors.Is(err, errBudgetExceeded) {
+		t.Fatalf("two of two users: err = %v, want errBudgetExceeded", err)
+	}
+
+	first.refund(ctx)
+	if charged := chargedTo(t, store, "shop"); charged != (ResellerCharge{TrafficGB: 10, Days: 30}) {
+		t.Fatalf("charged %+v after refunding one of two reservations", charged)
+	}
+	second.refund(ctx)
+	if charged := chargedTo(t, store, "shop"); charged != (ResellerCharge{}) {
+		t.Fatalf("charged %+v after refunding both reservations", charged)
+	}
+
+	// Other admins are not charged and get a nil reservation that does nothing.
+	ownerCtx := withAdminIdentity(context.Background(), AdminIdentity{Username: "root", Role: AdminRoleOwner})
+	reservation, err := reserveResellerBudget(ownerCtx, store, nil, User{TrafficLimitGB: 1000}, now)
+	if err != nil || reservation != nil {
+		t.Fatalf("owner reservation %+v, %v", reservation, err)
+	}
+	if err := reservation.verify(nil, User{}); err != nil {
+		t.Fatalf("verify of a nil reservation: %v", err)
+	}
+	reservation.refund(ownerCtx)
+}
@@ -0,0 +1,49 @@
+#!/bin/sh
+# Generates the Go packages of the Xray gRPC API this service talks to into
+# internal/v2rayapi, from the protos of the xray-core release XRAY_VERSION.
+# The packages keep Xray's layout without the app/ level, e.g. app/stats/command
+# becomes gcvp/internal/v2rayapi/stats/command.
+#
+# Needs go, protoc (or the command in PROTOC), protoc-gen-go and
+# protoc-gen-go-grpc. Run it from the repository root.
+set -eu
+
+XRAY_VERSION="${XRAY_VERSION:-v1.260327.0}"
+PROTOC="${PROTOC:-protoc}"
+MODULE=gcvp
+OUT=internal/v2rayapi
+
+# The protos of the packages the Go code imports; their imports are added below.
+ROOTS="app/stats/command/command.proto app/proxyman/command/command.proto
+common/protocol/user.proto common/serial/typed_message.proto
+proxy/vless/account.proto proxy/vmess/account.proto proxy/trojan/config.proto
+proxy/shadowsocks_2022/config.proto"
+
+src=$(go mod download -json "github.com/xtls/xray-core@$XRAY_VERSION" | sed -n 's/^[[:space:]]*"Dir": "\(.*\)",$/\1/p')
+if [ -z "$src" ]; then
+	echo "gen-v2rayapi: xray-core $XRAY_VERSION could not be downloaded" >&2
+	exit 1
+fi
+
+protos=""
+todo=$ROOTS
+while :; do
+	set -- $todo
+	[ $# -gt 0 ] || break
+	proto=$1
+	shift
+	todo="$*"
+	case " $protos " in *" $proto "*) continue ;; esac
+	protos="$protos $proto"
+	todo="$todo $(sed -n 's/^import "\([^"]*\)";.*/\1/p' "$src/$proto" | grep -v '^google/' || true)"
+done
+
+params="module=$MODULE"
+for proto in $protos; do
+	pkg=$(dirname "$proto")
+	params="$params,M$proto=$MODULE/$OUT/${pkg#app/}"
+done
+
+rm -rf "$OUT"
+"$PROTOC" -I "$src" --go_out="$params:." --go-grpc_out="$params:." $protos
+echo "gen-v2rayapi: generated $OUT from xray-core $XRAY_VERSION"
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A login starts a session: a short-lived access token (a JWT sent with
+// every request) and a refresh token that gets a new pair at
+// /api/auth/refresh. Refresh tokens rotate on every use; presenting one that
+// was already used means it leaked, and ends the session. Sessions are kept
+// in the "sessions" document of the store. Logging out deletes the session
+// and puts its ID and the token's jti on the denylist ("revoked_tokens"
+// document), which jwtAuthMiddleware checks, so that the access tokens
+// already issued stop working too.
+
+const (
+	accessTokenTTL        = 15 * time.Minute
+	sessionTTL            = 30 * 24 * time.Hour // Refresh tokens stop working this long after the login
+	sessionsDocument      = "sessions"
+	revokedTokensDocument = "revoked_tokens"
+	refreshTokenPrefix    = "rt_"
+	tokenTypeAccess       = "access"
+)
+
+// Session is an entry of the sessions document.
+type Session struct {
+	ID           string     `json:"id"`
+	Username     string     `json:"username"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RefreshHash  string     `json:"refresh_hash"`            // SHA-256 of the current refresh token
+	PreviousHash string     `json:"previous_hash,omitempty"` // Of the refresh token it replaced
+	RefreshedAt  *time.Time `json:"refreshed_at,omitempty"`
+	IP           string     `json:"ip"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+}
+
+// SessionsConfig holds the sessions by ID.
+type SessionsConfig map[string]Session
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+func randomTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("crypto/rand: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken returns a refresh token of the session: rt_<session>_<secret>.
+func newRefreshToken(sessionID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("crypto/rand: %v", err)
+	}
+	return refreshTokenPrefix + sessionID + "_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func refreshTokenSession(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, refreshTokenPrefix)
+	if !ok {
+		return "", false
+	}
+	sessionID, _, ok := strings.Cut(rest, "_")
+	return sessionID, ok && sessionID != ""
+}
+
+// generateJWT creates an access token of the session for admin.
+func generateJWT(admin Admin, sessionID string) (string, error) {
+	jti, err := randomTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return jwtKeys.sign(jwt.MapClaims{
+		"username": admin.Username,
+		"role":     admin.Role, // Informational; the registry is authoritative
+		"typ":      tokenTypeAccess,
+		"sid":      sessionID,
+		"jti":      jti,
+		"exp":      now.Add(accessTokenTTL).Unix(),
+		"iat":      now.Unix(),
+	})
+}
+
+func decodeSessions(data []byte) (SessionsConfig, error) {
+	sessions := make(SessionsConfig)
+	if data == nil {
+		return sessions, nil
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal sessions: %v", err)
+	}
+	return sessions, nil
+}
+
+// updateSessions applies mutate to the stored sessions, after dropping the
+// expired ones.
+func updateSessions(ctx context.Context, store UserStore, mutate func(sessions SessionsConfig) error) error {
+	_, err := store.UpdateDocument(ctx, sessionsDocument, func(data []byte) ([]byte, error) {
+		sessions, err := decodeSessions(data)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for id, session := range sessions {
+			if now.After(session.ExpiresAt) {
+				delete(sessions, id)
+			}
+		}
+		if err := mutate(sessions); err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(sessions, "", "  ")
+	})
+	return err
+}
+
+// LoginResponse is the token pair of a completed login or refresh.
+type LoginResponse struct {
+	Token         string   `json:"token"` // The access token
+	RefreshToken  string   `json:"refresh_token"`
+	TokenType     string   `json:"token_type"`
+	ExpiresIn     int      `json:"expires_in"`               // Seconds the access token is valid
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // Only right after enrolling in 2FA at login
+}
+
+func newLoginResponse(accessToken, refreshToken string) LoginResponse {
+	return LoginResponse{Token: accessToken, RefreshToken: refreshToken, TokenType: "Bearer", ExpiresIn: int(accessTokenTTL.Seconds())}
+}
+
+// startSession starts a session for admin, who has just logged in.
+func startSession(r *http.Request, store UserStore, admin Admin) (LoginResponse, error) {
+	sessionID, err := randomTokenID()
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	refreshToken, err := newRefreshToken(sessionID)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	now := time.Now().UTC()
+	session := Session{
+		ID:          sessionID,
+		Username:    admin.Username,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(sessionTTL),
+		RefreshHash: hashRefreshToken(refreshToken),
+		IP:          logins.clientIP(r),
+		UserAgent:   r.UserAgent(),
+	}
+	err = updateSessions(r.Context(), store, func(sessions SessionsConfig) error {
+		sessions[sessionID] = session
+		return nil
+	})
+	if err != nil {
+		return LoginResponse{}, fmt.Errorf("failed to save session: %v", err)
+	}
+	accessToken, err := generateJWT(admin, sessionID)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	return newLoginResponse(accessToken, refreshToken), nil
+}
+
+// rotateRefreshToken replaces refreshToken by a new one and returns it with
+// its session. A reused refresh token deletes the session.
+func rotateRefreshToken(ctx context.Context, store UserStore, refreshToken string) (Session, string, error) {
+	sessionID, ok := refreshTokenSession(refreshToken)
+	if !ok {
+		return Session{}, "", errInvalidRefreshToken
+	}
+	newToken, err := newRefreshToken(sessionID)
+	if err != nil {
+		return Session{}, "", err
+	}
+	hash := hashRefreshToken(refreshToken)
+	var session Session
+	reused := false
+	err = updateSessions(ctx, store, func(sessions SessionsConfig) error {
+		var ok bool
+		session, ok = sessions[sessionID]
+		reused = false
+		switch {
+		case !ok:
+			return errInvalidRefreshToken
+		case session.PreviousHash != "" && subtle.ConstantTimeCompare([]byte(session.PreviousHash), []byte(hash)) == 1:
+			reused = true
+			delete(sessions, sessionID)
+			return nil
+		case subtle.ConstantTimeCompare([]byte(session.RefreshHash), []byte(hash)) != 1:
+			return errInvalidRefreshToken
+		}
+		now := time.Now().UTC()
+		session.PreviousHash = session.RefreshHash
+		session.RefreshHash = hashRefreshToken(newToken)
+		session.RefreshedAt = &now
+		sessions[sessionID] = session
+		return nil
+	})
+	if err != nil {
+		return Session{}, "", err
+	}
+	if reused {
+		// The session is gone, but its access tokens stay valid unless revoked.
+		if err := revokedTokens.revoke(ctx, store, session.ID); err != nil {
+			return Session{}, "", fmt.Errorf("refresh token of session %s reused: %v", session.ID, err)
+		}
+		return Session{}, "", errRefreshTokenReused
+	}
+	return session, newToken, nil
+}
+
+// revokedTokenCache caches the denylist: the jti of logged out access tokens
+// and the IDs of ended sessions, each with the time after which no token it
+// covers is valid anyway. Other instances pick up additions within
+// adminsCacheTTL.
+type revokedTokenCache struct {
+	mu       sync.RWMutex
+	revoked  map[string]time.Time
+	loadedAt time.Time
+}
+
+var revokedTokens = &revokedTokenCache{}
+
+func decodeRevokedTokens(data []byte) (map[string]time.Time, error) {
+	revoked := make(map[string]time.Time)
+	if data == nil {
+		return revoked, nil
+	}
+	if err := json.Unmarshal(data, &revoked); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal revoked tokens: %v", err)
+	}
+	return revoked, nil
+}
+
+func (c *revokedTokenCache) set(revoked map[string]time.Time) {
+	c.mu.Lock()
+	c.revoked = revoked
+	c.loadedAt = time.Now()
+	c.mu.Unlock()
+}
+
+// contains reports whether any of ids is revoked.
+func (c *revokedTokenCache) contains(ctx context.Context, store UserStore, ids ...string) (bool, error) {
+	c.mu.RLock()
+	stale := time.Since(c.loadedAt) > adminsCacheTTL
+	c.mu.RUnlock()
+	if stale {
+		data, err := store.LoadDocument(ctx, revokedTokensDocument)
+		if err != nil {
+			return false, fmt.Errorf("failed to load revoked tokens from %s: %v", store.Describe(), err)
+		}
+		revoked, err := decodeRevokedTokens(data)
+		if err != nil {
+			return false, err
+		}
+		c.set(revoked)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, id := range ids {
+		if _, ok := c.revoked[id]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// revoke puts ids on the denylist until every access token they cover has
+// expired.
+func (c *revokedTokenCache) revoke(ctx context.Context, store UserStore, ids ...string) error {
+	until := time.Now().Add(accessTokenTTL).UTC()
+	var updated map[string]time.Time
+	_, err := store.UpdateDocument(ctx, revokedTokensDocument, func(data []byte) ([]byte, error) {
+		revoked, err := decodeRevokedTokens(data)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for id, expiresAt := range revoked {
+			if now.After(expiresAt) {
+				delete(revoked, id)
+			}
+		}
+		for _, id := range ids {
+			revoked[id] = until
+		}
+		updated = revoked
+		return json.MarshalIndent(revoked, "", "  ")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke tokens %v: %v", ids, err)
+	}
+	c.set(updated)
+	return nil
+}
+
+// endSessions deletes the sessions of username for which match returns true
+// and revokes their access tokens, plus the tokens in extra. An error means
+// some of those tokens may still be accepted.
+func endSessions(ctx context.Context, store UserStore, username string, match func(session Session) bool, extra ...string) error {
+	ended := extra
+	err := updateSessions(ctx, store, func(sessions SessionsConfig) error {
+		ended = extra
+		for id, session := range sessions {
+			if adminKey(session.Username) == adminKey(username) && match(session) {
+				ended = append(ended, id)
+				delete(sessions, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(ended) > 0 {
+		return revokedTokens.revoke(ctx, store, ended...)
+	}
+	return nil
+}
+
+// endAllSessions logs username out everywhere, after a password change by
+// someone else or the deletion of the account.
+func endAllSessions(ctx context.Context, store UserStore, username string) {
+	if err := endSessions(ctx, store, username, func(Session) bool { return true }); err != nil {
+		log.Printf("ERROR: Failed to end sessions of admin %s: %v", username, err)
+	}
+}
+
+// RefreshRequest is the body of POST /api/auth/refresh.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshHandler serves POST /api/auth/refresh: a refresh token is exchanged
+// for a new access token and a new refresh token.
+func refreshHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only POST method is allowed"})
+			return
+		}
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+
+		session, refreshToken, err := rotateRefreshToken(r.Context(), store, req.RefreshToken)
+		switch {
+		case errors.Is(err, errRefreshTokenReused):
+			logSecurityEvent("refresh_token_reused", "", logins.clientIP(r), "session ended")
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Refresh token was already used; log in again"})
+			return
+		case errors.Is(err, errInvalidRefreshToken):
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid or expired refresh token"})
+			return
+		case err != nil:
+			log.Printf("ERROR: Failed to refresh session: %v", err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to refresh session"})
+			return
+		}
+
+		admin, ok, err := admins.lookup(r.Context(), store, session.Username)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load admins"})
+			return
+		}
+		if !ok {
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Admin account no longer exists"})
+			return
+		}
+		accessToken, err := generateJWT(admin, session.ID)
+		if err != nil {
+			log.Printf("ERROR: Failed to generate JWT: %v", err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, newLoginResponse(accessToken, refreshToken))
+	}
+}
+
+// LogoutRequest is the optional body of POST /api/auth/logout.
+type LogoutRequest struct {
+	All bool `json:"all"` // End every session of the admin, not just this one
+}
+
+// logoutHandler serves POST /api/auth/logout: it ends the session of the
+// access token (or all sessions of its admin) and revokes the token.
+func logoutHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LogoutRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
+				return
+			}
+		}
+		id, _ := adminIdentityFromContext(r.Context())
+		err := endSessions(r.Context(), store, id.Username, func(session Session) bool {
+			return req.All || session.ID == id.SessionID
+		}, id.TokenID, id.SessionID)
+		if err != nil {
+			log.Printf("ERROR: Failed to end sessions of admin %s: %v", id.Username, err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to log out"})
+			return
+		}
+		detail := ""
+		if req.All {
+			detail = "all sessions"
+		}
+		logSecurityEvent("logout", id.Username, logins.clientIP(r), detail)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
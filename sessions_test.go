@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startTestSession logs admin in and returns the token pair.
+func startTestSession(t *testing.T, store UserStore, admin Admin) LoginResponse {
+	t.Helper()
+	login, err := startSession(httptest.NewRequest(http.MethodPost, "/api/auth/login", nil), store, admin)
+	if err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+	return login
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	useTestKeyring(t)
+	store := newTestStore(t)
+	ctx := context.Background()
+	admin := addTestAdmin(t, store, Admin{Username: "alice", Role: AdminRoleOwner})
+	login := startTestSession(t, store, admin)
+	sessionID, _ := refreshTokenSession(login.RefreshToken)
+
+	session, second, err := rotateRefreshToken(ctx, store, login.RefreshToken)
+	if err != nil {
+		t.Fatalf("first rotation: %v", err)
+	}
+	if session.ID != sessionID || session.Username != "alice" || second == login.RefreshToken {
+		t.Fatalf("rotation returned session %+v and token %q", session, second)
+	}
+	_, third, err := rotateRefreshToken(ctx, store, second)
+	if err != nil {
+		t.Fatalf("second rotation: %v", err)
+	}
+
+	// Tokens that never belonged to the session leave it alone.
+	for _, token := range []string{"", "rt_", "rt_" + sessionID, "rt_" + sessionID + "_guess", "rt_unknown_" + strings.TrimPrefix(third, "rt_"+sessionID+"_")} {
+		if _, _, err := rotateRefreshToken(ctx, store, token); !errors.Is(err, errInvalidRefreshToken) {
+			t.Errorf("token %q: err = %v, want errInvalidRefreshToken", token, err)
+		}
+	}
+
+	// The token just replaced is the reuse a thief would cause.
+	if _, _, err := rotateRefreshToken(ctx, store, second); !errors.Is(err, errRefreshTokenReused) {
+		t.Fatalf("reused token: err = %v, want errRefreshTokenReused", err)
+	}
+	if _, _, err := rotateRefreshToken(ctx, store, third); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("current token after the reuse: err = %v, want errInvalidRefreshToken", err)
+	}
+	if revoked, err := revokedTokens.contains(ctx, store, sessionID); err != nil || !revoked {
+		t.Fatalf("session revoked = %v, err = %v", revoked, err)
+	}
+
+	// Older tokens than the previous one are simply invalid.
+	other := startTestSession(t, store, admin)
+	next := other.RefreshToken
+	for i := 0; i < 2; i++ {
+		if _, next, err = rotateRefreshToken(ctx, store, next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := rotateRefreshToken(ctx, store, other.RefreshToken); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("token two rotations old: err = %v, want errInvalidRefreshToken", err)
+	}
+}
+
+// callWithToken sends a request with an access token through
+// jwtAuthMiddleware to handler and returns the response code.
+func callWithToken(store UserStore, method, path, token string, handler http.Handler) int {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	jwtAuthMiddleware(store, handler).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRevokedTokens(t *testing.T) {
+	useTestKeyring(t)
+	store := newTestStore(t)
+	admin := addTestAdmin(t, store, Admin{Username: "alice", Role: AdminRoleOwner})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	first := startTestSession(t, store, admin)
+	second := startTestSession(t, store, admin)
+	third := startTestSession(t, store, admin)
+	// A new access token of the first session, as after a refresh
+	sessionID, _ := refreshTokenSession(first.RefreshToken)
+	refreshed, err := generateJWT(admin, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := callWithToken(store, http.MethodPost, "/api/auth/logout", first.Token, logoutHandler(store)); code != http.StatusNoContent {
+		t.Fatalf("logout: got %d", code)
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"token used to log out", first.Token, http.StatusUnauthorized},
+		{"other token of the ended session", refreshed, http.StatusUnauthorized},
+		{"token of another session", second.Token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := callWithToken(store, http.MethodGet, "/api/v2/users", tt.token, ok); code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.want)
+		}
+	}
+	if _, _, err := rotateRefreshToken(context.Background(), store, first.RefreshToken); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("refresh token of the ended session: err = %v, want errInvalidRefreshToken", err)
+	}
+
+	// Ending every session of the admin, as on deletion
+	endAllSessions(context.Background(), store, "alice")
+	for _, token := range []string{second.Token, third.Token} {
+		if code := callWithToken(store, http.MethodGet, "/api/v2/users", token, ok); code != http.StatusUnauthorized {
+			t.Errorf("after ending all sessions: got %d, want 401", code)
+		}
+	}
+}
+
+// failingDocumentStore fails every UpdateDocument of one document.
+type failingDocumentStore struct {
+	UserStore
+	document string
+}
+
+func (s failingDocumentStore) UpdateDocument(ctx context.Context, name string, mutate func(data []byte) ([]byte, error)) ([]byte, error) {
+	if name == s.document {
+		return nil, errors.New("store unavailable")
+	}
+	return s.UserStore.UpdateDocument(ctx, name, mutate)
+}
+
+func TestRevocationFailures(t *testing.T) {
+	useTestKeyring(t)
+	store := newTestStore(t)
+	admin := addTestAdmin(t, store, Admin{Username: "alice", Role: AdminRoleOwner})
+	broken := failingDocumentStore{UserStore: store, document: revokedTokensDocument}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// A logout whose token cannot be revoked is reported, not silently accepted.
+	login := startTestSession(t, store, admin)
+	if code := callWithToken(broken, http.MethodPost, "/api/auth/logout", login.Token, logoutHandler(broken)); code != http.StatusInternalServerError {
+		t.Fatalf("logout without revocation: got %d, want 500", code)
+	}
+	startTestSession(t, store, admin)
+	if err := endSessions(context.Background(), broken, "alice", func(Session) bool { return true }); err == nil {
+		t.Fatal("endSessions without revocation succeeded")
+	}
+
+	// So is a detected reuse.
+	login = startTestSession(t, store, admin)
+	if _, _, err := rotateRefreshToken(context.Background(), store, login.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := rotateRefreshToken(context.Background(), broken, login.RefreshToken)
+	if err == nil || errors.Is(err, errRefreshTokenReused) || errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("reuse without revocation: err = %v, want a failure", err)
+	}
+
+	// Once the store works again, logging out revokes the token.
+	login = startTestSession(t, store, admin)
+	if code := callWithToken(store, http.MethodPost, "/api/auth/logout", login.Token, logoutHandler(store)); code != http.StatusNoContent {
+		t.Fatalf("logout: got %d", code)
+	}
+	if code := callWithToken(store, http.MethodGet, "/api/v2/users", login.Token, ok); code != http.StatusUnauthorized {
+		t.Fatalf("token after logout: got %d, want 401", code)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	qrDefaultSize = 256
+	qrMaxSize     = 1024
+)
+
+// publicEndpoint is the address clients use to reach the proxy.
+type publicEndpoint struct {
+	Host string
+	Port int
+	TLS  bool
+}
+
+// baseURL returns the panel URL for the endpoint, e.g. "https://host".
+func (e publicEndpoint) baseURL() string {
+	scheme := "http"
+	if e.TLS {
+		scheme = "https"
+	}
+	if (e.TLS && e.Port == 443) || (!e.TLS && e.Port == 80) {
+		if strings.Contains(e.Host, ":") {
+			return scheme + "://[" + e.Host + "]" // IPv6 literal
+		}
+		return scheme + "://" + e.Host
+	}
+	return scheme + "://" + e.hostPort()
+}
+
+// hostPort returns "host:port" for URIs, with IPv6 hosts in brackets.
+func (e publicEndpoint) hostPort() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// publicEndpointFromRequest derives the client-facing address from the
+// incoming request, since on Cloud Run the proxy and the API share a host.
+// PUBLIC_HOST, PUBLIC_PORT and PUBLIC_TLS override the detected values; the
+// port says nothing about TLS, since a TLS terminator may listen on any port.
+func publicEndpointFromRequest(r *http.Request) publicEndpoint {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	tls := r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+
+	port := 80
+	if tls {
+		port = 443
+	}
+	// SplitHostPort also unbrackets IPv6 hosts such as [2001:db8::1]:443.
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if n, err := strconv.Atoi(p); err == nil {
+			port = n
+		}
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]") // No port
+	}
+
+	if envHost := os.Getenv("PUBLIC_HOST"); envHost != "" {
+		host = strings.TrimSuffix(strings.TrimPrefix(envHost, "["), "]")
+	}
+	if envPort, err := strconv.Atoi(os.Getenv("PUBLIC_PORT")); err == nil && envPort > 0 {
+		port = envPort
+	}
+	if envTLS, err := strconv.ParseBool(os.Getenv("PUBLIC_TLS")); err == nil {
+		tls = envTLS
+	}
+	return publicEndpoint{Host: host, Port: port, TLS: tls}
+}
+
+// clientConnection describes how a client reaches one user-facing inbound
+// through the public endpoint.
+type clientConnection struct {
+	Protocol string
+	Tag      string
+	Network  string // V2Ray transport: ws, httpupgrade or tcp
+	Path     string // ws and httpupgrade path
+	Endpoint publicEndpoint
+	// Shadowsocks only: the method and the server key of the inbound
+	Method    string
+	ServerKey string
+}
+
+// clientConnections lists the connections offered to users, taken from the
+// same inbound definitions generateV2RayConfig writes. Proxied inbounds are
+// reached on endpoint; tcp ones on their own port of the same host, without TLS.
+func clientConnections(endpoint publicEndpoint) []clientConnection {
+	conns := make([]clientConnection, 0, len(v2rayInbounds))
+	for _, inbound := range v2rayInbounds {
+		conn := clientConnection{
+			Protocol:  inbound.Protocol,
+			Tag:       inbound.Tag,
+			Network:   inbound.Network,
+			Path:      inbound.Path,
+			Endpoint:  endpoint,
+			Method:    inbound.Method,
+			ServerKey: inbound.ServerKey,
+		}
+		if !inbound.proxied() {
+			conn.Endpoint = publicEndpoint{Host: endpoint.Host, Port: inbound.Port}
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// connectionName names the client profile for conn. With a single inbound the
+// base name is used as is.
+func connectionName(base string, conn clientConnection, total int) string {
+	if total <= 1 {
+		return base
+	}
+	return base + "-" + conn.Tag
+}
+
+// transportParams returns the query parameters vless:// and trojan:// URIs
+// use to describe the transport and TLS of conn.
+func transportParams(conn clientConnection) url.Values {
+	params := url.Values{}
+	params.Set("type", conn.Network)
+	if conn.Network == networkWS || conn.Network == networkHTTPUpgrade {
+		params.Set("path", conn.Path)
+		params.Set("host", conn.Endpoint.Host)
+	}
+	if conn.Endpoint.TLS {
+		params.Set("security", "tls")
+		params.Set("sni", conn.Endpoint.Host)
+	} else {
+		params.Set("security", "none")
+	}
+	return params
+}
+
+// vlessShareLink builds the vless:// URI for a VLESS inbound.
+func vlessShareLink(user User, conn clientConnection, name string) string {
+	params := transportParams(conn)
+	params.Set("encryption", "none")
+	return fmt.Sprintf("vless://%s@%s?%s#%s", user.ID, conn.Endpoint.hostPort(), params.Encode(), url.PathEscape(name))
+}
+
+// vmessShareLink builds the vmess:// URI for a VMess inbound: the base64 of
+// the JSON object v2rayN introduced.
+func vmessShareLink(user User, conn clientConnection, name string) (string, error) {
+	link := map[string]string{
+		"v":    "2",
+		"ps":   name,
+		"add":  conn.Endpoint.Host,
+		"port": strconv.Itoa(conn.Endpoint.Port),
+		"id":   user.ID,
+		"aid":  "0",
+		"scy":  "auto",
+		"net":  conn.Network,
+		"type": "none",
+		"host": "",
+		"path": conn.Path,
+		"tls":  "",
+	}
+	if conn.Network != networkTCP {
+		link["host"] = conn.Endpoint.Host
+	}
+	if conn.Endpoint.TLS {
+		link["tls"] = "tls"
+		link["sni"] = conn.Endpoint.Host
+	}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+	return "vmess://" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// trojanShareLink builds the trojan:// URI for a Trojan inbound.
+func trojanShareLink(user User, conn clientConnection, name string) string {
+	params := transportParams(conn)
+	return fmt.Sprintf("trojan://%s@%s?%s#%s", url.PathEscape(user.TrojanPassword), conn.Endpoint.hostPort(), params.Encode(), url.PathEscape(name))
+}
+
+// ssPassword is the password a Shadowsocks 2022 client of a multi-user
+// inbound uses: the server key and the user key joined by a colon.
+func ssPassword(user User, conn clientConnection) string {
+	return conn.ServerKey + ":" + userSSKey(user, conn.Method)
+}
+
+// ssShareLink builds the SIP002 ss:// URI for a Shadowsocks 2022 inbound.
+// WebSocket inbounds are described as the v2ray-plugin clients need to reach them.
+func ssShareLink(user User, conn clientConnection, name string) string {
+	userInfo := conn.Method + ":" + url.QueryEscape(ssPassword(user, conn))
+	link := fmt.Sprintf("ss://%s@%s", userInfo, conn.Endpoint.hostPort())
+	if conn.Network == networkWS {
+		plugin := "v2ray-plugin;mode=websocket;path=" + conn.Path + ";host=" + conn.Endpoint.Host
+		if conn.Endpoint.TLS {
+			plugin += ";tls"
+		}
+		link += "/?plugin=" + url.QueryEscape(plugin)
+	}
+	return link + "#" + url.PathEscape(name)
+}
+
+// shareLink builds the share URI for conn in the format of its protocol.
+func shareLink(user User, conn clientConnection, name string) (string, error) {
+	switch conn.Protocol {
+	case protocolVLESS:
+		return vlessShareLink(user, conn, name), nil
+	case protocolVMess:
+		return vmessShareLink(user, conn, name)
+	case protocolTrojan:
+		return trojanShareLink(user, conn, name), nil
+	case protocolShadowsocks:
+		return ssShareLink(user, conn, name), nil
+	default:
+		return "", fmt.Errorf("no share link format for protocol %q (inbound %s)", conn.Protocol, conn.Tag)
+	}
+}
+
+// userLink is one share link as returned by /api/user/links.
+type userLink struct {
+	Protocol string `json:"protocol"`
+	Tag      string `json:"tag"`
+	URI      string `json:"uri"`
+}
+
+// userShareLinks returns a share link for every inbound the user can connect to.
+func userShareLinks(user User, endpoint publicEndpoint, name string) ([]userLink, error) {
+	conns := clientConnections(endpoint)
+	links := make([]userLink, 0, len(conns))
+	for _, conn := range conns {
+		uri, err := shareLink(user, conn, connectionName(name, conn, len(conns)))
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, userLink{Protocol: conn.Protocol, Tag: conn.Tag, URI: uri})
+	}
+	return links, nil
+}
+
+// userProfileName is the name clients show for the user's profile.
+func userProfileName(user User) string {
+	if user.Username != "" {
+		return user.Username
+	}
+	if len(user.ID) > 8 {
+		return "user_" + user.ID[:8]
+	}
+	return "user_" + user.ID
+}
+
+// subscriptionURL returns the public /sub/ URL of the user, or "" without a token.
+func subscriptionURL(user User, endpoint publicEndpoint) string {
+	if user.SubscriptionToken == "" {
+		return ""
+	}
+	return endpoint.baseURL() + "/sub/" + user.SubscriptionToken
+}
+
+// lookupUser returns the user with the given ID from the in-memory config,
+// if the admin of ctx may see it.
+func lookupUser(ctx context.Context, userID string) (User, bool) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	user, ok := currentUsersConfig[userID]
+	if !ok || !userVisibleTo(ctx, user) {
+		return User{}, false
+	}
+	return user, ok
+}
+
+// userLinksHandler serves GET /api/user/links?id=, the share links of a user
+// built from the running inbound configuration.
+func userLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only GET method is allowed"})
+		return
+	}
+	userID := r.URL.Query().Get("id")
+	if userID == "" {
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required in query parameters"})
+		return
+	}
+	user, ok := lookupUser(r.Context(), userID)
+	if !ok {
+		writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+
+	endpoint := publicEndpointFromRequest(r)
+	links, err := userShareLinks(user, endpoint, userProfileName(user))
+	if err != nil {
+		log.Printf("ERROR: Failed to build share links for user %s: %v", userID, err)
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to build share links"})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"user_id":          user.ID,
+		"links":            links,
+		"subscription_url": subscriptionURL(user, endpoint),
+	})
+}
+
+// userQRHandler serves GET /api/user/qr?id=&link=&format=&size=, a QR code of
+// one of the user's share links (link=N, default 0) or of the subscription URL
+// (link=subscription), rendered as PNG (default) or SVG.
+func userQRHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only GET method is allowed"})
+		return
+	}
+	query := r.URL.Query()
+	userID := query.Get("id")
+	if userID == "" {
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required in query parameters"})
+		return
+	}
+	user, ok := lookupUser(r.Context(), userID)
+	if !ok {
+		writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+
+	size := qrDefaultSize
+	if s := query.Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 64 || n > qrMaxSize {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("size must be between 64 and %d", qrMaxSize)})
+			return
+		}
+		size = n
+	}
+
+	endpoint := publicEndpointFromRequest(r)
+	var content string
+	switch link := query.Get("link"); link {
+	case "subscription":
+		content = subscriptionURL(user, endpoint)
+		if content == "" {
+			writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "User has no subscription token"})
+			return
+		}
+	default:
+		index := 0
+		if link != "" {
+			n, err := strconv.Atoi(link)
+			if err != nil || n < 0 {
+				writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "link must be a link index or 'subscription'"})
+				return
+			}
+			index = n
+		}
+		links, err := userShareLinks(user, endpoint, userProfileName(user))
+		if err != nil {
+			log.Printf("ERROR: Failed to build share links for user %s: %v", userID, err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to build share links"})
+			return
+		}
+		if index >= len(links) {
+			writeJSONResponse(w, http.StatusNotFound, map[string]string{"error": "Link not found"})
+			return
+		}
+		content = links[index].URI
+	}
+
+	qr, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		log.Printf("ERROR: Failed to encode QR code for user %s: %v", userID, err)
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to encode QR code"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch strings.ToLower(query.Get("format")) {
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(qrSVG(qr.Bitmap(), size)))
+	case "", "png":
+		png, err := qr.PNG(size)
+		if err != nil {
+			log.Printf("ERROR: Failed to render QR code for user %s: %v", userID, err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to render QR code"})
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write(png)
+	default:
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "format must be png or svg"})
+	}
+}
+
+// qrSVG renders a QR bitmap (quiet zone included) as an SVG of size pixels.
+func qrSVG(bitmap [][]bool, size int) string {
+	var b strings.Builder
+	n := len(bitmap)
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
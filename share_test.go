@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicEndpointFromRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		proto   string // X-Forwarded-Proto
+		tls     bool   // Request received over TLS
+		envHost string
+		envPort string
+		envTLS  string
+		want    publicEndpoint
+	}{
+		{name: "plain http", host: "vpn.example.com", want: publicEndpoint{Host: "vpn.example.com", Port: 80}},
+		{name: "behind a TLS proxy", host: "vpn.example.com", proto: "https", want: publicEndpoint{Host: "vpn.example.com", Port: 443, TLS: true}},
+		{name: "TLS", host: "vpn.example.com:8443", tls: true, want: publicEndpoint{Host: "vpn.example.com", Port: 8443, TLS: true}},
+		{name: "IPv6 host", host: "[2001:db8::1]:8080", want: publicEndpoint{Host: "2001:db8::1", Port: 8080}},
+		{name: "overridden host", host: "10.0.0.1:8080", envHost: "vpn.example.com", want: publicEndpoint{Host: "vpn.example.com", Port: 8080}},
+		{name: "overridden port keeps TLS", host: "vpn.example.com", proto: "https", envPort: "8443", want: publicEndpoint{Host: "vpn.example.com", Port: 8443, TLS: true}},
+		{name: "port 443 without TLS", host: "vpn.example.com", envPort: "443", want: publicEndpoint{Host: "vpn.example.com", Port: 443}},
+		{name: "overridden TLS", host: "vpn.example.com", envPort: "8443", envTLS: "true", want: publicEndpoint{Host: "vpn.example.com", Port: 8443, TLS: true}},
+		{name: "TLS switched off", host: "vpn.example.com", proto: "https", envTLS: "false", want: publicEndpoint{Host: "vpn.example.com", Port: 443}},
+		{name: "invalid values are ignored", host: "vpn.example.com", proto: "https", envPort: "x", envTLS: "maybe", want: publicEndpoint{Host: "vpn.example.com", Port: 443, TLS: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PUBLIC_HOST", tt.envHost)
+			t.Setenv("PUBLIC_PORT", tt.envPort)
+			t.Setenv("PUBLIC_TLS", tt.envTLS)
+			r := httptest.NewRequest(http.MethodGet, "/sub/token", nil)
+			r.Host = tt.host
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := publicEndpointFromRequest(r); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// persistMutex orders persistUsers calls so the in-memory config is always
+// replaced by the most recently persisted state.
+var persistMutex = &sync.Mutex{}
+
+// ErrUserNotFound is returned by UserStore.Get and UserStore.Delete for unknown IDs.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrStoreConflict is returned when the stored users were changed by another
+// writer (e.g. another Cloud Run instance) and the change cannot be merged.
+var ErrStoreConflict = errors.New("users were modified concurrently")
+
+// UserStore persists the users configuration.
+// Load and Save operate on the whole set; Get, Put and Delete on a single user.
+// Changes that must check other users, such as a unique username, go
+// through Update, which the bolt store also writes user by user.
+type UserStore interface {
+	Load(ctx context.Context) (UsersConfig, error)
+	Save(ctx context.Context, users UsersConfig) error
+	// Update runs mutate against the latest stored users and persists the result.
+	// If another writer got in first, the users are reloaded and mutate is
+	// applied again. It returns the users as persisted.
+	Update(ctx context.Context, mutate func(users UsersConfig) error) (UsersConfig, error)
+	Get(ctx context.Context, id string) (User, error)
+	Put(ctx context.Context, user User) error
+	Delete(ctx context.Context, id string) error
+	// LoadDocument returns the named JSON document kept next to the users
+	// (such as the admin registry), or nil if it does not exist yet.
+	LoadDocument(ctx context.Context, name string) ([]byte, error)
+	// UpdateDocument runs mutate against the latest content of the named
+	// document (nil if it does not exist) and persists what mutate returns,
+	// with the same conflict handling as Update.
+	UpdateDocument(ctx context.Context, name string, mutate func(data []byte) ([]byte, error)) ([]byte, error)
+	// Describe returns a human-readable location of the store for logs.
+	Describe() string
+	Close() error
+}
+
+// newUserStoreFromEnv selects the UserStore backend from the environment:
+//
+//	USER_STORE=gcs  (default) GCS_BUCKET_NAME / GCS_OBJECT_NAME
+//	USER_STORE=file USER_STORE_PATH, a JSON file replaced atomically on save
+//	USER_STORE=bolt USER_STORE_PATH, an embedded bbolt database
+func newUserStoreFromEnv(ctx context.Context) (UserStore, error) {
+	backend := os.Getenv("USER_STORE")
+	if backend == "" {
+		backend = "gcs"
+	}
+
+	switch backend {
+	case "gcs":
+		bucket := os.Getenv("GCS_BUCKET_NAME")
+		object := os.Getenv("GCS_OBJECT_NAME")
+		if bucket == "" || object == "" {
+			return nil, fmt.Errorf("GCS_BUCKET_NAME and GCS_OBJECT_NAME environment variables must be set for USER_STORE=gcs")
+		}
+		return newGCSUserStore(ctx, bucket, object)
+	case "file":
+		path := os.Getenv("USER_STORE_PATH")
+		if path == "" {
+			path = "users.json"
+			log.Printf("USER_STORE_PATH not set, using default %s", path)
+		}
+		return newFileUserStore(path), nil
+	case "bolt":
+		path := os.Getenv("USER_STORE_PATH")
+		if path == "" {
+			path = "users.db"
+			log.Printf("USER_STORE_PATH not set, using default %s", path)
+		}
+		return newBoltUserStore(path)
+	default:
+		return nil, fmt.Errorf("unknown USER_STORE %q (expected gcs, file or bolt)", backend)
+	}
+}
+
+// documentName derives the file or object name of a named document from the
+// name the users are stored under: users.json -> users.admins.json.
+func documentName(usersName, name string) string {
+	return strings.TrimSuffix(usersName, path.Ext(usersName)) + "." + name + ".json"
+}
+
+// copyUsersConfig returns a shallow copy of users that is safe to hand to a store
+// after configMutex has been released.
+func copyUsersConfig(users UsersConfig) UsersConfig {
+	usersCopy := make(UsersConfig, len(users))
+	for k, v := range users {
+		usersCopy[k] = v
+	}
+	return usersCopy
+}
+
+// persistUsers applies mutate through store.Update and makes the persisted
+// result the new currentUsersConfig. On ErrStoreConflict the in-memory config
+// is refreshed from the store so that a retry by the caller sees fresh data.
+func persistUsers(ctx context.Context, store UserStore, mutate func(users UsersConfig) error) error {
+	persistMutex.Lock()
+	defer persistMutex.Unlock()
+
+	users, err := store.Update(ctx, mutate)
+	if errors.Is(err, ErrStoreConflict) {
+		if latest, loadErr := store.Load(ctx); loadErr == nil {
+			configMutex.Lock()
+			currentUsersConfig = latest
+			configMutex.Unlock()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	configMutex.Lock()
+	currentUsersConfig = users
+	configMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket     = []byte("users")
+	boltDocumentsBucket = []byte("documents") // Named documents, one per key
+)
+
+// boltUserStore keeps one JSON-encoded User per key in an embedded bbolt database,
+// so Put, Delete and Update only write the users that changed.
+type boltUserStore struct {
+	db   *bolt.DB
+	path string
+}
+
+func newBoltUserStore(path string) (*boltUserStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.Open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltUsersBucket, boltDocumentsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return fmt.Errorf("create bucket %s: %v", bucket, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltUserStore{db: db, path: path}, nil
+}
+
+func (s *boltUserStore) Describe() string {
+	return "bolt://" + s.path
+}
+
+func (s *boltUserStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltUserStore) Load(ctx context.Context) (UsersConfig, error) {
+	users := make(UsersConfig)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return fmt.Errorf("json.Unmarshal user %s: %v", k, err)
+			}
+			users[string(k)] = user
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Save replaces the whole bucket with users in a single transaction.
+func (s *boltUserStore) Save(ctx context.Context, users UsersConfig) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltUsersBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(boltUsersBucket)
+		if err != nil {
+			return err
+		}
+		for id, user := range users {
+			data, err := json.Marshal(user)
+			if err != nil {
+				return fmt.Errorf("json.Marshal user %s: %v", id, err)
+			}
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update applies mutate and writes back only the users it added, changed or
+// removed, all within one read-write transaction.
+func (s *boltUserStore) Update(ctx context.Context, mutate func(users UsersConfig) error) (UsersConfig, error) {
+	var users UsersConfig
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsersBucket)
+		before := make(map[string][]byte)
+		users = make(UsersConfig)
+		err := b.ForEach(func(k, v []byte) error {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return fmt.Errorf("json.Unmarshal user %s: %v", k, err)
+			}
+			before[string(k)] = append([]byte(nil), v...)
+			users[string(k)] = user
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := mutate(users); err != nil {
+			return err
+		}
+
+		for id, user := range users {
+			data, err := json.Marshal(user)
+			if err != nil {
+				return fmt.Errorf("json.Marshal user %s: %v", id, err)
+			}
+			if bytes.Equal(before[id], data) {
+				continue
+			}
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		for id := range before {
+			if _, ok := users[id]; !ok {
+				if err := b.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *boltUserStore) Get(ctx context.Context, id string) (User, error) {
+	var user User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltUsersBucket).Get([]byte(id))
+		if data == nil {
+			return ErrUserNotFound
+		}
+		return json.Unmarshal(data, &user)
+	})
+	return user, err
+}
+
+func (s *boltUserStore) Put(ctx context.Context, user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("json.Marshal user %s: %v", user.ID, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Put([]byte(user.ID), data)
+	})
+}
+
+func (s *boltUserStore) Delete(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsersBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrUserNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (s *boltUserStore) LoadDocument(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltDocumentsBucket).Get([]byte(name)); v != nil {
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+// UpdateDocument reads, mutates and writes the document in one read-write transaction.
+func (s *boltUserStore) UpdateDocument(ctx context.Context, name string, mutate func(data []byte) ([]byte, error)) ([]byte, error) {
+	var data []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDocumentsBucket)
+		var current []byte
+		if v := b.Get([]byte(name)); v != nil {
+			current = append([]byte(nil), v...)
+		}
+		var err error
+		if data, err = mutate(current); err != nil {
+			return err
+		}
+		return b.Put([]byte(name), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
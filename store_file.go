@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileUserStore keeps the whole UsersConfig in a local JSON file. Saves are
+// written to a temporary file in the same directory and renamed over the
+// original, so a crash never leaves a half-written file behind.
+type fileUserStore struct {
+	path string
+	mu   sync.Mutex // Serializes read-modify-write cycles of Update
+}
+
+func newFileUserStore(path string) *fileUserStore {
+	return &fileUserStore{path: path}
+}
+
+func (s *fileUserStore) Describe() string {
+	return "file://" + s.path
+}
+
+func (s *fileUserStore) Close() error {
+	return nil
+}
+
+// Load reads the file. A missing file yields an empty UsersConfig.
+func (s *fileUserStore) Load(ctx context.Context) (UsersConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+func (s *fileUserStore) Save(ctx context.Context, users UsersConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(users)
+}
+
+func (s *fileUserStore) Update(ctx context.Context, mutate func(users UsersConfig) error) (UsersConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := mutate(users); err != nil {
+		return nil, err
+	}
+	if err := s.save(users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *fileUserStore) Get(ctx context.Context, id string) (User, error) {
+	users, err := s.Load(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	user, ok := users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *fileUserStore) Put(ctx context.Context, user User) error {
+	_, err := s.Update(ctx, func(users UsersConfig) error {
+		users[user.ID] = user
+		return nil
+	})
+	return err
+}
+
+func (s *fileUserStore) Delete(ctx context.Context, id string) error {
+	_, err := s.Update(ctx, func(users UsersConfig) error {
+		if _, ok := users[id]; !ok {
+			return ErrUserNotFound
+		}
+		delete(users, id)
+		return nil
+	})
+	return err
+}
+
+func (s *fileUserStore) documentPath(name string) string {
+	return filepath.Join(filepath.Dir(s.path), documentName(filepath.Base(s.path), name))
+}
+
+func (s *fileUserStore) LoadDocument(ctx context.Context, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readDocument(name)
+}
+
+func (s *fileUserStore) UpdateDocument(ctx context.Context, name string, mutate func(data []byte) ([]byte, error)) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.readDocument(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err = mutate(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(s.documentPath(name), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *fileUserStore) readDocument(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.documentPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile: %v", err)
+	}
+	return data, nil
+}
+
+func (s *fileUserStore) load() (UsersConfig, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Printf("User store file %s not found, returning empty config", s.path)
+		return make(UsersConfig), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile: %v", err)
+	}
+
+	users := make(UsersConfig)
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %v", err)
+	}
+	return users, nil
+}
+
+func (s *fileUserStore) save(users UsersConfig) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %v", err)
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	log.Printf("Successfully saved config to %s", s.Describe())
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data through a temporary
+// file in the same directory.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once the rename has succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %v", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync %s: %v", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("rename %s to %s: %v", tmpPath, path, err)
+	}
+	return nil
+}
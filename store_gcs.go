@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// gcsMaxUpdateAttempts bounds the reload-and-retry loop of Update when other
+// instances keep winning the generation race.
+const gcsMaxUpdateAttempts = 5
+
+// gcsUserStore keeps the whole UsersConfig as a single JSON object in GCS.
+// A single storage.Client is reused for the lifetime of the store.
+//
+// Every write is conditional on the object generation that was read, so
+// several Cloud Run instances sharing the object cannot silently overwrite
+// each other's changes.
+type gcsUserStore struct {
+	client *storage.Client
+	bucket string
+	object string
+
+	mu         sync.Mutex // Guards generation
+	generation int64      // Generation seen by the last Load/write; 0 if the object did not exist
+}
+
+func newGCSUserStore(ctx context.Context, bucketName, objectName string) (*gcsUserStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	return &gcsUserStore{client: client, bucket: bucketName, object: objectName}, nil
+}
+
+func (s *gcsUserStore) Describe() string {
+	return fmt.Sprintf("gs://%s/%s", s.bucket, s.object)
+}
+
+func (s *gcsUserStore) Close() error {
+	return s.client.Close()
+}
+
+// Load loads the user configuration from GCS and remembers its generation.
+// If the object is not found, it returns an empty UsersConfig and nil error.
+func (s *gcsUserStore) Load(ctx context.Context) (UsersConfig, error) {
+	users, generation, err := s.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.generation = generation
+	s.mu.Unlock()
+	return users, nil
+}
+
+// Save overwrites the object, provided nobody else wrote it since the last
+// Load or write. Otherwise ErrStoreConflict is returned, since a blind Save
+// carries no information on how to merge.
+func (s *gcsUserStore) Save(ctx context.Context, users UsersConfig) error {
+	s.mu.Lock()
+	generation := s.generation
+	s.mu.Unlock()
+
+	newGeneration, err := s.write(ctx, users, generation)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.generation = newGeneration
+	s.mu.Unlock()
+	return nil
+}
+
+// Update reads the object, applies mutate and writes it back with an
+// IfGenerationMatch precondition, starting over when the precondition fails.
+func (s *gcsUserStore) Update(ctx context.Context, mutate func(users UsersConfig) error) (UsersConfig, error) {
+	for attempt := 1; attempt <= gcsMaxUpdateAttempts; attempt++ {
+		users, generation, err := s.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := mutate(users); err != nil {
+			return nil, err
+		}
+
+		newGeneration, err := s.write(ctx, users, generation)
+		if errors.Is(err, ErrStoreConflict) {
+			log.Printf("WARN: %s changed since generation %d, reloading and retrying (attempt %d/%d)", s.Describe(), generation, attempt, gcsMaxUpdateAttempts)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		s.generation = newGeneration
+		s.mu.Unlock()
+		return users, nil
+	}
+	return nil, fmt.Errorf("%s: giving up after %d attempts: %w", s.Describe(), gcsMaxUpdateAttempts, ErrStoreConflict)
+}
+
+func (s *gcsUserStore) Get(ctx context.Context, id string) (User, error) {
+	users, err := s.Load(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	user, ok := users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// Put and Delete rewrite the whole object, since GCS stores all users together.
+func (s *gcsUserStore) Put(ctx context.Context, user User) error {
+	_, err := s.Update(ctx, func(users UsersConfig) error {
+		users[user.ID] = user
+		return nil
+	})
+	return err
+}
+
+func (s *gcsUserStore) Delete(ctx context.Context, id string) error {
+	_, err := s.Update(ctx, func(users UsersConfig) error {
+		if _, ok := users[id]; !ok {
+			return ErrUserNotFound
+		}
+		delete(users, id)
+		return nil
+	})
+	return err
+}
+
+// read returns the stored users together with the object generation.
+func (s *gcsUserStore) read(ctx context.Context) (UsersConfig, int64, error) {
+	data, generation, err := s.readObject(ctx, s.object)
+	if err != nil {
+		return nil, 0, err
+	}
+	users := make(UsersConfig)
+	if data == nil {
+		log.Printf("Object %s in bucket %s not found, returning empty config", s.object, s.bucket)
+		return users, 0, nil
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, 0, fmt.Errorf("json.Unmarshal: %v", err)
+	}
+	return users, generation, nil
+}
+
+// write stores users if the object is still at generation (or still absent
+// when generation is 0) and returns the new generation.
+func (s *gcsUserStore) write(ctx context.Context, users UsersConfig, generation int64) (int64, error) {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("json.MarshalIndent: %v", err)
+	}
+	newGeneration, err := s.writeObject(ctx, s.object, data, generation)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Successfully saved config to %s (generation %d)", s.Describe(), newGeneration)
+	return newGeneration, nil
+}
+
+// LoadDocument reads the document object stored next to the users object.
+func (s *gcsUserStore) LoadDocument(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := s.readObject(ctx, documentName(s.object, name))
+	return data, err
+}
+
+// UpdateDocument rewrites the document object with an IfGenerationMatch
+// precondition, starting over when the precondition fails.
+func (s *gcsUserStore) UpdateDocument(ctx context.Context, name string, mutate func(data []byte) ([]byte, error)) ([]byte, error) {
+	object := documentName(s.object, name)
+	for attempt := 1; attempt <= gcsMaxUpdateAttempts; attempt++ {
+		data, generation, err := s.readObject(ctx, object)
+		if err != nil {
+			return nil, err
+		}
+		data, err = mutate(data)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.writeObject(ctx, object, data, generation)
+		if errors.Is(err, ErrStoreConflict) {
+			log.Printf("WARN: gs://%s/%s changed since generation %d, reloading and retrying (attempt %d/%d)", s.bucket, object, generation, attempt, gcsMaxUpdateAttempts)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("gs://%s/%s: giving up after %d attempts: %w", s.bucket, object, gcsMaxUpdateAttempts, ErrStoreConflict)
+}
+
+// readObject returns the content and generation of an object, or nil data
+// and generation 0 if it does not exist.
+func (s *gcsUserStore) readObject(ctx context.Context, object string) ([]byte, int64, error) {
+	rc, err := s.client.Bucket(s.bucket).Object(object).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("Object(%q).NewReader: %v", object, err)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("ioutil.ReadAll: %v", err)
+	}
+	return data, rc.Attrs.Generation, nil
+}
+
+// writeObject stores data if the object is still at generation (or still
+// absent when generation is 0) and returns the new generation.
+func (s *gcsUserStore) writeObject(ctx context.Context, object string, data []byte, generation int64) (int64, error) {
+	conditions := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		conditions = storage.Conditions{DoesNotExist: true}
+	}
+	wc := s.client.Bucket(s.bucket).Object(object).If(conditions).NewWriter(ctx)
+	wc.ContentType = "application/json"
+	if _, err := wc.Write(data); err != nil {
+		wc.Close()
+		return 0, fmt.Errorf("Writer.Write: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return 0, ErrStoreConflict
+		}
+		return 0, fmt.Errorf("Writer.Close: %v", err)
+	}
+	return wc.Attrs().Generation, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGCS serves the two GCS requests the store makes: XML media reads and
+// multipart uploads with an ifGenerationMatch precondition.
+type fakeGCS struct {
+	mu         sync.Mutex
+	objects    map[string][]byte // Content by object name
+	generation map[string]int64  // Generation by object name
+	next       int64
+}
+
+// newFakeGCS starts a fake GCS and points the storage client at it.
+func newFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+	f := &fakeGCS{objects: make(map[string][]byte), generation: make(map[string]int64)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /upload/storage/v1/b/{bucket}/o", f.upload)
+	mux.HandleFunc("GET /{bucket}/{object...}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		data, ok := f.objects[r.PathValue("object")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(f.generation[r.PathValue("object")], 10))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	return f
+}
+
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	var body [2][]byte // Object metadata and media
+	for i := range body {
+		part, err := parts.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body[i], err = io.ReadAll(part); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	object := r.URL.Query().Get("name")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" && match != strconv.FormatInt(f.generation[object], 10) {
+		writeJSONResponse(w, http.StatusPreconditionFailed, map[string]any{"error": map[string]any{"code": http.StatusPreconditionFailed, "message": "conditionNotMet"}})
+		return
+	}
+	f.next++
+	f.objects[object], f.generation[object] = body[1], f.next
+	writeJSONResponse(w, http.StatusOK, map[string]string{"bucket": r.PathValue("bucket"), "name": object, "generation": strconv.FormatInt(f.next, 10)})
+}
+
+func openTestGCSStore(t *testing.T) *gcsUserStore {
+	t.Helper()
+	store, err := newGCSUserStore(context.Background(), "bucket", "users.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestGCSUserStoreSaveConflict(t *testing.T) {
+	newFakeGCS(t)
+	ctx := context.Background()
+	a, b := openTestGCSStore(t), openTestGCSStore(t)
+
+	if users, err := a.Load(ctx); err != nil || len(users) != 0 {
+		t.Fatalf("Load of a missing object: %v, %v", users, err)
+	}
+	if err := b.Save(ctx, UsersConfig{"b": {ID: "b"}}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// a still thinks the object does not exist.
+	if err := a.Save(ctx, UsersConfig{"a": {ID: "a"}}); !errors.Is(err, ErrStoreConflict) {
+		t.Fatalf("Save over another instance's write: err = %v, want ErrStoreConflict", err)
+	}
+	if _, err := a.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Save(ctx, UsersConfig{"a": {ID: "a"}}); err != nil {
+		t.Fatalf("Save after reloading: %v", err)
+	}
+	if err := b.Save(ctx, UsersConfig{"b": {ID: "b"}}); !errors.Is(err, ErrStoreConflict) {
+		t.Fatalf("Save of the stale instance: err = %v, want ErrStoreConflict", err)
+	}
+}
+
+func TestGCSUserStoreUpdateRetries(t *testing.T) {
+	newFakeGCS(t)
+	ctx := context.Background()
+	a, b := openTestGCSStore(t), openTestGCSStore(t)
+
+	calls := 0
+	users, err := a.Update(ctx, func(users UsersConfig) error {
+		calls++
+		if calls == 1 {
+			// Another instance writes between our read and our write.
+			if err := b.Put(ctx, User{ID: "b"}); err != nil {
+				return err
+			}
+		}
+		users["a"] = User{ID: "a"}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if calls != 2 || len(users) != 2 {
+		t.Fatalf("mutate ran %d times and returned %v, want a retry that keeps both users", calls, users)
+	}
+
+	// An instance that always loses the race gives up.
+	_, err = a.Update(ctx, func(users UsersConfig) error {
+		return b.Put(ctx, User{ID: fmt.Sprintf("b%d", len(users))})
+	})
+	if !errors.Is(err, ErrStoreConflict) {
+		t.Fatalf("Update losing every attempt: err = %v, want ErrStoreConflict", err)
+	}
+}
+
+func TestGCSUserStoreUpdateDocumentRetries(t *testing.T) {
+	newFakeGCS(t)
+	ctx := context.Background()
+	a, b := openTestGCSStore(t), openTestGCSStore(t)
+
+	var seen []string
+	data, err := a.UpdateDocument(ctx, "admins", func(data []byte) ([]byte, error) {
+		seen = append(seen, string(data))
+		if len(seen) == 1 {
+			if _, err := b.UpdateDocument(ctx, "admins", func([]byte) ([]byte, error) { return []byte("b"), nil }); err != nil {
+				return nil, err
+			}
+		}
+		return append(data, 'a'), nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateDocument: %v", err)
+	}
+	if string(data) != "ba" || len(seen) != 2 || seen[1] != "b" {
+		t.Fatalf("UpdateDocument returned %q after seeing %q, want a retry on the other write", data, seen)
+	}
+	if data, err := b.LoadDocument(ctx, "admins"); err != nil || string(data) != "ba" {
+		t.Fatalf("LoadDocument: %q, %v", data, err)
+	}
+	if users, err := b.Load(ctx); err != nil || len(users) != 0 {
+		t.Fatalf("the document was written over the users: %v, %v", users, err)
+	}
+}
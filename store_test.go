@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testStoreBackends opens a store of every backend that needs no server in
+// its own temporary directory.
+var testStoreBackends = []struct {
+	name string
+	open func(t *testing.T) UserStore
+}{
+	{"file", func(t *testing.T) UserStore {
+		return newFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+	}},
+	{"bolt", func(t *testing.T) UserStore {
+		store, err := newBoltUserStore(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+}
+
+func TestUserStoreContract(t *testing.T) {
+	ctx := context.Background()
+	errMutate := errors.New("mutate failed")
+	for _, backend := range testStoreBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+
+			users, err := store.Load(ctx)
+			if err != nil || len(users) != 0 {
+				t.Fatalf("Load of a new store: %v, %v", users, err)
+			}
+			if err := store.Save(ctx, UsersConfig{"a": {ID: "a", TrafficLimitGB: 1}, "b": {ID: "b", TrafficLimitGB: 2}}); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+
+			if err := store.Put(ctx, User{ID: "c", TrafficLimitGB: 3}); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if user, err := store.Get(ctx, "c"); err != nil || user.TrafficLimitGB != 3 {
+				t.Fatalf("Get after Put: %+v, %v", user, err)
+			}
+			if err := store.Delete(ctx, "a"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.Get(ctx, "a"); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Get of a deleted user: err = %v, want ErrUserNotFound", err)
+			}
+			if err := store.Delete(ctx, "a"); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Delete of an unknown user: err = %v, want ErrUserNotFound", err)
+			}
+
+			updated, err := store.Update(ctx, func(users UsersConfig) error {
+				user := users["b"]
+				user.TrafficUsedBytes = 42
+				users["b"] = user
+				delete(users, "c")
+				users["d"] = User{ID: "d"}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if len(updated) != 2 || updated["b"].TrafficUsedBytes != 42 {
+				t.Fatalf("Update returned %+v", updated)
+			}
+
+			// A failing mutate leaves the stored users alone.
+			_, err = store.Update(ctx, func(users UsersConfig) error {
+				delete(users, "b")
+				return errMutate
+			})
+			if !errors.Is(err, errMutate) {
+				t.Fatalf("Update with a failing mutate: err = %v", err)
+			}
+
+			users, err = store.Load(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 2 || users["b"].TrafficUsedBytes != 42 || users["b"].TrafficLimitGB != 2 {
+				t.Fatalf("stored users %+v", users)
+			}
+			if _, ok := users["d"]; !ok {
+				t.Fatal("the user added by Update is missing")
+			}
+		})
+	}
+}
+
+func TestUserStoreDocuments(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range testStoreBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			if data, err := store.LoadDocument(ctx, "admins"); err != nil || data != nil {
+				t.Fatalf("missing document: %q, %v", data, err)
+			}
+			for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+				var seen []byte
+				_, err := store.UpdateDocument(ctx, "admins", func(data []byte) ([]byte, error) {
+					seen = data
+					return []byte(want), nil
+				})
+				if err != nil {
+					t.Fatalf("UpdateDocument: %v", err)
+				}
+				if want == `{"n":2}` && string(seen) != `{"n":1}` {
+					t.Fatalf("mutate saw %q, want the previous content", seen)
+				}
+			}
+			if data, err := store.LoadDocument(ctx, "admins"); err != nil || string(data) != `{"n":2}` {
+				t.Fatalf("LoadDocument: %q, %v", data, err)
+			}
+			// Documents are kept apart from each other and from the users.
+			if data, err := store.LoadDocument(ctx, "sessions"); err != nil || data != nil {
+				t.Fatalf("other document: %q, %v", data, err)
+			}
+			if users, err := store.Load(ctx); err != nil || len(users) != 0 {
+				t.Fatalf("users: %v, %v", users, err)
+			}
+		})
+	}
+}
+
+func TestFileUserStoreLayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := newFileUserStore(filepath.Join(dir, "users.json"))
+	if err := store.Save(ctx, UsersConfig{"a": {ID: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateDocument(ctx, "admins", func([]byte) ([]byte, error) { return []byte("{}"), nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != "users.admins.json" || names[1] != "users.json" {
+		t.Fatalf("files %v, want the users and the admins document and no temporary files", names)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Fatalf("content %q, %v", data, err)
+	}
+
+	// A rename that fails leaves the target as it was and no temporary file.
+	target := filepath.Join(dir, "taken")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(target, []byte("new")); err == nil {
+		t.Fatal("replacing a non-empty directory succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries left in the directory, want the file and the directory", len(entries))
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Subscription output formats selectable with ?format= or by User-Agent.
+const (
+	subFormatBase64  = "base64"  // v2rayN & co: base64 of newline-separated share links
+	subFormatClash   = "clash"   // Clash / Mihomo YAML profile
+	subFormatSingBox = "singbox" // sing-box JSON profile
+)
+
+const subscriptionUpdateIntervalHours = 12
+
+// newSubscriptionToken returns a random, URL-safe token for /sub/{token}.
+func newSubscriptionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// ensureSubscriptionTokens gives every stored user without a token a new one.
+func ensureSubscriptionTokens(ctx context.Context, store UserStore) error {
+	configMutex.RLock()
+	missing := 0
+	for _, user := range currentUsersConfig {
+		if user.SubscriptionToken == "" {
+			missing++
+		}
+	}
+	configMutex.RUnlock()
+	if missing == 0 {
+		return nil
+	}
+
+	log.Printf("Generating subscription tokens for %d user(s)", missing)
+	return persistUsers(ctx, store, func(users UsersConfig) error {
+		for id, user := range users {
+			if user.SubscriptionToken == "" {
+				user.SubscriptionToken = newSubscriptionToken()
+				users[id] = user
+			}
+		}
+		return nil
+	})
+}
+
+// findUserBySubscriptionToken looks up the user owning token. Every token is
+// compared in constant time and the loop does not stop at a match, so the
+// response time tells nothing about how much of a token was guessed right.
+func findUserBySubscriptionToken(token string) (User, bool) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	var found User
+	ok := false
+	for _, user := range currentUsersConfig {
+		if user.SubscriptionToken != "" && subtle.ConstantTimeCompare([]byte(user.SubscriptionToken), []byte(token)) == 1 {
+			found, ok = user, true
+		}
+	}
+	return found, ok
+}
+
+// subscriptionFormat picks the output format from ?format= or the User-Agent.
+func subscriptionFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case subFormatClash, "mihomo":
+		return subFormatClash
+	case subFormatSingBox, "sing-box":
+		return subFormatSingBox
+	case subFormatBase64, "v2rayn":
+		return subFormatBase64
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	switch {
+	case strings.Contains(ua, "clash"), strings.Contains(ua, "mihomo"), strings.Contains(ua, "stash"):
+		return subFormatClash
+	case strings.Contains(ua, "sing-box"), strings.Contains(ua, "sfa"), strings.Contains(ua, "sfi"), strings.Contains(ua, "sfm"):
+		return subFormatSingBox
+	default:
+		return subFormatBase64
+	}
+}
+
+// subscriptionUserinfo formats the Subscription-Userinfo header understood by
+// most clients. Only the total is tracked, so it is reported as download.
+func subscriptionUserinfo(user User) string {
+	total := int64(user.TrafficLimitGB * 1024 * 1024 * 1024)
+	var expire int64
+	if expiresAt, ok := userExpiry(user); ok {
+		expire = expiresAt.Unix()
+	}
+	return fmt.Sprintf("upload=0; download=%d; total=%d; expire=%d", user.TrafficUsedBytes, total, expire)
+}
+
+// subscriptionHandler serves /sub/{token}. It is public: the token is the credential.
+func subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only GET method is allowed"})
+		return
+	}
+
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sub/"), "/")
+	user, ok := findUserBySubscriptionToken(token)
+	if token == "" || !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	endpoint := publicEndpointFromRequest(r)
+	profileName := userProfileName(user)
+	conns := clientConnections(endpoint)
+
+	var body []byte
+	var err error
+	format := subscriptionFormat(r)
+	switch format {
+	case subFormatClash:
+		var profile string
+		profile, err = clashProfile(user, conns, profileName)
+		body = []byte(profile)
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+	case subFormatSingBox:
+		body, err = singBoxProfile(user, conns, profileName)
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		var links []userLink
+		links, err = userShareLinks(user, endpoint, profileName)
+		uris := make([]string, 0, len(links))
+		for _, link := range links {
+			uris = append(uris, link.URI)
+		}
+		body = []byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(uris, "\n"))))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to build %s subscription for user %s: %v", format, user.ID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Subscription-Userinfo", subscriptionUserinfo(user))
+	w.Header().Set("Profile-Update-Interval", fmt.Sprintf("%d", subscriptionUpdateIntervalHours))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", profileName))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+// yamlQuote quotes s as a YAML double-quoted scalar.
+func yamlQuote(s string) string {
+	quoted, _ := json.Marshal(s) // JSON strings are valid YAML double-quoted scalars
+	return string(quoted)
+}
+
+// clashProfile renders a minimal Clash / Mihomo profile with one proxy per connection.
+func clashProfile(user User, conns []clientConnection, name string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated %s\n", time.Now().UTC().Format(time.RFC3339))
+	b.WriteString("mixed-port: 7890\nallow-lan: false\nmode: rule\nlog-level: warning\n")
+	b.WriteString("proxies:\n")
+	names := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		proxyName := connectionName(name, conn, len(conns))
+		names = append(names, proxyName)
+		fmt.Fprintf(&b, "  - name: %s\n", yamlQuote(proxyName))
+		switch conn.Protocol {
+		case protocolVLESS:
+			b.WriteString("    type: vless\n")
+			fmt.Fprintf(&b, "    uuid: %s\n", yamlQuote(user.ID))
+		case protocolVMess:
+			b.WriteString("    type: vmess\n")
+			fmt.Fprintf(&b, "    uuid: %s\n", yamlQuote(user.ID))
+			b.WriteString("    alterId: 0\n    cipher: auto\n")
+		case protocolTrojan:
+			b.WriteString("    type: trojan\n")
+			fmt.Fprintf(&b, "    password: %s\n", yamlQuote(user.TrojanPassword))
+		case protocolShadowsocks:
+			b.WriteString("    type: ss\n")
+			fmt.Fprintf(&b, "    cipher: %s\n", conn.Method)
+			fmt.Fprintf(&b, "    password: %s\n", yamlQuote(ssPassword(user, conn)))
+		default:
+			return "", fmt.Errorf("no Clash proxy type for protocol %q (inbound %s)", conn.Protocol, conn.Tag)
+		}
+		fmt.Fprintf(&b, "    server: %s\n", yamlQuote(conn.Endpoint.Host))
+		fmt.Fprintf(&b, "    port: %d\n", conn.Endpoint.Port)
+		b.WriteString("    udp: true\n")
+		if conn.Protocol == protocolShadowsocks {
+			// Shadowsocks has no transport of its own; WebSocket goes through v2ray-plugin.
+			if conn.Network == networkWS {
+				b.WriteString("    plugin: v2ray-plugin\n    plugin-opts:\n      mode: websocket\n")
+				fmt.Fprintf(&b, "      tls: %t\n", conn.Endpoint.TLS)
+				fmt.Fprintf(&b, "      host: %s\n", yamlQuote(conn.Endpoint.Host))
+				fmt.Fprintf(&b, "      path: %s\n", yamlQuote(conn.Path))
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "    tls: %t\n", conn.Endpoint.TLS)
+		if conn.Endpoint.TLS {
+			if conn.Protocol == protocolTrojan {
+				fmt.Fprintf(&b, "    sni: %s\n", yamlQuote(conn.Endpoint.Host))
+			} else {
+				fmt.Fprintf(&b, "    servername: %s\n", yamlQuote(conn.Endpoint.Host))
+			}
+		}
+		switch conn.Network {
+		case networkWS, networkHTTPUpgrade:
+			b.WriteString("    network: ws\n")
+			b.WriteString("    ws-opts:\n")
+			fmt.Fprintf(&b, "      path: %s\n", yamlQuote(conn.Path))
+			b.WriteString("      headers:\n")
+			fmt.Fprintf(&b, "        Host: %s\n", yamlQuote(conn.Endpoint.Host))
+			if conn.Network == networkHTTPUpgrade {
+				b.WriteString("      v2ray-http-upgrade: true\n")
+			}
+		default:
+			fmt.Fprintf(&b, "    network: %s\n", conn.Network)
+		}
+	}
+	b.WriteString("proxy-groups:\n")
+	b.WriteString("  - name: \"PROXY\"\n    type: select\n    proxies:\n")
+	for _, proxyName := range names {
+		fmt.Fprintf(&b, "      - %s\n", yamlQuote(proxyName))
+	}
+	b.WriteString("      - \"DIRECT\"\n")
+	b.WriteString("rules:\n  - MATCH,PROXY\n")
+	return b.String(), nil
+}
+
+// singBoxProfile renders a minimal sing-box profile with one outbound per
+// connection behind a selector.
+func singBoxProfile(user User, conns []clientConnection, name string) ([]byte, error) {
+	outbounds := make([]interface{}, 0, len(conns)+2)
+	names := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		tag := connectionName(name, conn, len(conns))
+		outbound := map[string]interface{}{
+			"tag":         tag,
+			"server":      conn.Endpoint.Host,
+			"server_port": conn.Endpoint.Port,
+		}
+		switch conn.Protocol {
+		case protocolVLESS:
+			outbound["type"] = "vless"
+			outbound["uuid"] = user.ID
+		case protocolVMess:
+			outbound["type"] = "vmess"
+			outbound["uuid"] = user.ID
+			outbound["security"] = "auto"
+		case protocolTrojan:
+			outbound["type"] = "trojan"
+			outbound["password"] = user.TrojanPassword
+		case protocolShadowsocks:
+			outbound["type"] = "shadowsocks"
+			outbound["method"] = conn.Method
+			outbound["password"] = ssPassword(user, conn)
+		default:
+			return nil, fmt.Errorf("no sing-box outbound type for protocol %q (inbound %s)", conn.Protocol, conn.Tag)
+		}
+		if conn.Protocol == protocolShadowsocks {
+			// Shadowsocks has no transport of its own; WebSocket goes through v2ray-plugin.
+			if conn.Network == networkWS {
+				opts := "mode=websocket;host=" + conn.Endpoint.Host + ";path=" + conn.Path
+				if conn.Endpoint.TLS {
+					opts += ";tls"
+				}
+				outbound["plugin"] = "v2ray-plugin"
+				outbound["plugin_opts"] = opts
+			}
+			outbounds = append(outbounds, outbound)
+			names = append(names, tag)
+			continue
+		}
+		switch conn.Network {
+		case networkWS:
+			outbound["transport"] = map[string]interface{}{
+				"type":    "ws",
+				"path":    conn.Path,
+				"headers": map[string]string{"Host": conn.Endpoint.Host},
+			}
+		case networkHTTPUpgrade:
+			outbound["transport"] = map[string]interface{}{
+				"type": "httpupgrade",
+				"path": conn.Path,
+				"host": conn.Endpoint.Host,
+			}
+		}
+		if conn.Endpoint.TLS {
+			outbound["tls"] = map[string]interface{}{
+				"enabled":     true,
+				"server_name": conn.Endpoint.Host,
+			}
+		}
+		outbounds = append(outbounds, outbound)
+		names = append(names, tag)
+	}
+	outbounds = append(outbounds,
+		map[string]interface{}{"type": "selector", "tag": name, "outbounds": names},
+		map[string]interface{}{"type": "direct", "tag": "direct"},
+	)
+	if len(names) == 1 {
+		// A single outbound needs no selector in front of it.
+		outbounds = append(outbounds[:1], outbounds[2:]...)
+	}
+
+	profile := map[string]interface{}{
+		"log": map[string]interface{}{"level": "warn"},
+		"inbounds": []interface{}{
+			map[string]interface{}{"type": "mixed", "tag": "mixed-in", "listen": "127.0.0.1", "listen_port": 2080},
+		},
+		"outbounds": outbounds,
+		"route":     map[string]interface{}{"final": name},
+	}
+	return json.MarshalIndent(profile, "", "  ")
+}
+
+// rotateSubscriptionTokenHandler issues a new subscription token for a user,
+// invalidating the old /sub/ URL (e.g. after it leaked).
+func rotateSubscriptionTokenHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only POST method is allowed"})
+			return
+		}
+		userID := r.URL.Query().Get("id")
+		if userID == "" {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required in query parameters"})
+			return
+		}
+
+		var previous, rotated User
+		err := persistUsers(r.Context(), store, func(users UsersConfig) error {
+			user, ok := users[userID]
+			if !ok || !userVisibleTo(r.Context(), user) {
+				return ErrUserNotFound
+			}
+			previous = user
+			user.SubscriptionToken = newSubscriptionToken()
+			users[userID] = user
+			rotated = user
+			return nil
+		})
+		if err != nil {
+			log.Printf("ERROR: Failed to rotate subscription token for user %s: %v", userID, err)
+			writeStoreError(w, err)
+			return
+		}
+		recordAudit(r.Context(), "user.rotate_subscription", userID, previous, rotated)
+		writeJSONResponse(w, http.StatusOK, rotated)
+	}
+}
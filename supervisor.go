@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// SupervisorState describes the lifecycle state of the supervised V2Ray process.
+type SupervisorState string
+
+const (
+	SupervisorStarting SupervisorState = "starting" // Process spawned, API not reachable yet
+	SupervisorRunning  SupervisorState = "running"  // API inbound accepts connections
+	SupervisorCrashed  SupervisorState = "crashed"  // Exited unexpectedly, restart pending
+	SupervisorStopped  SupervisorState = "stopped"  // Not running and not scheduled to run
+)
+
+const (
+	v2rayConfigPath         = "/tmp/v2ray_config.json"
+	v2rayStopTimeout        = 10 * time.Second // Grace period before the old process is killed
+	v2rayReadyTimeout       = 30 * time.Second // How long to wait for the API inbound after start
+	v2rayReadyPollInterval  = 200 * time.Millisecond
+	v2rayMinRestartBackoff  = 1 * time.Second
+	v2rayMaxRestartBackoff  = 1 * time.Minute
+	v2rayStableRunThreshold = 1 * time.Minute // A run this long resets the crash backoff
+)
+
+// SupervisorStatus is the snapshot of the supervisor exposed through the API.
+type SupervisorStatus struct {
+	State        SupervisorState `json:"state"`
+	PID          int             `json:"pid,omitempty"`
+	Generation   int             `json:"generation"`    // Incremented on every process start
+	RestartCount int             `json:"restart_count"` // Restarts requested through Restart
+	CrashCount   int             `json:"crash_count"`   // Unexpected exits
+	StartedAt    *time.Time      `json:"started_at,omitempty"`
+	LastExit     string          `json:"last_exit,omitempty"`
+	LastExitAt   *time.Time      `json:"last_exit_at,omitempty"`
+	NextRetryAt  *time.Time      `json:"next_retry_at,omitempty"`
+}
+
+// v2rayProcess tracks a single spawned V2Ray process.
+type v2rayProcess struct {
+	cmd        *exec.Cmd
+	generation int
+	runID      string // Unique across manager restarts, keys persisted traffic counters
+	startedAt  time.Time
+	exited     chan struct{} // Closed once cmd.Wait returns
+	stopping   bool          // Set when the exit was requested by the supervisor
+	killReason string        // Why the supervisor killed a process it treats as crashed
+}
+
+// V2RaySupervisor owns the V2Ray child process: it restarts it on request,
+// waits for the old process to exit before spawning a new one, and brings it
+// back with exponential backoff when it exits unexpectedly.
+type V2RaySupervisor struct {
+	inbounds   []InboundDefinition
+	beforeStop func() // Called while the running process can still be queried, may be nil
+
+	opMutex sync.Mutex // Serializes start/stop/restart operations
+	mu      sync.Mutex // Guards the fields below
+
+	proc         *v2rayProcess
+	state        SupervisorState
+	generation   int
+	restartCount int
+	crashCount   int
+	backoff      time.Duration
+	lastExit     string
+	lastExitAt   time.Time
+	nextRetryAt  time.Time
+	retry        int // Incremented for every scheduled crash restart; only the latest one runs
+}
+
+// NewV2RaySupervisor creates a supervisor for a V2Ray process serving inbounds.
+// beforeStop, if not nil, runs before a running process is deliberately
+// stopped, e.g. to collect its traffic counters.
+func NewV2RaySupervisor(inbounds []InboundDefinition, beforeStop func()) *V2RaySupervisor {
+	return &V2RaySupervisor{
+		inbounds:   inbounds,
+		beforeStop: beforeStop,
+		state:      SupervisorStopped,
+		backoff:    v2rayMinRestartBackoff,
+	}
+}
+
+// Restart stops the current process (if any), waits for it to exit and starts
+// a new one with a freshly generated config.
+func (s *V2RaySupervisor) Restart() error {
+	s.opMutex.Lock()
+	defer s.opMutex.Unlock()
+
+	s.stopLocked()
+
+	s.mu.Lock()
+	if s.generation > 0 {
+		s.restartCount++
+	}
+	s.mu.Unlock()
+
+	return s.startLocked()
+}
+
+// Stop stops the current process and disables crash restarts.
+func (s *V2RaySupervisor) Stop() {
+	s.opMutex.Lock()
+	defer s.opMutex.Unlock()
+	s.stopLocked()
+}
+
+// Status returns a snapshot of the supervisor state.
+func (s *V2RaySupervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SupervisorStatus{
+		State:        s.state,
+		Generation:   s.generation,
+		RestartCount: s.restartCount,
+		CrashCount:   s.crashCount,
+		LastExit:     s.lastExit,
+	}
+	if s.proc != nil {
+		startedAt := s.proc.startedAt
+		status.StartedAt = &startedAt
+		if s.proc.cmd.Process != nil {
+			status.PID = s.proc.cmd.Process.Pid
+		}
+	}
+	if !s.lastExitAt.IsZero() {
+		lastExitAt := s.lastExitAt
+		status.LastExitAt = &lastExitAt
+	}
+	if s.state == SupervisorCrashed && !s.nextRetryAt.IsZero() {
+		nextRetryAt := s.nextRetryAt
+		status.NextRetryAt = &nextRetryAt
+	}
+	return status
+}
+
+// IsRunning reports whether the process is up and its API inbound is reachable.
+func (s *V2RaySupervisor) IsRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == SupervisorRunning
+}
+
+// Generation returns a counter that is incremented every time a process starts.
+func (s *V2RaySupervisor) Generation() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// RunID returns the random ID of the current process, or "" if there is none.
+// Unlike Generation it is never reused, not even by another manager process.
+func (s *V2RaySupervisor) RunID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proc == nil {
+		return ""
+	}
+	return s.proc.runID
+}
+
+// newRunID returns a random ID for a V2Ray process.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// stopLocked terminates the current process and waits for it to exit,
+// killing it after v2rayStopTimeout. Caller must hold opMutex.
+func (s *V2RaySupervisor) stopLocked() {
+	s.mu.Lock()
+	proc := s.proc
+	if proc == nil {
+		s.state = SupervisorStopped
+		s.mu.Unlock()
+		return
+	}
+	running := s.state == SupervisorRunning
+	s.mu.Unlock()
+
+	if running && s.beforeStop != nil {
+		s.beforeStop()
+	}
+
+	s.mu.Lock()
+	proc.stopping = true
+	s.mu.Unlock()
+
+	pid := proc.cmd.Process.Pid
+	log.Printf("Stopping V2Ray process (PID: %d)...", pid)
+	if err := proc.cmd.Process.Signal(os.Interrupt); err != nil {
+		log.Printf("Failed to send interrupt signal to V2Ray process (PID: %d): %v. Attempting to kill.", pid, err)
+		if killErr := proc.cmd.Process.Kill(); killErr != nil {
+			log.Printf("Failed to kill V2Ray process (PID: %d): %v", pid, killErr)
+		}
+	}
+
+	select {
+	case <-proc.exited:
+	case <-time.After(v2rayStopTimeout):
+		log.Printf("V2Ray process (PID: %d) did not exit within %s, killing it", pid, v2rayStopTimeout)
+		if err := proc.cmd.Process.Kill(); err != nil {
+			log.Printf("Failed to kill V2Ray process (PID: %d): %v", pid, err)
+		}
+		<-proc.exited
+	}
+	log.Printf("V2Ray process (PID: %d) stopped", pid)
+
+	s.mu.Lock()
+	s.proc = nil
+	s.state = SupervisorStopped
+	s.mu.Unlock()
+}
+
+// startLocked writes a new config and spawns V2Ray. Caller must hold opMutex.
+func (s *V2RaySupervisor) startLocked() error {
+	configMutex.RLock()
+	usersToConfigure := make(UsersConfig) // Create a deep copy for thread safety
+	for k, v := range currentUsersConfig {
+		usersToConfigure[k] = v
+	}
+	configMutex.RUnlock()
+
+	log.Println("Generating V2Ray config...")
+	v2rayConfigBytes, err := generateV2RayConfig(usersToConfigure, s.inbounds)
+	if err != nil {
+		return fmt.Errorf("failed to generate V2Ray config: %v", err)
+	}
+	if err := ioutil.WriteFile(v2rayConfigPath, v2rayConfigBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write V2Ray config to %s: %v", v2rayConfigPath, err)
+	}
+	log.Printf("V2Ray config written to %s", v2rayConfigPath)
+
+	cmd := exec.Command("v2ray", "-config", v2rayConfigPath)
+	cmd.Stdout = log.Writer()
+	cmd.Stderr = log.Writer()
+
+	s.mu.Lock()
+	s.state = SupervisorStarting
+	s.mu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		s.mu.Lock()
+		s.state = SupervisorStopped
+		s.mu.Unlock()
+		return fmt.Errorf("failed to start V2Ray process: %v", err)
+	}
+
+	s.mu.Lock()
+	s.generation++
+	proc := &v2rayProcess{
+		cmd:        cmd,
+		generation: s.generation,
+		runID:      newRunID(),
+		startedAt:  time.Now().UTC(),
+		exited:     make(chan struct{}),
+	}
+	s.proc = proc
+	s.mu.Unlock()
+	log.Printf("V2Ray process started with PID: %d (generation %d)", cmd.Process.Pid, proc.generation)
+
+	go s.wait(proc)
+	go s.waitReady(proc)
+	return nil
+}
+
+// waitReady polls the API inbound until it accepts connections and then marks
+// the process as running. A process that does not become ready in time is
+// killed, so wait treats it as a crash and restarts it with backoff.
+func (s *V2RaySupervisor) waitReady(proc *v2rayProcess) {
+	deadline := time.Now().Add(v2rayReadyTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-proc.exited:
+			return
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", v2rayGrpcAPIAddress, v2rayReadyPollInterval)
+		if err == nil {
+			conn.Close()
+			s.mu.Lock()
+			if s.proc == proc && s.state == SupervisorStarting {
+				s.state = SupervisorRunning
+			}
+			s.mu.Unlock()
+			// Drop the connection to the previous process so the next API call redials.
+			resetV2RayAPIConnection()
+			log.Printf("V2Ray process (PID: %d) is ready", proc.cmd.Process.Pid)
+			return
+		}
+		time.Sleep(v2rayReadyPollInterval)
+	}
+
+	s.mu.Lock()
+	if s.proc != proc || s.state != SupervisorStarting || proc.stopping {
+		s.mu.Unlock()
+		return // Replaced or being stopped meanwhile
+	}
+	proc.killReason = fmt.Sprintf("API not reachable within %s", v2rayReadyTimeout)
+	s.mu.Unlock()
+
+	log.Printf("ERROR: V2Ray process (PID: %d) API did not become reachable within %s, killing it", proc.cmd.Process.Pid, v2rayReadyTimeout)
+	if err := proc.cmd.Process.Kill(); err != nil {
+		log.Printf("Failed to kill V2Ray process (PID: %d): %v", proc.cmd.Process.Pid, err)
+	}
+}
+
+// wait blocks until the process exits and schedules a restart if the exit was
+// not requested by the supervisor.
+func (s *V2RaySupervisor) wait(proc *v2rayProcess) {
+	err := proc.cmd.Wait()
+	pid := proc.cmd.Process.Pid
+	exitDescription := "exited successfully"
+	if err != nil {
+		exitDescription = err.Error()
+	}
+	close(proc.exited)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proc.killReason != "" {
+		exitDescription = proc.killReason + " (" + exitDescription + ")"
+	}
+
+	s.lastExit = exitDescription
+	s.lastExitAt = time.Now().UTC()
+	if proc.stopping || s.proc != proc {
+		log.Printf("V2Ray process (PID: %d) finished: %s", pid, exitDescription)
+		return
+	}
+
+	s.crashCount++
+	s.state = SupervisorCrashed
+	if time.Since(proc.startedAt) >= v2rayStableRunThreshold {
+		s.backoff = v2rayMinRestartBackoff
+	}
+	delay := s.backoff
+	s.backoff *= 2
+	if s.backoff > v2rayMaxRestartBackoff {
+		s.backoff = v2rayMaxRestartBackoff
+	}
+	log.Printf("ERROR: V2Ray process (PID: %d) exited unexpectedly: %s. Restarting in %s", pid, exitDescription, delay)
+	s.scheduleRetryLocked(delay)
+}
+
+// scheduleRetryLocked arranges for restartAfterCrash to run after delay.
+// Caller must hold mu.
+func (s *V2RaySupervisor) scheduleRetryLocked(delay time.Duration) {
+	s.retry++
+	retry := s.retry
+	s.nextRetryAt = time.Now().UTC().Add(delay)
+	time.AfterFunc(delay, func() { s.restartAfterCrash(retry) })
+}
+
+// restartAfterCrash starts a new process if retry is still the pending crash
+// restart, i.e. nobody restarted or stopped V2Ray in the meantime.
+func (s *V2RaySupervisor) restartAfterCrash(retry int) {
+	s.opMutex.Lock()
+	defer s.opMutex.Unlock()
+
+	s.mu.Lock()
+	if s.state != SupervisorCrashed || s.retry != retry {
+		s.mu.Unlock()
+		return
+	}
+	s.proc = nil // The crashed process has exited
+	s.mu.Unlock()
+
+	if err := s.startLocked(); err != nil {
+		log.Printf("ERROR: Failed to restart crashed V2Ray process: %v", err)
+		s.mu.Lock()
+		s.state = SupervisorCrashed
+		delay := s.backoff
+		s.backoff *= 2
+		if s.backoff > v2rayMaxRestartBackoff {
+			s.backoff = v2rayMaxRestartBackoff
+		}
+		s.scheduleRetryLocked(delay)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a file store in a temporary directory. The registries
+// cached from the stores of other tests are dropped, so that the next lookup
+// reads the new store.
+func newTestStore(t *testing.T) UserStore {
+	t.Helper()
+	admins.mu.Lock()
+	admins.admins, admins.loadedAt = nil, time.Time{}
+	admins.mu.Unlock()
+	apiKeys.mu.Lock()
+	apiKeys.keys, apiKeys.loadedAt, apiKeys.touched = nil, time.Time{}, make(map[string]time.Time)
+	apiKeys.mu.Unlock()
+	securitySettings.mu.Lock()
+	securitySettings.settings, securitySettings.loadedAt = SecuritySettings{}, time.Time{}
+	securitySettings.mu.Unlock()
+	revokedTokens.mu.Lock()
+	revokedTokens.revoked, revokedTokens.loadedAt = nil, time.Time{}
+	revokedTokens.mu.Unlock()
+	return newFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+}
+
+// useTestKeyring signs tokens with a test key for the duration of the test.
+func useTestKeyring(t *testing.T) {
+	t.Helper()
+	previous := jwtKeys
+	jwtKeys = &jwtKeyring{activeKID: "test", keys: map[string][]byte{"test": []byte("test signing key")}}
+	t.Cleanup(func() { jwtKeys = previous })
+}
+
+// addTestAdmin stores admin in the admin registry of store.
+func addTestAdmin(t *testing.T, store UserStore, admin Admin) Admin {
+	t.Helper()
+	if admin.CreatedAt.IsZero() {
+		admin.CreatedAt = time.Now().UTC()
+	}
+	err := admins.update(context.Background(), store, func(registry AdminsConfig) error {
+		registry[adminKey(admin.Username)] = admin
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("admins.update: %v", err)
+	}
+	return admin
+}
+
+// useTestUsers makes users the in-memory users for the duration of the test.
+func useTestUsers(t *testing.T, users UsersConfig) {
+	t.Helper()
+	configMutex.Lock()
+	previous := currentUsersConfig
+	currentUsersConfig = users
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		currentUsersConfig = previous
+		configMutex.Unlock()
+	})
+}
@@ -0,0 +1,875 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Admins may protect their login with a TOTP second factor (RFC 6238 with
+// the parameters authenticator apps expect: HMAC-SHA1, 6 digits, 30-second
+// steps). When an admin has it enabled, or an owner requires it for
+// everyone, the password step of the login only returns a short-lived
+// challenge token, which is exchanged for a session token together with a
+// TOTP code or one of the admin's recovery codes.
+
+const (
+	totpIssuer           = "GCVP"
+	totpPeriod           = 30 // Seconds per time step
+	totpDigits           = 6
+	totpSkew             = 1 // Steps accepted before and after the current one, for clock drift
+	totpSecretBytes      = 20
+	totpQRSize           = 256
+	recoveryCodeCount    = 10
+	challengeTokenTTL    = 5 * time.Minute
+	challengeMaxFailures = 5 // Wrong codes before a challenge token is burned
+	challengePurpose     = "login_2fa"
+	securityDocument     = "security"
+)
+
+// AdminTOTP is the second factor of an admin.
+type AdminTOTP struct {
+	Secret        string     `json:"secret"`  // Base32, as entered into the authenticator app
+	Enabled       bool       `json:"enabled"` // False until the enrollment is confirmed with a code
+	EnabledAt     *time.Time `json:"enabled_at,omitempty"`
+	LastStep      int64      `json:"last_step"`      // Last accepted time step; each code works once
+	RecoveryCodes []string   `json:"recovery_codes"` // SHA-256 hashes of the unused recovery codes
+}
+
+func (a Admin) twoFactorEnabled() bool {
+	return a.TOTP != nil && a.TOTP.Enabled
+}
+
+var (
+	errInvalidSecondFactor = errors.New("invalid two-factor code")
+	errTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	errTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	errTwoFactorNotStarted = errors.New("two-factor enrollment has not been started")
+	errTwoFactorRequired   = errors.New("two-factor authentication is required for all admins")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("crypto/rand: %v", err)
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// totpCode returns the code of the given time step (RFC 4226 section 5.3).
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000) // 10^totpDigits
+}
+
+// matchTOTP returns the time step near now whose code is code. Steps up to
+// lastStep have been used already and never match.
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURL is the otpauth:// URL authenticator apps import, usually as a QR code.
+func totpURL(secret, username string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns fresh recovery codes (xxxxx-xxxxx) and their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("crypto/rand: %v", err)
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// use checks a TOTP code, or a recovery code if code is empty, and marks it
+// used. It must run inside admins.update, so that a code is accepted at
+// most once even with several instances.
+func (t *AdminTOTP) use(code, recoveryCode string, now time.Time) error {
+	if code != "" {
+		step, ok := matchTOTP(t.Secret, code, now, t.LastStep)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		t.LastStep = step
+		return nil
+	}
+	if recoveryCode == "" {
+		return errInvalidSecondFactor
+	}
+	hash := hashRecoveryCode(recoveryCode)
+	for i, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return errInvalidSecondFactor
+}
+
+// SecuritySettings are the login rules owners set for all admins, persisted
+// as the "security" document of the user store.
+type SecuritySettings struct {
+	Require2FA bool `json:"require_2fa"`
+	// SSOExempt leaves SSO admins to the identity provider's own second
+	// factor: they neither have to set up 2FA nor enter its codes. Without
+	// it they go through the panel's second factor after the SSO login.
+	SSOExempt bool `json:"sso_exempt_from_2fa"`
+}
+
+// defaultSecuritySettings apply until owners change them, and to fields a
+// saved document or a PUT body leaves out.
+func defaultSecuritySettings() SecuritySettings {
+	return SecuritySettings{SSOExempt: true}
+}
+
+// ssoExempt reports whether admin is left to the identity provider.
+func (s SecuritySettings) ssoExempt(admin Admin) bool {
+	return admin.OIDCSubject != "" && s.SSOExempt
+}
+
+// requiredFor reports whether owners require 2FA of admin.
+func (s SecuritySettings) requiredFor(admin Admin) bool {
+	return s.Require2FA && !s.ssoExempt(admin)
+}
+
+// secondFactorRequired reports whether admin has to pass the panel's second
+// factor to log in.
+func (s SecuritySettings) secondFactorRequired(admin Admin) bool {
+	return !s.ssoExempt(admin) && (admin.twoFactorEnabled() || s.Require2FA)
+}
+
+// securitySettingsCache caches the settings like adminRegistry caches admins.
+type securitySettingsCache struct {
+	mu       sync.RWMutex
+	settings SecuritySettings
+	loadedAt time.Time
+}
+
+var securitySettings = &securitySettingsCache{}
+
+func decodeSecuritySettings(data []byte) (SecuritySettings, error) {
+	settings := defaultSecuritySettings()
+	if data == nil {
+		return settings, nil
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return SecuritySettings{}, fmt.Errorf("json.Unmarshal security settings: %v", err)
+	}
+	return settings, nil
+}
+
+func (c *securitySettingsCache) set(settings SecuritySettings) {
+	c.mu.Lock()
+	c.settings = settings
+	c.loadedAt = time.Now()
+	c.mu.Unlock()
+}
+
+// get returns the settings, reloading them if the cached copy is older than
+// adminsCacheTTL.
+func (c *securitySettingsCache) get(ctx context.Context, store UserStore) (SecuritySettings, error) {
+	c.mu.RLock()
+	settings, stale := c.settings, time.Since(c.loadedAt) > adminsCacheTTL
+	c.mu.RUnlock()
+	if !stale {
+		return settings, nil
+	}
+	data, err := store.LoadDocument(ctx, securityDocument)
+	if err != nil {
+		return SecuritySettings{}, fmt.Errorf("failed to load security settings from %s: %v", store.Describe(), err)
+	}
+	if settings, err = decodeSecuritySettings(data); err != nil {
+		return SecuritySettings{}, err
+	}
+	c.set(settings)
+	return settings, nil
+}
+
+func (c *securitySettingsCache) update(ctx context.Context, store UserStore, mutate func(settings *SecuritySettings) error) (SecuritySettings, error) {
+	var updated SecuritySettings
+	_, err := store.UpdateDocument(ctx, securityDocument, func(data []byte) ([]byte, error) {
+		settings, err := decodeSecuritySettings(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := mutate(&settings); err != nil {
+			return nil, err
+		}
+		updated = settings
+		return json.MarshalIndent(settings, "", "  ")
+	})
+	if err != nil {
+		return SecuritySettings{}, err
+	}
+	c.set(updated)
+	return updated, nil
+}
+
+// LoginChallengeResponse is returned by the password step of the login when
+// a second factor is needed.
+type LoginChallengeResponse struct {
+	TwoFactorRequired  bool   `json:"two_factor_required"`
+	ChallengeToken     string `json:"challenge_token"`
+	EnrollmentRequired bool   `json:"enrollment_required"` // 2FA is required but not set up yet, see /api/auth/login/2fa/enroll
+	ExpiresIn          int    `json:"expires_in"`          // Seconds
+}
+
+// generateChallengeToken issues the token proving that admin passed the
+// password step. Its "typ" is not an access token's, so jwtAuthMiddleware
+// rejects it.
+func generateChallengeToken(admin Admin) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("crypto/rand: %v", err)
+	}
+	now := time.Now()
+	return jwtKeys.sign(jwt.MapClaims{
+		"username": admin.Username,
+		"typ":      challengePurpose,
+		"jti":      hex.EncodeToString(jti),
+		"exp":      now.Add(challengeTokenTTL).Unix(),
+		"iat":      now.Unix(),
+	})
+}
+
+// loginChallengeClaims identify a validated challenge token.
+type loginChallengeClaims struct {
+	username  string
+	jti       string
+	expiresAt time.Time
+}
+
+// parseChallengeToken validates a challenge token.
+func parseChallengeToken(tokenString string) (loginChallengeClaims, error) {
+	token, err := jwtKeys.parse(tokenString)
+	if err != nil {
+		return loginChallengeClaims{}, err
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	purpose, _ := claims["typ"].(string)
+	username, _ := claims["username"].(string)
+	jti, _ := claims["jti"].(string)
+	if purpose != challengePurpose || username == "" || jti == "" {
+		return loginChallengeClaims{}, errors.New("not a login challenge token")
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return loginChallengeClaims{}, err
+	}
+	return loginChallengeClaims{username: username, jti: jti, expiresAt: exp.Time}, nil
+}
+
+// challengeFailureCounter counts wrong codes per challenge token, so that one
+// password check does not allow guessing codes for its whole lifetime. The
+// counts are per instance.
+type challengeFailureCounter struct {
+	mu       sync.Mutex
+	failures map[string]challengeFailure // By token ID
+}
+
+type challengeFailure struct {
+	count     int
+	expiresAt time.Time
+}
+
+var challengeFailures = &challengeFailureCounter{failures: make(map[string]challengeFailure)}
+
+func (c *challengeFailureCounter) exhausted(jti string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures[jti].count >= challengeMaxFailures
+}
+
+func (c *challengeFailureCounter) record(jti string, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, failure := range c.failures {
+		if now.After(failure.expiresAt) {
+			delete(c.failures, id)
+		}
+	}
+	failure := c.failures[jti]
+	failure.count++
+	failure.expiresAt = expiresAt
+	c.failures[jti] = failure
+}
+
+// loginChallenge returns the challenge the password step must answer with
+// instead of a session token, or nil if admin needs no second factor.
+func loginChallenge(ctx context.Context, store UserStore, admin Admin) (*LoginChallengeResponse, error) {
+	settings, err := securitySettings.get(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.secondFactorRequired(admin) {
+		return nil, nil
+	}
+	token, err := generateChallengeToken(admin)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginChallengeResponse{
+		TwoFactorRequired:  true,
+		ChallengeToken:     token,
+		EnrollmentRequired: !admin.twoFactorEnabled(),
+		ExpiresIn:          int(challengeTokenTTL.Seconds()),
+	}, nil
+}
+
+// TOTPEnrollment is what an admin needs to add the secret to an authenticator app.
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+	QRCode     string `json:"qr_code"` // The otpauth URL as a PNG data: URL
+}
+
+// startEnrollment gives the admin a new, not yet enabled TOTP secret,
+// replacing any unconfirmed one.
+func startEnrollment(ctx context.Context, store UserStore, username string) (TOTPEnrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	var admin Admin
+	err = admins.update(ctx, store, func(registry AdminsConfig) error {
+		var ok bool
+		admin, ok = registry[adminKey(username)]
+		if !ok {
+			return errAdminNotFound
+		}
+		if admin.twoFactorEnabled() {
+			return errTwoFactorEnabled
+		}
+		admin.TOTP = &AdminTOTP{Secret: secret}
+		registry[adminKey(username)] = admin
+		return nil
+	})
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	otpURL := totpURL(secret, admin.Username)
+	png, err := qrcode.Encode(otpURL, qrcode.Medium, totpQRSize)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("failed to encode QR code: %v", err)
+	}
+	log.Printf("INFO: Admin %s started two-factor enrollment", admin.Username)
+	return TOTPEnrollment{
+		Secret:     secret,
+		OTPAuthURL: otpURL,
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// completeSecondFactor checks a TOTP code or recovery code of the admin named
+// username and marks it used. A TOTP code also confirms a pending
+// enrollment; the recovery codes created for it are returned and cannot be
+// shown again.
+func completeSecondFactor(ctx context.Context, store UserStore, username, code, recoveryCode string) (Admin, []string, error) {
+	now := time.Now().UTC()
+	var admin Admin
+	var recoveryCodes []string
+	err := admins.update(ctx, store, func(registry AdminsConfig) error {
+		var ok bool
+		admin, ok = registry[adminKey(username)]
+		if !ok {
+			return errAdminNotFound
+		}
+		if admin.TOTP == nil {
+			return errTwoFactorNotStarted
+		}
+		recoveryCodes = nil
+		if admin.TOTP.Enabled {
+			if err := admin.TOTP.use(code, recoveryCode, now); err != nil {
+				return err
+			}
+		} else {
+			// Recovery codes do not exist before the enrollment is confirmed
+			if err := admin.TOTP.use(code, "", now); err != nil {
+				return err
+			}
+			codes, hashes, err := newRecoveryCodes()
+			if err != nil {
+				return err
+			}
+			admin.TOTP.Enabled = true
+			admin.TOTP.EnabledAt = &now
+			admin.TOTP.RecoveryCodes = hashes
+			recoveryCodes = codes
+		}
+		registry[adminKey(username)] = admin
+		return nil
+	})
+	if err != nil {
+		return Admin{}, nil, err
+	}
+	if recoveryCodes != nil {
+		log.Printf("INFO: Admin %s enabled two-factor authentication", admin.Username)
+	} else if code == "" {
+		log.Printf("WARN: Admin %s used a recovery code, %d left", admin.Username, len(admin.TOTP.RecoveryCodes))
+	}
+	return admin, recoveryCodes, nil
+}
+
+// SecondFactorLoginRequest is the body of POST /api/auth/login/2fa. One of
+// Code and RecoveryCode is required.
+type SecondFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// readSecondFactorRequest decodes the body of the second login step and
+// validates its challenge token, writing the error response itself.
+func readSecondFactorRequest(w http.ResponseWriter, r *http.Request) (SecondFactorLoginRequest, loginChallengeClaims, bool) {
+	var req SecondFactorLoginRequest
+	if r.Method != http.MethodPost {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "Only POST method is allowed"})
+		return req, loginChallengeClaims{}, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
+		return req, loginChallengeClaims{}, false
+	}
+	challenge, err := parseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		log.Printf("Challenge token validation error: %v", err)
+		writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid or expired challenge token; log in again"})
+		return req, loginChallengeClaims{}, false
+	}
+	if challengeFailures.exhausted(challenge.jti) {
+		writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Too many wrong codes; log in again"})
+		return req, loginChallengeClaims{}, false
+	}
+	return req, challenge, true
+}
+
+// loginSecondFactorHandler serves POST /api/auth/login/2fa, the second step
+// of the login: it exchanges a challenge token and a code for a session token.
+func loginSecondFactorHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, challenge, ok := readSecondFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		username := challenge.username
+		admission, ok := logins.admit(w, r, username)
+		if !ok {
+			return
+		}
+		defer logins.release(r, admission) // Unless it failed or succeeded
+
+		admin, recoveryCodes, err := completeSecondFactor(r.Context(), store, username, req.Code, req.RecoveryCode)
+		switch {
+		case errors.Is(err, errInvalidSecondFactor):
+			challengeFailures.record(challenge.jti, challenge.expiresAt)
+			logins.fail(r, admission, username, "wrong two-factor code")
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Invalid two-factor code"})
+			return
+		case errors.Is(err, errAdminNotFound):
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Admin account no longer exists"})
+			return
+		case errors.Is(err, errTwoFactorNotStarted):
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Set up two-factor authentication first (POST /api/auth/login/2fa/enroll)"})
+			return
+		case err != nil:
+			log.Printf("ERROR: Failed to check two-factor code of admin %s: %v", username, err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to check two-factor code"})
+			return
+		}
+
+		tokens, err := startSession(r, store, admin)
+		if err != nil {
+			log.Printf("ERROR: Failed to start session: %v", err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+			return
+		}
+		tokens.RecoveryCodes = recoveryCodes
+		if recoveryCodes != nil {
+			recordAuditEvent(AuditEvent{Actor: admin.Username, Action: "admin.2fa_enable", Target: admin.Username, IP: logins.clientIP(r)})
+		} else if req.Code == "" {
+			logSecurityEvent("recovery_code_used", admin.Username, logins.clientIP(r), fmt.Sprintf("%d left", len(admin.TOTP.RecoveryCodes)))
+		}
+		logins.succeed(r, admission, admin.Username)
+		writeJSONResponse(w, http.StatusOK, tokens)
+	}
+}
+
+// loginEnrollHandler serves POST /api/auth/login/2fa/enroll: admins who must
+// use 2FA but have not set it up get their secret with the challenge token,
+// and confirm it with their first code at /api/auth/login/2fa.
+func loginEnrollHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, challenge, ok := readSecondFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		username := challenge.username
+
+		enrollment, err := startEnrollment(r.Context(), store, username)
+		switch {
+		case errors.Is(err, errTwoFactorEnabled):
+			writeJSONResponse(w, http.StatusConflict, map[string]string{"error": "Two-factor authentication is already enabled"})
+		case errors.Is(err, errAdminNotFound):
+			writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "Admin account no longer exists"})
+		case err != nil:
+			log.Printf("ERROR: Failed to start two-factor enrollment of admin %s: %v", username, err)
+			writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "Failed to start two-factor enrollment"})
+		default:
+			writeJSONResponse(w, http.StatusOK, enrollment)
+		}
+	}
+}
+
+// twoFactorMissing reports whether owners require 2FA and admin has not set
+// it up. SSO admins are exempt if the settings say so.
+func twoFactorMissing(ctx context.Context, store UserStore, admin Admin) (bool, error) {
+	if admin.twoFactorEnabled() {
+		return false, nil
+	}
+	settings, err := securitySettings.get(ctx, store)
+	if err != nil {
+		return false, err
+	}
+	return settings.requiredFor(admin), nil
+}
+
+// twoFactorSetupMissing reports whether the request must be rejected because
+// owners require 2FA and admin has not set it up. The /api/v2/me routes stay
+// open, since they are needed to set it up, and so does logging out.
+func twoFactorSetupMissing(store UserStore, admin Admin, r *http.Request) (bool, error) {
+	if r.URL.Path == "/api/v2/me" || strings.HasPrefix(r.URL.Path, "/api/v2/me/") || r.URL.Path == "/api/auth/logout" {
+		return false, nil
+	}
+	return twoFactorMissing(r.Context(), store, admin)
+}
+
+// TwoFactorCodeRequest is the body of the /api/v2/me/2fa routes that need a
+// current code or the password.
+type TwoFactorCodeRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// twoFactorStatus is returned by GET /api/v2/me/2fa.
+type twoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	Pending           bool `json:"pending"` // Enrollment started but not confirmed
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	Required          bool `json:"required"` // Owners require 2FA for every admin
+}
+
+// registerTwoFactorRoutes adds the second login step, the self-service 2FA
+// routes and the owner settings to mux.
+func registerTwoFactorRoutes(mux *http.ServeMux, store UserStore) {
+	mux.HandleFunc("/api/auth/login/2fa", loginSecondFactorHandler(store))
+	mux.HandleFunc("/api/auth/login/2fa/enroll", loginEnrollHandler(store))
+
+	self := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, jwtAuthMiddleware(store, requireSession(handler)))
+	}
+	self("GET /api/v2/me/2fa", twoFactorStatusHandler(store))
+	self("POST /api/v2/me/2fa/enroll", enrollTwoFactorHandler(store))
+	self("POST /api/v2/me/2fa/confirm", confirmTwoFactorHandler(store))
+	self("POST /api/v2/me/2fa/recovery-codes", regenerateRecoveryCodesHandler(store))
+	self("POST /api/v2/me/2fa/disable", disableTwoFactorHandler(store))
+
+	manage := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, jwtAuthMiddleware(store, requireSession(requirePermission(PermAdminsManage, handler))))
+	}
+	manage("DELETE /api/v2/admins/{username}/2fa", resetTwoFactorHandler(store))
+	manage("GET /api/v2/settings/security", getSecuritySettingsHandler(store))
+	manage("PUT /api/v2/settings/security", updateSecuritySettingsHandler(store))
+}
+
+func twoFactorStatusHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := adminIdentityFromContext(r.Context())
+		admin, ok, err := admins.lookup(r.Context(), store, id.Username)
+		if err == nil && !ok {
+			err = errAdminNotFound
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		settings, err := securitySettings.get(r.Context(), store)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, err.Error())
+			return
+		}
+		status := twoFactorStatus{Required: settings.requiredFor(admin)}
+		if admin.TOTP != nil {
+			status.Enabled = admin.TOTP.Enabled
+			status.Pending = !admin.TOTP.Enabled
+			status.RecoveryCodesLeft = len(admin.TOTP.RecoveryCodes)
+		}
+		writeJSONResponse(w, http.StatusOK, status)
+	}
+}
+
+func enrollTwoFactorHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := adminIdentityFromContext(r.Context())
+		enrollment, err := startEnrollment(r.Context(), store, id.Username)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, enrollment)
+	}
+}
+
+func confirmTwoFactorHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TwoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		id, _ := adminIdentityFromContext(r.Context())
+		admin, ok, err := admins.lookup(r.Context(), store, id.Username)
+		if err == nil && !ok {
+			err = errAdminNotFound
+		}
+		if err == nil && admin.twoFactorEnabled() {
+			err = errTwoFactorEnabled
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		_, recoveryCodes, err := completeSecondFactor(r.Context(), store, id.Username, req.Code, "")
+		if err == nil && recoveryCodes == nil {
+			err = errTwoFactorEnabled // Confirmed concurrently
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		recordAudit(r.Context(), "admin.2fa_enable", id.Username, nil, nil)
+		writeJSONResponse(w, http.StatusOK, map[string][]string{"recovery_codes": recoveryCodes})
+	}
+}
+
+func regenerateRecoveryCodesHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TwoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		id, _ := adminIdentityFromContext(r.Context())
+		now := time.Now().UTC()
+		err = admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			admin, ok := registry[adminKey(id.Username)]
+			if !ok {
+				return errAdminNotFound
+			}
+			if !admin.twoFactorEnabled() {
+				return errTwoFactorNotEnabled
+			}
+			if err := admin.TOTP.use(req.Code, "", now); err != nil {
+				return err
+			}
+			admin.TOTP.RecoveryCodes = hashes
+			registry[adminKey(id.Username)] = admin
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("INFO: Admin %s generated new recovery codes", id.Username)
+		recordAudit(r.Context(), "admin.2fa_recovery_codes", id.Username, nil, nil)
+		writeJSONResponse(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+func disableTwoFactorHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TwoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		settings, err := securitySettings.get(r.Context(), store)
+		if err == nil && settings.Require2FA {
+			err = errTwoFactorRequired
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		id, _ := adminIdentityFromContext(r.Context())
+		err = admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			admin, ok := registry[adminKey(id.Username)]
+			if !ok {
+				return errAdminNotFound
+			}
+			if admin.TOTP == nil {
+				return errTwoFactorNotEnabled
+			}
+			if !admin.checkPassword(req.Password) {
+				return invalidRequestf("password is wrong")
+			}
+			admin.TOTP = nil
+			registry[adminKey(id.Username)] = admin
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("INFO: Admin %s disabled two-factor authentication", id.Username)
+		recordAudit(r.Context(), "admin.2fa_disable", id.Username, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// resetTwoFactorHandler serves DELETE /api/v2/admins/{username}/2fa, for
+// admins who lost their authenticator and recovery codes. If 2FA is
+// required, they have to set it up again at their next login.
+func resetTwoFactorHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := adminKey(r.PathValue("username"))
+		err := admins.update(r.Context(), store, func(registry AdminsConfig) error {
+			admin, ok := registry[key]
+			if !ok {
+				return errAdminNotFound
+			}
+			if admin.TOTP == nil {
+				return errTwoFactorNotEnabled
+			}
+			admin.TOTP = nil
+			registry[key] = admin
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		actor, _ := adminIdentityFromContext(r.Context())
+		log.Printf("INFO: Admin %s reset two-factor authentication of admin %s", actor.Username, r.PathValue("username"))
+		recordAudit(r.Context(), "admin.2fa_reset", r.PathValue("username"), nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func getSecuritySettingsHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings, err := securitySettings.get(r.Context(), store)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, err.Error())
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, settings)
+	}
+}
+
+func updateSecuritySettingsHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := defaultSecuritySettings()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidRequest, "Invalid request body: "+err.Error())
+			return
+		}
+		id, _ := adminIdentityFromContext(r.Context())
+		if req.Require2FA {
+			// Owners must not lock themselves out of the setting
+			admin, ok, err := admins.lookup(r.Context(), store, id.Username)
+			if err == nil && (!ok || !admin.twoFactorEnabled()) {
+				err = invalidRequestf("enable two-factor authentication for your own account first")
+			}
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+		}
+
+		var previous SecuritySettings
+		settings, err := securitySettings.update(r.Context(), store, func(settings *SecuritySettings) error {
+			previous = *settings
+			*settings = req
+			return nil
+		})
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("INFO: Admin %s set require_2fa to %t, sso_exempt_from_2fa to %t", id.Username, settings.Require2FA, settings.SSOExempt)
+		recordAudit(r.Context(), "settings.security", "", previous, settings)
+		writeJSONResponse(w, http.StatusOK, settings)
+	}
+}
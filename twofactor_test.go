@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTOTPKey = []byte("12345678901234567890") // The RFC 6238 SHA-1 test key
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(testTOTPKey, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTPWindow(t *testing.T) {
+	secret := base32NoPadding.EncodeToString(testTOTPKey)
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		offset   int64 // Step of the code relative to now
+		lastStep int64
+		want     bool
+	}{
+		{"current step", 0, 0, true},
+		{"previous step", -1, 0, true},
+		{"next step", 1, 0, true},
+		{"two steps behind", -2, 0, false},
+		{"two steps ahead", 2, 0, false},
+		{"already used", 0, current, false},
+		{"older than the last used", -1, current, false},
+		{"newer than the last used", 1, current, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := totpCode(testTOTPKey, current+tt.offset)
+			step, ok := matchTOTP(secret, code, now, tt.lastStep)
+			if ok != tt.want {
+				t.Fatalf("matchTOTP ok = %v, want %v", ok, tt.want)
+			}
+			if ok && step != current+tt.offset {
+				t.Errorf("matchTOTP step = %d, want %d", step, current+tt.offset)
+			}
+		})
+	}
+
+	if _, ok := matchTOTP(secret, "12345", now, 0); ok {
+		t.Error("a code of the wrong length matched")
+	}
+	spaced := totpCode(testTOTPKey, current)
+	if _, ok := matchTOTP(strings.ToLower(secret), spaced[:3]+" "+spaced[3:], now, 0); !ok {
+		t.Error("a code with a space or a lower-case secret did not match")
+	}
+}
+
+func TestAdminTOTPUseRejectsReplay(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := &AdminTOTP{Secret: base32NoPadding.EncodeToString(testTOTPKey), Enabled: true}
+	code := totpCode(testTOTPKey, now.Unix()/totpPeriod)
+
+	if err := totp.use(code, "", now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := totp.use(code, "", now); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("replayed code: err = %v, want errInvalidSecondFactor", err)
+	}
+	// The previous step is inside the window but older than the code just used.
+	previous := totpCode(testTOTPKey, now.Unix()/totpPeriod-1)
+	if err := totp.use(previous, "", now); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("older code: err = %v, want errInvalidSecondFactor", err)
+	}
+	next := now.Add(totpPeriod * time.Second)
+	if err := totp.use(totpCode(testTOTPKey, next.Unix()/totpPeriod), "", next); err != nil {
+		t.Fatalf("code of the next step: %v", err)
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	totp := &AdminTOTP{Secret: base32NoPadding.EncodeToString(testTOTPKey), Enabled: true, RecoveryCodes: hashes}
+	now := time.Now()
+
+	// Recovery codes are accepted without the dash and in upper case.
+	typed := strings.ToUpper(strings.ReplaceAll(codes[3], "-", ""))
+	if err := totp.use("", typed, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if len(totp.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Fatalf("%d recovery codes left, want %d", len(totp.RecoveryCodes), recoveryCodeCount-1)
+	}
+	if err := totp.use("", codes[3], now); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("second use: err = %v, want errInvalidSecondFactor", err)
+	}
+	if err := totp.use("", "aaaaa-bbbbb", now); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("unknown code: err = %v, want errInvalidSecondFactor", err)
+	}
+	if err := totp.use("", "", now); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("no code: err = %v, want errInvalidSecondFactor", err)
+	}
+	// The other codes still work, and the original slice is left alone.
+	if err := totp.use("", codes[4], now); err != nil {
+		t.Fatalf("another code: %v", err)
+	}
+	if hashes[3] != hashRecoveryCode(codes[3]) {
+		t.Fatal("the caller's hash slice was modified")
+	}
+}
+
+func TestChallengeFailureCap(t *testing.T) {
+	counter := &challengeFailureCounter{failures: make(map[string]challengeFailure)}
+	expiresAt := time.Now().Add(challengeTokenTTL)
+
+	for i := 1; i <= challengeMaxFailures; i++ {
+		if counter.exhausted("a") {
+			t.Fatalf("exhausted after %d failures, want %d", i-1, challengeMaxFailures)
+		}
+		counter.record("a", expiresAt)
+	}
+	if !counter.exhausted("a") {
+		t.Fatalf("not exhausted after %d failures", challengeMaxFailures)
+	}
+	if counter.exhausted("b") {
+		t.Fatal("another challenge was exhausted too")
+	}
+
+	// Failures of expired challenges are dropped on the next record.
+	counter.record("old", time.Now().Add(-time.Second))
+	counter.record("b", expiresAt)
+	if _, ok := counter.failures["old"]; ok {
+		t.Fatal("the failures of an expired challenge were kept")
+	}
+}
+
+func TestChallengeToken(t *testing.T) {
+	useTestKeyring(t)
+	admin := Admin{Username: "alice", Role: AdminRoleOwner}
+
+	token, err := generateChallengeToken(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseChallengeToken(token)
+	if err != nil {
+		t.Fatalf("parseChallengeToken: %v", err)
+	}
+	if claims.username != "alice" || claims.jti == "" || time.Until(claims.expiresAt) > challengeTokenTTL {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	access, err := generateJWT(admin, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseChallengeToken(access); err == nil {
+		t.Fatal("an access token was accepted as a login challenge")
+	}
+}
+
+func TestCompleteSecondFactor(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	addTestAdmin(t, store, Admin{Username: "alice", Role: AdminRoleOwner})
+
+	if _, _, err := completeSecondFactor(ctx, store, "alice", "000000", ""); !errors.Is(err, errTwoFactorNotStarted) {
+		t.Fatalf("before enrollment: err = %v, want errTwoFactorNotStarted", err)
+	}
+	enrollment, err := startEnrollment(ctx, store, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := base32NoPadding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	admin, recoveryCodes, err := completeSecondFactor(ctx, store, "alice", code, "")
+	if err != nil {
+		t.Fatalf("confirming the enrollment: %v", err)
+	}
+	if !admin.twoFactorEnabled() || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("enabled = %v with %d recovery codes", admin.twoFactorEnabled(), len(recoveryCodes))
+	}
+	if _, _, err := completeSecondFactor(ctx, store, "alice", code, ""); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("replayed code: err = %v, want errInvalidSecondFactor", err)
+	}
+	if _, _, err := completeSecondFactor(ctx, store, "alice", "", recoveryCodes[0]); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if _, _, err := completeSecondFactor(ctx, store, "alice", "", recoveryCodes[0]); !errors.Is(err, errInvalidSecondFactor) {
+		t.Fatalf("reused recovery code: err = %v, want errInvalidSecondFactor", err)
+	}
+	if _, err := startEnrollment(ctx, store, "alice"); !errors.Is(err, errTwoFactorEnabled) {
+		t.Fatalf("enrolling again: err = %v, want errTwoFactorEnabled", err)
+	}
+}
+
+func TestSecuritySettingsSSOExemption(t *testing.T) {
+	// Documents saved before the setting existed keep SSO admins exempt.
+	for _, data := range [][]byte{nil, []byte(`{"require_2fa":true}`)} {
+		settings, err := decodeSecuritySettings(data)
+		if err != nil || !settings.SSOExempt {
+			t.Errorf("decoding %q: %+v, %v", data, settings, err)
+		}
+	}
+
+	enrolled := &AdminTOTP{Secret: "AAAA", Enabled: true}
+	tests := []struct {
+		name         string
+		settings     SecuritySettings
+		admin        Admin
+		wantRequired bool // requiredFor
+		wantLogin    bool // secondFactorRequired
+	}{
+		{"password admin", SecuritySettings{}, Admin{}, false, false},
+		{"password admin with 2FA", SecuritySettings{}, Admin{TOTP: enrolled}, false, true},
+		{"password admin, 2FA required", SecuritySettings{Require2FA: true, SSOExempt: true}, Admin{}, true, true},
+		{"exempt SSO admin", SecuritySettings{Require2FA: true, SSOExempt: true}, Admin{OIDCSubject: "sub"}, false, false},
+		{"exempt SSO admin with 2FA", SecuritySettings{SSOExempt: true}, Admin{OIDCSubject: "sub", TOTP: enrolled}, false, false},
+		{"SSO admin, 2FA required", SecuritySettings{Require2FA: true}, Admin{OIDCSubject: "sub"}, true, true},
+		{"SSO admin with 2FA", SecuritySettings{}, Admin{OIDCSubject: "sub", TOTP: enrolled}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.requiredFor(tt.admin); got != tt.wantRequired {
+				t.Errorf("requiredFor = %v, want %v", got, tt.wantRequired)
+			}
+			if got := tt.settings.secondFactorRequired(tt.admin); got != tt.wantLogin {
+				t.Errorf("secondFactorRequired = %v, want %v", got, tt.wantLogin)
+			}
+		})
+	}
+}
@@ -3,7 +3,10 @@ import { createPinia } from 'pinia' // Импорт Pinia
 import App from './App.vue'
 import router from './router'
 
+import { useAuthStore } from './stores/auth'
+
 const app = createApp(App)
 app.use(createPinia()) // Подключение Pinia
 app.use(router)
-app.mount('#app')
+// Сначала обновляем сохраненный токен, чтобы первые запросы не получили 401
+useAuthStore().restoreSession().finally(() => app.mount('#app'))
@@ -19,36 +19,167 @@ apiClient.interceptors.request.use(config => {
 });
 
 
+// Таймер обновления access-токена (он живет 15 минут) с помощью refresh-токена.
+let refreshTimer = null;
+
 export const useAuthStore = defineStore('auth', {
   state: () => ({
     token: localStorage.getItem('authToken') || null,
+    refreshToken: localStorage.getItem('refreshToken') || null,
     username: null, // Можно хранить имя пользователя или другие данные
+    challenge: null, // Второй шаг входа (2FA): { token, enrollmentRequired }
+    sso: null, // Адрес входа через SSO, если он настроен на сервере
     error: null
   }),
   getters: {
     isAuthenticated: (state) => !!state.token,
   },
   actions: {
+    // Возвращает true при успешном входе, 'two_factor', если нужен код 2FA
+    // (см. verifySecondFactor), и false при ошибке.
     async login(credentials) {
       try {
         const response = await apiClient.post('/auth/login', credentials);
-        this.token = response.data.token;
-        localStorage.setItem('authToken', response.data.token);
+        this.error = null;
+        if (response.data.two_factor_required) {
+          this.challenge = {
+            token: response.data.challenge_token,
+            enrollmentRequired: response.data.enrollment_required,
+          };
+          return 'two_factor';
+        }
+        this.setTokens(response.data);
         // Можно попытаться получить данные пользователя, если API их возвращает или есть отдельный эндпоинт
         // this.username = ...
-        this.error = null;
         return true;
       } catch (error) {
-        this.token = null;
-        localStorage.removeItem('authToken');
+        this.clearTokens();
         this.error = error.response?.data?.error || 'Ошибка входа';
         return false;
       }
     },
-    logout() {
+    // Получает секрет и QR-код для настройки 2FA, если владелец требует ее, а она еще не настроена.
+    async startEnrollment() {
+      try {
+        const response = await apiClient.post('/auth/login/2fa/enroll', { challenge_token: this.challenge.token });
+        this.error = null;
+        return response.data;
+      } catch (error) {
+        this.error = error.response?.data?.error || 'Не удалось начать настройку 2FA';
+        return null;
+      }
+    },
+    // Второй шаг входа: код из приложения ({ code }) или резервный код ({ recovery_code }).
+    // Возвращает ответ сервера (с recovery_codes после настройки 2FA) или null при ошибке.
+    async verifySecondFactor(codes) {
+      try {
+        const response = await apiClient.post('/auth/login/2fa', { challenge_token: this.challenge.token, ...codes });
+        this.setTokens(response.data);
+        this.challenge = null;
+        this.error = null;
+        return response.data;
+      } catch (error) {
+        this.error = error.response?.data?.error || 'Неверный код';
+        if (error.response?.status === 401 && this.error !== 'Invalid two-factor code') {
+          this.challenge = null; // Вызов истек или исчерпан, нужно заново ввести пароль
+        }
+        return null;
+      }
+    },
+    // Сохраняет пару токенов из ответа входа или обновления и планирует
+    // следующее обновление за минуту до истечения access-токена.
+    async loadSSO() {
+      try {
+        const response = await apiClient.get('/auth/oidc');
+        this.sso = response.data.enabled ? response.data.login_url : null;
+      } catch (error) {
+        this.sso = null;
+      }
+    },
+    // Сервер возвращает результат входа через SSO во фрагменте URL страницы входа.
+    // Возвращает 'two_factor', если владелец не освободил SSO-администраторов от 2FA.
+    completeSSO(fragment) {
+      const params = new URLSearchParams(fragment);
+      if (params.get('sso_error')) {
+        this.error = params.get('sso_error');
+        return false;
+      }
+      if (params.get('challenge_token')) {
+        this.challenge = {
+          token: params.get('challenge_token'),
+          enrollmentRequired: params.get('enrollment_required') === 'true',
+        };
+        this.error = null;
+        return 'two_factor';
+      }
+      if (!params.get('token')) {
+        return false;
+      }
+      this.setTokens({
+        token: params.get('token'),
+        refresh_token: params.get('refresh_token'),
+        expires_in: Number(params.get('expires_in')),
+      });
+      this.error = null;
+      return true;
+    },
+    setTokens(data) {
+      this.token = data.token;
+      this.refreshToken = data.refresh_token;
+      localStorage.setItem('authToken', data.token);
+      localStorage.setItem('refreshToken', data.refresh_token);
+      clearTimeout(refreshTimer);
+      const delay = Math.max((data.expires_in - 60) * 1000, 10000);
+      refreshTimer = setTimeout(() => this.refresh(), delay);
+    },
+    clearTokens() {
+      clearTimeout(refreshTimer);
       this.token = null;
-      this.username = null;
+      this.refreshToken = null;
       localStorage.removeItem('authToken');
+      localStorage.removeItem('refreshToken');
+    },
+    // Получает новую пару токенов. Refresh-токен одноразовый: после ошибки нужно войти заново.
+    async refresh() {
+      // Другая вкладка могла уже обменять токен: берем последний сохраненный
+      this.refreshToken = localStorage.getItem('refreshToken');
+      if (!this.refreshToken) {
+        this.clearTokens();
+        return false;
+      }
+      try {
+        const response = await apiClient.post('/auth/refresh', { refresh_token: this.refreshToken });
+        this.setTokens(response.data);
+        return true;
+      } catch (error) {
+        if (error.response) {
+          this.clearTokens(); // Сессия завершена или отозвана
+        } else {
+          refreshTimer = setTimeout(() => this.refresh(), 30000); // Сеть недоступна, повторим позже
+        }
+        return false;
+      }
+    },
+    // Вызывается при запуске приложения: сохраненный access-токен мог истечь, пока вкладка была закрыта.
+    async restoreSession() {
+      if (this.refreshToken) {
+        await this.refresh();
+      } else if (this.token) {
+        this.clearTokens(); // Токен старого формата без refresh-токена
+      }
+    },
+    // all = true завершает все сессии администратора, а не только текущую.
+    async logout(all = false) {
+      if (this.token) {
+        try {
+          await apiClient.post('/auth/logout', { all });
+        } catch (error) {
+          // Токены все равно удаляются локально
+        }
+      }
+      this.clearTokens();
+      this.username = null;
+      this.challenge = null;
       // Перенаправление на страницу входа может быть сделано в компоненте или роутере
     },
     // Можно добавить действие для проверки токена при загрузке приложения
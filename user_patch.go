@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errInvalidRequest marks a request rejected while being applied to the
+// stored user. writeStoreError reports it as 400.
+var errInvalidRequest = errors.New("invalid request")
+
+// optionalTime distinguishes an absent JSON field (Set is false) from an
+// explicit null (Set is true, Value is nil).
+type optionalTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (o *optionalTime) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	o.Value = nil
+	if string(data) == "null" {
+		return nil
+	}
+	var t time.Time
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	t = t.UTC()
+	o.Value = &t
+	return nil
+}
+
+// UserPatch holds the client-editable fields of a user. A nil pointer (or an
+// unset optionalTime) means the field was not sent and is left unchanged.
+// Read-only fields such as id or created_at are ignored, so the body of a
+// GET can be sent back as is.
+type UserPatch struct {
+	TrafficLimitGB       *float64              `json:"traffic_limit_gb"`
+	TrafficUsedBytes     *int64                `json:"traffic_used_bytes"`
+	TimeLimitDays        *int                  `json:"time_limit_days"` // Converted into expires_at, see applyTimeLimitDays
+	ExpiresAt            optionalTime          `json:"expires_at"`      // null removes the time limit unless time_limit_days sets one
+	Status               *UserStatus           `json:"status"`
+	IsActive             *bool                 `json:"is_active"` // Shorthand for status, see applyUserPatch
+	TrafficResetStrategy *TrafficResetStrategy `json:"traffic_reset_strategy"`
+	OnHoldExpireAt       optionalTime          `json:"on_hold_expire_at"`
+	Username             *string               `json:"username"` // "" removes it; the V2Ray email tag is kept
+	Note                 *string               `json:"note"`
+	Contact              *string               `json:"contact"`
+	Labels               *[]string             `json:"labels"`
+}
+
+// missingForReplace lists the fields a PUT must contain.
+func (p UserPatch) missingForReplace() []string {
+	var missing []string
+	if p.TrafficLimitGB == nil {
+		missing = append(missing, "traffic_limit_gb")
+	}
+	if p.TrafficUsedBytes == nil {
+		missing = append(missing, "traffic_used_bytes")
+	}
+	if !p.ExpiresAt.Set {
+		missing = append(missing, "expires_at")
+	}
+	if p.Status == nil {
+		missing = append(missing, "status")
+	}
+	if p.TrafficResetStrategy == nil {
+		missing = append(missing, "traffic_reset_strategy")
+	}
+	return missing
+}
+
+// asReplacement checks that a PUT body sets every required field and resets
+// the optional fields it leaves out.
+func (p *UserPatch) asReplacement() error {
+	if missing := p.missingForReplace(); len(missing) > 0 {
+		return invalidRequestf("PUT replaces the user and requires: %s. Use PATCH for partial updates", strings.Join(missing, ", "))
+	}
+	if p.TimeLimitDays == nil {
+		p.TimeLimitDays = new(int)
+	}
+	if !p.OnHoldExpireAt.Set {
+		p.OnHoldExpireAt.Set = true
+	}
+	for _, field := range []**string{&p.Username, &p.Note, &p.Contact} {
+		if *field == nil {
+			*field = new(string)
+		}
+	}
+	if p.Labels == nil {
+		p.Labels = &[]string{}
+	}
+	return nil
+}
+
+func invalidRequestf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+// applyUserPatch validates patch against user and applies the fields it sets.
+func applyUserPatch(user *User, patch UserPatch, now time.Time) error {
+	if patch.TrafficLimitGB != nil && *patch.TrafficLimitGB <= 0 {
+		return invalidRequestf("traffic_limit_gb must be positive")
+	}
+	if patch.TrafficUsedBytes != nil && *patch.TrafficUsedBytes < 0 {
+		return invalidRequestf("traffic_used_bytes must not be negative")
+	}
+	if patch.TimeLimitDays != nil && *patch.TimeLimitDays < 0 {
+		return invalidRequestf("time_limit_days must not be negative")
+	}
+	if patch.TimeLimitDays != nil && *patch.TimeLimitDays > 0 && patch.ExpiresAt.Value != nil {
+		return invalidRequestf("time_limit_days cannot be combined with expires_at")
+	}
+	if patch.TrafficResetStrategy != nil {
+		if err := validateTrafficResetStrategy(*patch.TrafficResetStrategy); err != nil {
+			return invalidRequestf("%v", err)
+		}
+	}
+	if patch.Username != nil && *patch.Username != "" {
+		if err := validateUsername(*patch.Username); err != nil {
+			return err
+		}
+	}
+	if patch.Note != nil {
+		if err := validateProfileText(*patch.Note, ""); err != nil {
+			return err
+		}
+	}
+	if patch.Contact != nil {
+		if err := validateProfileText("", *patch.Contact); err != nil {
+			return err
+		}
+	}
+	var labels []string
+	if patch.Labels != nil {
+		var err error
+		if labels, err = normalizeLabels(*patch.Labels); err != nil {
+			return err
+		}
+	}
+
+	// Status first: it decides how the time limit fields are applied.
+	switch {
+	case patch.Status != nil:
+		status := *patch.Status
+		if patch.IsActive != nil && *patch.IsActive != statusAllowsConnection(status) {
+			return invalidRequestf("is_active=%t contradicts status %q", *patch.IsActive, status)
+		}
+		if status != user.Status {
+			// Sending back the current status (e.g. "limited") is allowed.
+			if err := validateAdminStatus(status); err != nil {
+				return invalidRequestf("%v", err)
+			}
+			if status == UserStatusOnHold && user.ExpiresAt != nil && (patch.TimeLimitDays == nil || *patch.TimeLimitDays == 0) && !(patch.ExpiresAt.Set && patch.ExpiresAt.Value == nil) {
+				// Clearing ExpiresAt would silently make the user unlimited.
+				return invalidRequestf("time_limit_days is required to put a user with an expiry on hold (or expires_at: null to remove the time limit)")
+			}
+			setUserStatus(user, status, "set by admin", now)
+			if status == UserStatusOnHold {
+				// The time limit starts again with the next traffic and
+				// lasts time_limit_days from there.
+				user.StartedAt = nil
+				user.ExpiresAt = nil
+			}
+		}
+	case patch.IsActive != nil && *patch.IsActive && !user.IsActive:
+		setUserStatus(user, UserStatusActive, "enabled by admin", now)
+	case patch.IsActive != nil && !*patch.IsActive && user.IsActive:
+		setUserStatus(user, UserStatusDisabledByAdmin, "disabled by admin", now)
+	}
+
+	if patch.TrafficLimitGB != nil {
+		user.TrafficLimitGB = *patch.TrafficLimitGB
+	}
+	if patch.TrafficUsedBytes != nil {
+		user.TrafficUsedBytes = *patch.TrafficUsedBytes
+	}
+	if patch.TimeLimitDays != nil {
+		switch {
+		case *patch.TimeLimitDays > 0:
+			applyTimeLimitDays(user, *patch.TimeLimitDays)
+		case user.Status == UserStatusOnHold:
+			user.TimeLimitDays = 0
+		}
+		// 0 for other users is what GET returns for them and changes nothing.
+	}
+	// expires_at: null next to time_limit_days (a PUT has to send expires_at)
+	// leaves the limit just set in days alone.
+	if patch.ExpiresAt.Set && (patch.TimeLimitDays == nil || *patch.TimeLimitDays == 0) {
+		if user.Status == UserStatusOnHold && patch.ExpiresAt.Value != nil {
+			return invalidRequestf("expires_at cannot be set for on-hold users, use time_limit_days")
+		}
+		user.ExpiresAt = patch.ExpiresAt.Value
+		if user.Status != UserStatusOnHold {
+			user.TimeLimitDays = 0
+		}
+	}
+	if patch.OnHoldExpireAt.Set {
+		user.OnHoldExpireAt = patch.OnHoldExpireAt.Value
+	}
+	if patch.Username != nil {
+		user.Username = *patch.Username
+	}
+	if patch.Note != nil {
+		user.Note = *patch.Note
+	}
+	if patch.Contact != nil {
+		user.Contact = *patch.Contact
+	}
+	if patch.Labels != nil {
+		user.Labels = labels
+	}
+	if patch.TrafficResetStrategy != nil && patch.TrafficResetStrategy.orNone() != user.TrafficResetStrategy.orNone() {
+		user.TrafficResetStrategy = *patch.TrafficResetStrategy
+		if user.LastTrafficResetAt == nil {
+			// Count the first period from now rather than from CreatedAt,
+			// otherwise switching schedules resets usage on the next tick.
+			resetAt := now.UTC()
+			user.LastTrafficResetAt = &resetAt
+		}
+	}
+
+	// A raised limit or reset usage brings back limited and expired users.
+	reactivateIfWithinLimits(user, now)
+	return nil
+}
+
+// userIDFromRequest returns the user ID from /api/users/{id} or from ?id=.
+func userIDFromRequest(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/api/users/") {
+		if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/"); id != "" {
+			return id
+		}
+	}
+	return r.URL.Query().Get("id")
+}
+
+// modifyUserHandler serves PATCH (change only the fields sent) and PUT
+// (replace every editable field; all of them must be sent) for a user.
+func modifyUserHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := userIDFromRequest(r)
+		if userID == "" {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "User ID is required"})
+			return
+		}
+
+		var patch UserPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if r.Method == http.MethodPut {
+			if err := patch.asReplacement(); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+
+		updatedUser, err := modifyUser(r.Context(), store, userID, patch)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, updatedUser)
+	}
+}
+
+// modifyUser applies patch to the latest stored user, so fields it does not
+// mention (traffic counted meanwhile, for example) are kept, and syncs the
+// result to V2Ray.
+func modifyUser(ctx context.Context, store UserStore, userID string, patch UserPatch) (User, error) {
+	var before, after User
+	now := time.Now().UTC()
+	reservation, err := reserveForChange(ctx, store, userID, now, func(user *User) error {
+		return applyUserPatch(user, patch, now)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	err = persistUsers(ctx, store, func(users UsersConfig) error {
+		user, ok := users[userID]
+		if !ok || !userVisibleTo(ctx, user) {
+			return ErrUserNotFound
+		}
+		before = user
+		if err := applyUserPatch(&user, patch, now); err != nil {
+			return err
+		}
+		if err := checkUsernameFree(users, userID, user.Username); err != nil {
+			return err
+		}
+		if err := reservation.verify(&before, user); err != nil {
+			return err
+		}
+		users[userID] = user
+		after = user
+		return nil
+	})
+	if err != nil {
+		reservation.refund(ctx)
+		log.Printf("ERROR: Failed to update user %s in %s: %v", userID, store.Describe(), err)
+		return User{}, err
+	}
+	recordAudit(ctx, "user.update", userID, before, after)
+
+	if err := syncV2RayUser(&before, &after); err != nil {
+		log.Printf("ERROR: Failed to apply updated user to V2Ray: %v", err)
+		return after, fmt.Errorf("%w: %v", errApplyToV2Ray, err)
+	}
+	return after, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// decodeTestPatch decodes body as a PATCH, or a PUT if replace is set.
+func decodeTestPatch(t *testing.T, body string, replace bool) (UserPatch, error) {
+	t.Helper()
+	var patch UserPatch
+	if err := json.Unmarshal([]byte(body), &patch); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	if replace {
+		return patch, patch.asReplacement()
+	}
+	return patch, nil
+}
+
+func TestApplyUserPatchOnHold(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	expiresAt := now.AddDate(0, 0, 10)
+	startedAt := now.AddDate(0, 0, -20)
+	withExpiry := User{Status: UserStatusActive, IsActive: true, TrafficLimitGB: 1, StartedAt: &startedAt, ExpiresAt: &expiresAt}
+	unlimited := User{Status: UserStatusActive, IsActive: true, TrafficLimitGB: 1}
+
+	tests := []struct {
+		name     string
+		user     User
+		body     string
+		wantErr  bool
+		wantDays int
+	}{
+		{"with time_limit_days", withExpiry, `{"status":"on_hold","time_limit_days":30}`, false, 30},
+		{"expiry without time_limit_days", withExpiry, `{"status":"on_hold"}`, true, 0},
+		{"expiry with time_limit_days 0", withExpiry, `{"status":"on_hold","time_limit_days":0}`, true, 0},
+		{"expiry removed explicitly", withExpiry, `{"status":"on_hold","expires_at":null}`, false, 0},
+		{"unlimited user", unlimited, `{"status":"on_hold"}`, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, _ := decodeTestPatch(t, tt.body, false)
+			user := tt.user
+			err := applyUserPatch(&user, patch, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, errInvalidRequest) {
+					t.Fatalf("err = %v, want errInvalidRequest", err)
+				}
+				return
+			}
+			if user.Status != UserStatusOnHold || user.ExpiresAt != nil || user.StartedAt != nil || user.TimeLimitDays != tt.wantDays {
+				t.Errorf("user %+v, want on hold for %d days", user, tt.wantDays)
+			}
+		})
+	}
+}
+
+func TestApplyUserPatch(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	createdAt := now.AddDate(0, 0, -5)
+	expiresAt := now.AddDate(0, 0, 10)
+	user := User{
+		CreatedAt:      createdAt,
+		Status:         UserStatusActive,
+		IsActive:       true,
+		TrafficLimitGB: 10,
+		ExpiresAt:      &expiresAt,
+		Username:       "alice",
+		Note:           "note",
+		Labels:         []string{"team"},
+	}
+	in30Days := createdAt.AddDate(0, 0, 30)
+	date := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		replace   bool
+		body      string
+		wantErr   bool
+		wantLimit float64
+		wantUntil *time.Time
+		wantName  string
+	}{
+		{name: "PATCH of the traffic limit", body: `{"traffic_limit_gb":20}`, wantLimit: 20, wantUntil: &expiresAt, wantName: "alice"},
+		{name: "PATCH with time_limit_days", body: `{"time_limit_days":30}`, wantLimit: 10, wantUntil: &in30Days, wantName: "alice"},
+		{name: "PATCH with time_limit_days and expires_at null", body: `{"time_limit_days":30,"expires_at":null}`, wantLimit: 10, wantUntil: &in30Days, wantName: "alice"},
+		{name: "PATCH with time_limit_days and expires_at", body: `{"time_limit_days":30,"expires_at":"2024-12-31T00:00:00Z"}`, wantErr: true},
+		{name: "PATCH with expires_at null", body: `{"expires_at":null}`, wantLimit: 10, wantName: "alice"},
+		{name: "PATCH with expires_at", body: `{"expires_at":"2024-12-31T00:00:00Z","time_limit_days":0}`, wantLimit: 10, wantUntil: &date, wantName: "alice"},
+		{name: "PATCH with a negative time_limit_days", body: `{"time_limit_days":-1}`, wantErr: true},
+		{name: "PATCH with a zero traffic limit", body: `{"traffic_limit_gb":0}`, wantErr: true},
+
+		{name: "PUT without required fields", replace: true, body: `{"traffic_limit_gb":20}`, wantErr: true},
+		{name: "PUT with time_limit_days", replace: true, body: `{"traffic_limit_gb":20,"traffic_used_bytes":0,"expires_at":null,"status":"active","traffic_reset_strategy":"none","time_limit_days":30}`, wantLimit: 20, wantUntil: &in30Days},
+		{name: "PUT with expires_at", replace: true, body: `{"traffic_limit_gb":20,"traffic_used_bytes":0,"expires_at":"2024-12-31T00:00:00Z","status":"active","traffic_reset_strategy":"none"}`, wantLimit: 20, wantUntil: &date},
+		{name: "PUT without a time limit", replace: true, body: `{"traffic_limit_gb":20,"traffic_used_bytes":0,"expires_at":null,"status":"active","traffic_reset_strategy":"none","username":"bob"}`, wantLimit: 20, wantName: "bob"},
+		{name: "PUT with time_limit_days and expires_at", replace: true, body: `{"traffic_limit_gb":20,"traffic_used_bytes":0,"expires_at":"2024-12-31T00:00:00Z","status":"active","traffic_reset_strategy":"none","time_limit_days":30}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := decodeTestPatch(t, tt.body, tt.replace)
+			got := user
+			if err == nil {
+				err = applyUserPatch(&got, patch, now)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, errInvalidRequest) {
+					t.Fatalf("err = %v, want errInvalidRequest", err)
+				}
+				return
+			}
+			if got.TrafficLimitGB != tt.wantLimit || got.Username != tt.wantName || got.TimeLimitDays != 0 {
+				t.Errorf("user %+v", got)
+			}
+			if (got.ExpiresAt == nil) != (tt.wantUntil == nil) || got.ExpiresAt != nil && !got.ExpiresAt.Equal(*tt.wantUntil) {
+				t.Errorf("expires_at = %v, want %v", got.ExpiresAt, tt.wantUntil)
+			}
+			if tt.replace && (got.Note != "" || len(got.Labels) != 0) {
+				t.Errorf("PUT kept the optional fields it did not send: %+v", got)
+			}
+		})
+	}
+}
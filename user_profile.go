@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Profile fields help admins tell users apart: a unique username, a free-form
+// note, a contact (email, Telegram handle, ...) and labels for filtering.
+//
+// The username also names the user in V2Ray. EmailTag, the email V2Ray keys
+// access logs and stats counters by, is chosen once when the user is created:
+// the lower-cased username if one was given, "user_"+ID otherwise. Renaming a
+// user keeps the tag, so its stats counters carry on.
+
+const (
+	maxNoteLength    = 1024
+	maxContactLength = 128
+	maxLabels        = 20
+	maxLabelLength   = 32
+)
+
+// errUsernameTaken is returned when another user already has the username.
+// It is reported as 409.
+var errUsernameTaken = errors.New("username is already taken")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{2,31}$`)
+
+// validateUsername checks the format of a non-empty username.
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return invalidRequestf("username must be 3-32 characters: letters, digits, '_', '.' or '-', starting with a letter or digit")
+	}
+	return nil
+}
+
+// checkUsernameFree reports errUsernameTaken if a user other than userID has
+// the username, compared case-insensitively.
+func checkUsernameFree(users UsersConfig, userID, username string) error {
+	if username == "" {
+		return nil
+	}
+	for id, user := range users {
+		if id != userID && strings.EqualFold(user.Username, username) {
+			return errUsernameTaken
+		}
+	}
+	return nil
+}
+
+// normalizeLabels trims labels, drops empty ones and duplicates (ignoring
+// case) and checks their number and length.
+func normalizeLabels(labels []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || seen[strings.ToLower(label)] {
+			continue
+		}
+		if len(label) > maxLabelLength || strings.Contains(label, ",") {
+			return nil, invalidRequestf("labels must be at most %d characters and must not contain commas", maxLabelLength)
+		}
+		seen[strings.ToLower(label)] = true
+		normalized = append(normalized, label)
+	}
+	if len(normalized) > maxLabels {
+		return nil, invalidRequestf("a user can have at most %d labels", maxLabels)
+	}
+	return normalized, nil
+}
+
+// validateProfileText checks the length of the note and contact.
+func validateProfileText(note, contact string) error {
+	if len(note) > maxNoteLength {
+		return invalidRequestf("note must be at most %d characters", maxNoteLength)
+	}
+	if len(contact) > maxContactLength {
+		return invalidRequestf("contact must be at most %d characters", maxContactLength)
+	}
+	return nil
+}
+
+// assignEmailTag picks the V2Ray email tag of a new user, falling back to
+// "user_"+ID when the username is already the tag of another user (one that
+// was renamed since).
+func assignEmailTag(users UsersConfig, user *User) {
+	user.EmailTag = "user_" + user.ID
+	if user.Username == "" {
+		return
+	}
+	tag := strings.ToLower(user.Username)
+	for _, other := range users {
+		if userStatsTag(other) == tag {
+			return
+		}
+	}
+	user.EmailTag = tag
+}
+
+// userHasLabel reports whether the user carries label, ignoring case.
+func userHasLabel(user User, label string) bool {
+	for _, l := range user.Labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// userMatchesSearch reports whether the lower-cased query occurs in the user's
+// ID, username, note or contact.
+func userMatchesSearch(user User, query string) bool {
+	for _, field := range []string{user.ID, user.Username, user.Note, user.Contact} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureEmailTags records the tag of stored users that predate EmailTag. They
+// keep "user_"+ID, which their stats counters already use.
+func ensureEmailTags(ctx context.Context, store UserStore) error {
+	configMutex.RLock()
+	missing := 0
+	for _, user := range currentUsersConfig {
+		if user.EmailTag == "" {
+			missing++
+		}
+	}
+	configMutex.RUnlock()
+	if missing == 0 {
+		return nil
+	}
+
+	log.Printf("Recording V2Ray email tags for %d user(s)", missing)
+	return persistUsers(ctx, store, func(users UsersConfig) error {
+		for id, user := range users {
+			if user.EmailTag == "" {
+				user.EmailTag = "user_" + user.ID
+				users[id] = user
+			}
+		}
+		return nil
+	})
+}
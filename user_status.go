@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// UserStatus is the lifecycle state of a user. IsActive mirrors it for
+// existing clients: it is true exactly when the user may connect.
+type UserStatus string
+
+const (
+	UserStatusActive          UserStatus = "active"            // May connect
+	UserStatusDisabledByAdmin UserStatus = "disabled_by_admin" // Disabled by hand, never reactivated automatically
+	UserStatusLimited         UserStatus = "limited"           // Traffic limit reached
+	UserStatusExpired         UserStatus = "expired"           // Time limit reached
+	UserStatusOnHold          UserStatus = "on_hold"           // May connect; the time limit starts with the first traffic
+)
+
+// statusAllowsConnection reports whether users in status belong in the inbound.
+func statusAllowsConnection(status UserStatus) bool {
+	return status == UserStatusActive || status == UserStatusOnHold
+}
+
+// validateAdminStatus checks a status requested through the API. Only
+// "active", "disabled_by_admin" and "on_hold" can be set by hand; "limited"
+// and "expired" are entered by the monitoring loop.
+func validateAdminStatus(status UserStatus) error {
+	switch status {
+	case "", UserStatusActive, UserStatusDisabledByAdmin, UserStatusOnHold:
+		return nil
+	case UserStatusLimited, UserStatusExpired:
+		return fmt.Errorf("status %q is set automatically and cannot be requested", status)
+	default:
+		return fmt.Errorf("unknown status %q, expected active, disabled_by_admin or on_hold", status)
+	}
+}
+
+// setUserStatus moves user to status, recording why and when, and keeps
+// IsActive in sync. Setting the current status again only updates the reason.
+func setUserStatus(user *User, status UserStatus, reason string, now time.Time) {
+	if user.Status != status {
+		changedAt := now.UTC()
+		user.StatusChangedAt = &changedAt
+	}
+	user.Status = status
+	user.StatusReason = reason
+	user.IsActive = statusAllowsConnection(status)
+}
+
+// limitStatus maps a userLimitExceeded reason to the status it leads to.
+func limitStatus(reason string) UserStatus {
+	if reason == "traffic limit" {
+		return UserStatusLimited
+	}
+	return UserStatusExpired
+}
+
+// neverStarted reports whether user was created on hold and has not
+// connected yet, i.e. it expired at its on-hold deadline.
+func neverStarted(user User) bool {
+	return user.StartedAt == nil && user.OnHoldExpireAt != nil
+}
+
+// startOnHoldUser starts the time limit of an on-hold user at its first traffic.
+func startOnHoldUser(user *User, now time.Time) {
+	startedAt := now.UTC()
+	user.StartedAt = &startedAt
+	setUserStatus(user, UserStatusActive, "first connection", now)
+	if user.TimeLimitDays > 0 {
+		applyTimeLimitDays(user, user.TimeLimitDays)
+	}
+}
+
+// reactivateIfWithinLimits brings a limited or expired user back once no
+// limit is exceeded any more, e.g. after a limit was raised or usage reset.
+// A user that expired on hold without ever connecting goes back on hold.
+// Admin-disabled users are left alone. It reports whether the user changed.
+func reactivateIfWithinLimits(user *User, now time.Time) bool {
+	if user.Status != UserStatusLimited && user.Status != UserStatusExpired {
+		return false
+	}
+	target := UserStatusActive
+	if neverStarted(*user) {
+		target = UserStatusOnHold
+	}
+	candidate := *user
+	candidate.Status = target
+	if userLimitExceeded(candidate, now) != "" {
+		return false
+	}
+	setUserStatus(user, target, fmt.Sprintf("reactivated, no longer %s", user.Status), now)
+	return true
+}
+
+// inferUserStatus derives the status of a user stored before statuses existed.
+func inferUserStatus(user User, now time.Time) (UserStatus, string) {
+	if user.IsActive {
+		return UserStatusActive, ""
+	}
+	if reason := userLimitExceeded(user, now); reason != "" {
+		return limitStatus(reason), reason + " reached"
+	}
+	return UserStatusDisabledByAdmin, "disabled before statuses were recorded"
+}
+
+// ensureUserStatuses fills in Status for stored users that predate it.
+func ensureUserStatuses(ctx context.Context, store UserStore) error {
+	configMutex.RLock()
+	missing := 0
+	for _, user := range currentUsersConfig {
+		if user.Status == "" {
+			missing++
+		}
+	}
+	configMutex.RUnlock()
+	if missing == 0 {
+		return nil
+	}
+
+	log.Printf("Inferring status for %d user(s)", missing)
+	now := time.Now().UTC()
+	return persistUsers(ctx, store, func(users UsersConfig) error {
+		for id, user := range users {
+			if user.Status == "" {
+				status, reason := inferUserStatus(user, now)
+				setUserStatus(&user, status, reason, now)
+				users[id] = user
+			}
+		}
+		return nil
+	})
+}
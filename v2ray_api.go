@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+
+	// Generated by scripts/gen-v2rayapi.sh from the Xray protos
+	"gcvp/internal/v2rayapi/common/protocol"
+	"gcvp/internal/v2rayapi/common/serial"
+	"gcvp/internal/v2rayapi/proxy/shadowsocks_2022"
+	"gcvp/internal/v2rayapi/proxy/trojan"
+	"gcvp/internal/v2rayapi/proxy/vless"
+	"gcvp/internal/v2rayapi/proxy/vmess"
+	handlerService "gcvp/internal/v2rayapi/proxyman/command"
+)
+
+const (
+	v2rayGrpcAPIAddress = "127.0.0.1:10085" // As configured in generateV2RayConfig
+	vlessInboundTag     = "vless-in"        // Tag of the default user-facing inbound
+	v2rayUserLevel      = 0                 // Policy level assigned to every user
+	v2rayAPITimeout     = 5 * time.Second
+)
+
+var (
+	v2rayAPIConn      *grpc.ClientConn
+	v2rayAPIConnMutex = &sync.Mutex{}
+)
+
+// userStatsTag returns the email tag V2Ray uses for a user's stats counters
+// and access logs. Users stored before EmailTag existed use "user_"+ID.
+func userStatsTag(user User) string {
+	if user.EmailTag != "" {
+		return user.EmailTag
+	}
+	return "user_" + user.ID
+}
+
+// v2rayAPIConnection returns the shared gRPC connection to the V2Ray API inbound,
+// dialing it lazily on first use.
+func v2rayAPIConnection() (*grpc.ClientConn, error) {
+	v2rayAPIConnMutex.Lock()
+	defer v2rayAPIConnMutex.Unlock()
+
+	if v2rayAPIConn != nil {
+		return v2rayAPIConn, nil
+	}
+	conn, err := grpc.Dial(v2rayGrpcAPIAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("grpc.Dial %s: %v", v2rayGrpcAPIAddress, err)
+	}
+	v2rayAPIConn = conn
+	return v2rayAPIConn, nil
+}
+
+// resetV2RayAPIConnection closes the shared connection so the next call redials.
+// The supervisor calls it whenever a new V2Ray process becomes ready.
+func resetV2RayAPIConnection() {
+	v2rayAPIConnMutex.Lock()
+	defer v2rayAPIConnMutex.Unlock()
+
+	if v2rayAPIConn != nil {
+		v2rayAPIConn.Close()
+		v2rayAPIConn = nil
+	}
+}
+
+// typedMessage wraps message the way Xray's serial.ToTypedMessage does. That
+// helper is hand-written Go in xray-core, so it is not among the generated
+// packages.
+func typedMessage(message proto.Message) *serial.TypedMessage {
+	value, _ := proto.Marshal(message) // Cannot fail for these proto3 messages
+	return &serial.TypedMessage{
+		Type:  string(message.ProtoReflect().Descriptor().FullName()),
+		Value: value,
+	}
+}
+
+// inboundAccount returns the user's account for the protocol of the inbound,
+// matching the clients inboundClient writes to the config file.
+func inboundAccount(def InboundDefinition, user User) *serial.TypedMessage {
+	switch def.Protocol {
+	case protocolVMess:
+		return typedMessage(&vmess.Account{
+			Id:               user.ID,
+			SecuritySettings: &protocol.SecurityConfig{Type: protocol.SecurityType_AUTO},
+		})
+	case protocolTrojan:
+		return typedMessage(&trojan.Account{Password: user.TrojanPassword})
+	case protocolShadowsocks:
+		// Email and level come from the protocol.User around the account.
+		return typedMessage(&shadowsocks_2022.Account{Key: userSSKey(user, def.Method)})
+	default:
+		return typedMessage(&vless.Account{Id: user.ID, Encryption: "none"})
+	}
+}
+
+// addV2RayUser adds the user to every running user-facing inbound through
+// HandlerService. Adding a user that is already present is not treated as an error.
+func addV2RayUser(user User) error {
+	conn, err := v2rayAPIConnection()
+	if err != nil {
+		return err
+	}
+	client := handlerService.NewHandlerServiceClient(conn)
+
+	tag := userStatsTag(user)
+	for _, def := range v2rayInbounds {
+		ctx, cancel := context.WithTimeout(context.Background(), v2rayAPITimeout)
+		_, err = client.AlterInbound(ctx, &handlerService.AlterInboundRequest{
+			Tag: def.Tag,
+			Operation: typedMessage(&handlerService.AddUserOperation{
+				User: &protocol.User{
+					Level:   v2rayUserLevel,
+					Email:   tag,
+					Account: inboundAccount(def, user),
+				},
+			}),
+		})
+		cancel()
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("AlterInbound add %s to %s: %v", tag, def.Tag, err)
+		}
+		log.Printf("Added user %s (tag: %s) to inbound %s", user.ID, tag, def.Tag)
+	}
+	return nil
+}
+
+// removeV2RayUser removes the user from every running user-facing inbound
+// through HandlerService. Removing a user that is not present is not treated as an error.
+func removeV2RayUser(user User) error {
+	conn, err := v2rayAPIConnection()
+	if err != nil {
+		return err
+	}
+	client := handlerService.NewHandlerServiceClient(conn)
+
+	tag := userStatsTag(user)
+	for _, def := range v2rayInbounds {
+		ctx, cancel := context.WithTimeout(context.Background(), v2rayAPITimeout)
+		_, err = client.AlterInbound(ctx, &handlerService.AlterInboundRequest{
+			Tag:       def.Tag,
+			Operation: typedMessage(&handlerService.RemoveUserOperation{Email: tag}),
+		})
+		cancel()
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			return fmt.Errorf("AlterInbound remove %s from %s: %v", tag, def.Tag, err)
+		}
+		log.Printf("Removed user %s (tag: %s) from inbound %s", user.ID, tag, def.Tag)
+	}
+	return nil
+}
+
+// syncV2RayUser applies a single user change to the running V2Ray process.
+// before is nil for a newly created user and after is nil for a deleted one.
+// If the HandlerService call fails, it falls back to a full restart so the
+// running process never drifts from currentUsersConfig.
+func syncV2RayUser(before, after *User) error {
+	wasActive := before != nil && before.IsActive
+	isActive := after != nil && after.IsActive
+
+	var err error
+	switch {
+	case !wasActive && isActive:
+		err = addV2RayUser(*after)
+	case wasActive && !isActive:
+		err = removeV2RayUser(*before)
+	default:
+		return nil // Nothing the inbound cares about has changed
+	}
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("WARN: Hot user update via HandlerService failed, falling back to V2Ray restart: %v", err)
+	return handleRestartV2Ray()
+}